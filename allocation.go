@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AllocationStrategy selects which free identifier is handed out next
+type AllocationStrategy string
+
+const (
+	// StrategyLowestFirst allocates the free identifier that sorts first in natural order
+	StrategyLowestFirst AllocationStrategy = "lowest_first"
+	// StrategyLeastRecentlyUsed prefers identifiers that have never been used, then the ones released longest ago
+	StrategyLeastRecentlyUsed AllocationStrategy = "least_recently_used"
+	// StrategyRandom picks any free identifier at random
+	StrategyRandom AllocationStrategy = "random"
+	// StrategyRoundRobin walks the pool in natural order, continuing after the last allocation
+	StrategyRoundRobin AllocationStrategy = "round_robin"
+)
+
+// parseAllocationStrategy validates a configured strategy name, defaulting to lowest_first
+func parseAllocationStrategy(name string) (AllocationStrategy, error) {
+	switch strategy := AllocationStrategy(name); strategy {
+	case "":
+		return StrategyLowestFirst, nil
+	case StrategyLowestFirst, StrategyLeastRecentlyUsed, StrategyRandom, StrategyRoundRobin:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown allocation strategy %q", name)
+	}
+}
+
+// initAllocationCursors creates the table the round_robin strategy records, per pool, the last
+// identifier it handed out in, so that the walk survives restarts and is shared by every replica
+// of the database. The cursor names the identifier rather than its sort key, since sort keys
+// are renumbered whenever identifiers are added or removed.
+func initAllocationCursors() {
+	legacy, err := hasColumn("allocation_cursors", "sort_key")
+	if err != nil {
+		log.Fatalf("Failed to inspect allocation_cursors table: %v", err)
+	}
+	if legacy {
+		// An earlier layout kept the sort key; carry its cursors over as identifiers
+		_, err = db.Exec(`
+		ALTER TABLE allocation_cursors RENAME TO allocation_cursors_sort_key;
+		CREATE TABLE allocation_cursors (
+			pool TEXT PRIMARY KEY,
+			identifier TEXT NOT NULL
+		);
+		INSERT INTO allocation_cursors (pool, identifier)
+			SELECT c.pool, i.identifier
+			FROM allocation_cursors_sort_key c JOIN identifiers i ON i.sort_key = c.sort_key;
+		DROP TABLE allocation_cursors_sort_key;`)
+	} else {
+		_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS allocation_cursors (
+			pool TEXT PRIMARY KEY,
+			identifier TEXT NOT NULL
+		);`)
+	}
+	if err != nil {
+		log.Fatalf("Failed to create allocation_cursors table: %v", err)
+	}
+}
+
+// loadAllocationCursors maps every pool to the last identifier round_robin handed out in it
+func loadAllocationCursors(q queryer) (map[string]string, error) {
+	rows, err := q.Query(`SELECT pool, identifier FROM allocation_cursors`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cursors := make(map[string]string)
+	for rows.Next() {
+		var pool, identifier string
+		if err := rows.Scan(&pool, &identifier); err != nil {
+			return nil, err
+		}
+		cursors[pool] = identifier
+	}
+	return cursors, rows.Err()
+}
+
+// orderClause returns the ORDER BY clause used to pick the next free identifier in pool, and its arguments
+func (s AllocationStrategy) orderClause(pool string) (string, []interface{}) {
+	switch s {
+	case StrategyLeastRecentlyUsed:
+		return "ORDER BY released_at IS NOT NULL, released_at, sort_key", nil
+	case StrategyRandom:
+		return "ORDER BY RANDOM()", nil
+	case StrategyRoundRobin:
+		// Identifiers after the cursor's current position come first, then wrap around to the
+		// start of the pool. The walk starts over if the cursor's identifier was removed.
+		return `ORDER BY sort_key <= COALESCE((
+				SELECT i.sort_key FROM allocation_cursors c JOIN identifiers i ON i.identifier = c.identifier
+				WHERE c.pool = ?
+			), 0), sort_key`,
+			[]interface{}{pool}
+	default:
+		return "ORDER BY sort_key", nil
+	}
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// allocateNextIdentifier locks the next free identifier in pool for clientID according to the configured strategy.
+// Identifiers still in their reuse cooldown are skipped. It returns sql.ErrNoRows when the pool is exhausted.
+func allocateNextIdentifier(q queryer, pool, clientID string, ttl time.Duration, metadata Metadata, now time.Time) (string, error) {
+	order, orderArgs := config.Identifiers.Strategy.orderClause(pool)
+
+	args := append([]interface{}{clientID, now, metadata, ttlColumn(ttl), pool, cooldownThreshold(now)}, orderArgs...)
+
+	var identifier string
+	err := q.QueryRow(`
+		UPDATE identifiers
+		SET locked_by = ?, last_seen = ?, metadata = ?, ttl = ?, released_by = NULL
+		WHERE identifier IN (
+			SELECT identifier FROM identifiers
+			WHERE locked_by IS NULL AND pool = ? AND (released_at IS NULL OR released_at <= ?)
+			`+order+` LIMIT 1
+		)
+		RETURNING identifier`,
+		args...,
+	).Scan(&identifier)
+	if err != nil {
+		return "", err
+	}
+
+	if config.Identifiers.Strategy == StrategyRoundRobin {
+		_, err = q.Exec(`
+			INSERT INTO allocation_cursors (pool, identifier) VALUES (?, ?)
+			ON CONFLICT (pool) DO UPDATE SET identifier = excluded.identifier`,
+			pool, identifier,
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return identifier, nil
+}
+
+// allocateIdentifiers makes sure clientID holds count identifiers from pool, allocating the
+// shortfall in one transaction so that either all of them are allocated or none are.
+// Identifiers the client already holds are kept, renewed and have metadata merged in. Every one
+// of them gets the lease TTL ttl.
+// It returns every identifier the client holds in the pool, or sql.ErrNoRows if the pool
+// cannot satisfy the request.
+func allocateIdentifiers(pool, clientID string, count int, ttl time.Duration, metadata Metadata, now time.Time) ([]string, error) {
+	if cluster != nil {
+		return cluster.allocateIdentifiers(pool, clientID, count, ttl, metadata, now)
+	}
+
+	var held []string
+	_, err := commitEvents(func(tx *sql.Tx) ([]Event, error) {
+		var allocated []Event
+		var err error
+		held, allocated, err = allocateIdentifiersTx(tx, pool, clientID, count, ttl, metadata, now)
+		return allocated, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Identifiers the client already held may have been given a new TTL
+	if heartbeats != nil {
+		heartbeats.forget(held)
+	}
+	return held, nil
+}
+
+// allocateIdentifiersTx does the work of allocateIdentifiers inside a transaction, and returns
+// the allocate events to publish once it commits
+func allocateIdentifiersTx(q queryer, pool, clientID string, count int, ttl time.Duration, metadata Metadata, now time.Time) ([]string, []Event, error) {
+	rows, err := q.Query(`
+		SELECT identifier, metadata
+		FROM identifiers
+		WHERE locked_by = ? AND pool = ?
+		ORDER BY sort_key`,
+		clientID, pool,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var held []string
+	existing := make(map[string]Metadata)
+	for rows.Next() {
+		var identifier string
+		var stored sql.NullString
+		if err := rows.Scan(&identifier, &stored); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		held = append(held, identifier)
+		existing[identifier] = parseMetadata(stored)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for identifier, stored := range existing {
+		if _, err := q.Exec(`UPDATE identifiers SET last_seen = ?, metadata = ?, ttl = ? WHERE identifier = ?`,
+			now, stored.merge(metadata), ttlColumn(ttl), identifier); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var allocated []Event
+	for len(held) < count {
+		identifier, err := allocateNextIdentifier(q, pool, clientID, ttl, metadata, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		held = append(held, identifier)
+		allocated = append(allocated, Event{Type: EventAllocate, Pool: pool, ClientID: clientID, Identifier: identifier})
+	}
+	return held, allocated, nil
+}
+
+// touchClientIdentifiers records a liveness probe for every identifier clientID holds, or only
+// for those of identifiers it holds if any are given, merging in metadata if given. It returns
+// the number of identifiers updated.
+func touchClientIdentifiers(clientID string, identifiers []string, metadata Metadata, now time.Time) (int, error) {
+	if cluster != nil {
+		return cluster.touchClientIdentifiers(clientID, identifiers, metadata, now)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	touched, err := touchClientIdentifiersTx(tx, clientID, identifiers, metadata, now)
+	if err != nil {
+		return 0, err
+	}
+	return touched, tx.Commit()
+}
+
+// touchClientIdentifiersTx does the work of touchClientIdentifiers inside a transaction
+func touchClientIdentifiersTx(q queryer, clientID string, identifiers []string, metadata Metadata, now time.Time) (int, error) {
+	query := `SELECT identifier, metadata FROM identifiers WHERE locked_by = ?`
+	args := []interface{}{clientID}
+	if len(identifiers) > 0 {
+		query += ` AND identifier IN (` + strings.TrimSuffix(strings.Repeat("?, ", len(identifiers)), ", ") + `)`
+		for _, identifier := range identifiers {
+			args = append(args, identifier)
+		}
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	stored := make(map[string]Metadata)
+	for rows.Next() {
+		var identifier string
+		var column sql.NullString
+		if err := rows.Scan(&identifier, &column); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stored[identifier] = parseMetadata(column)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for identifier, existing := range stored {
+		if len(metadata) > 0 {
+			_, err = q.Exec(`UPDATE identifiers SET last_seen = ?, metadata = ? WHERE identifier = ?`,
+				now, existing.merge(metadata), identifier)
+		} else {
+			_, err = q.Exec(`UPDATE identifiers SET last_seen = ? WHERE identifier = ?`, now, identifier)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(stored), nil
+}
+
+// cooldownThreshold returns the release time before which an identifier is out of quarantine
+func cooldownThreshold(now time.Time) time.Time {
+	return now.Add(-config.Server.ReuseCooldown)
+}
+
+// assignSortKeys numbers every identifier in the table by natural sort order,
+// so strategies can order by a plain integer column.
+func assignSortKeys() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := assignSortKeysTx(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// assignSortKeysTx does the work of assignSortKeys inside a transaction
+func assignSortKeysTx(q queryer) error {
+	rows, err := q.Query(`SELECT identifier FROM identifiers`)
+	if err != nil {
+		return err
+	}
+
+	var identifiers []string
+	for rows.Next() {
+		var identifier string
+		if err := rows.Scan(&identifier); err != nil {
+			rows.Close()
+			return err
+		}
+		identifiers = append(identifiers, identifier)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(identifiers, func(i, j int) bool {
+		return naturalLess(identifiers[i], identifiers[j])
+	})
+
+	stmt, err := q.Prepare(`UPDATE identifiers SET sort_key = ? WHERE identifier = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, identifier := range identifiers {
+		if _, err := stmt.Exec(i+1, identifier); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// naturalLess compares two strings treating runs of digits as numbers, so "id-2" sorts before "id-10"
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			numA, restA := splitDigits(a)
+			numB, restB := splitDigits(b)
+
+			// Compare numerically by ignoring leading zeros, then by length, then lexically
+			trimmedA, trimmedB := trimZeros(numA), trimZeros(numB)
+			if len(trimmedA) != len(trimmedB) {
+				return len(trimmedA) < len(trimmedB)
+			}
+			if trimmedA != trimmedB {
+				return trimmedA < trimmedB
+			}
+			if len(numA) != len(numB) {
+				return len(numA) < len(numB)
+			}
+
+			a, b = restA, restB
+			continue
+		}
+
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func trimZeros(s string) string {
+	for len(s) > 1 && s[0] == '0' {
+		s = s[1:]
+	}
+	return s
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// setupTestDB points the global config and db at a fresh database preloaded with patterns
+func setupTestDB(t testing.TB, strategy AllocationStrategy, patterns ...string) {
+	t.Helper()
+
+	config = &Config{
+		Server: ServerConfig{StaleTimeout: 90 * time.Second},
+		Database: DatabaseConfig{
+			Driver:     "sqlite3",
+			Datasource: filepath.Join(t.TempDir(), "identifiers.db"),
+		},
+		Identifiers: IdentifierConfig{Patterns: patterns, Strategy: strategy, MaxPerClient: 1},
+	}
+	config.Database.applyDefaults()
+
+	initDB()
+	t.Cleanup(func() { db.Close() })
+
+	preloadIdentifiers()
+
+	waitlist = newAllocationWaitlist()
+	poolLevels.Lock()
+	poolLevels.levels = make(map[string]EventType)
+	poolLevels.Unlock()
+}
+
+func mustAllocate(t *testing.T, clientID string) string {
+	t.Helper()
+
+	identifier, err := allocateNextIdentifier(db, DefaultPool, clientID, 0, nil, time.Now())
+	if err != nil {
+		t.Fatalf("allocate for %s: %v", clientID, err)
+	}
+	return identifier
+}
+
+func mustRelease(t *testing.T, identifier string, at time.Time) {
+	t.Helper()
+
+	_, err := db.Exec(`
+		UPDATE identifiers
+		SET locked_by = NULL, last_seen = NULL, released_at = ?
+		WHERE identifier = ?`,
+		at, identifier,
+	)
+	if err != nil {
+		t.Fatalf("release %s: %v", identifier, err)
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	got := []string{"id-10", "id-2", "id-1", "id-02", "id-1-3", "id-1-20", "host-9", "id"}
+	sort.Slice(got, func(i, j int) bool { return naturalLess(got[i], got[j]) })
+
+	want := []string{"host-9", "id", "id-1", "id-1-3", "id-1-20", "id-2", "id-02", "id-10"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("natural order = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestParseAllocationStrategy(t *testing.T) {
+	if s, err := parseAllocationStrategy(""); err != nil || s != StrategyLowestFirst {
+		t.Errorf("empty strategy = %q, %v; want lowest_first", s, err)
+	}
+	if _, err := parseAllocationStrategy("most_recent"); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+}
+
+func TestLowestFirstAllocatesInNaturalOrder(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[8-11]", "vm-[1-2]")
+
+	want := []string{"vm-1", "vm-2", "vm-8", "vm-9", "vm-10", "vm-11"}
+	for i, w := range want {
+		if got := mustAllocate(t, "client-"+w); got != want[i] {
+			t.Fatalf("allocation %d = %s, want %s", i, got, w)
+		}
+	}
+
+	// A released low identifier is handed out again before anything else
+	mustRelease(t, "vm-2", time.Now())
+	if got := mustAllocate(t, "client-again"); got != "vm-2" {
+		t.Fatalf("after release got %s, want vm-2", got)
+	}
+}
+
+func TestLeastRecentlyUsedAvoidsJustReleased(t *testing.T) {
+	setupTestDB(t, StrategyLeastRecentlyUsed, "vm-[1-4]")
+
+	mustAllocate(t, "a") // vm-1
+	mustAllocate(t, "b") // vm-2
+
+	now := time.Now()
+	mustRelease(t, "vm-1", now.Add(-time.Minute))
+	mustRelease(t, "vm-2", now.Add(-time.Hour))
+
+	// Never-used identifiers come first, then the one released longest ago
+	want := []string{"vm-3", "vm-4", "vm-2", "vm-1"}
+	for i, w := range want {
+		if got := mustAllocate(t, "c"+w); got != w {
+			t.Fatalf("allocation %d = %s, want %s", i, got, w)
+		}
+	}
+}
+
+func TestRoundRobinContinuesAfterLastAllocation(t *testing.T) {
+	setupTestDB(t, StrategyRoundRobin, "vm-[1-4]")
+
+	mustAllocate(t, "a") // vm-1
+	mustAllocate(t, "b") // vm-2
+
+	// Releasing vm-1 must not send the next allocation back to the start
+	mustRelease(t, "vm-1", time.Now())
+	if got := mustAllocate(t, "c"); got != "vm-3" {
+		t.Fatalf("got %s, want vm-3", got)
+	}
+	if got := mustAllocate(t, "d"); got != "vm-4" {
+		t.Fatalf("got %s, want vm-4", got)
+	}
+
+	// The cursor wraps around to the lowest free identifier
+	if got := mustAllocate(t, "e"); got != "vm-1" {
+		t.Fatalf("got %s, want vm-1 after wrap", got)
+	}
+}
+
+func TestRoundRobinCursorSurvivesRestart(t *testing.T) {
+	setupTestDB(t, StrategyRoundRobin, "vm-[1-4]")
+
+	mustAllocate(t, "a") // vm-1
+	mustAllocate(t, "b") // vm-2
+	mustRelease(t, "vm-1", time.Now())
+	mustRelease(t, "vm-2", time.Now())
+
+	if err := db.QueryRow(`SELECT identifier FROM allocation_cursors WHERE pool = ?`, DefaultPool).Scan(new(string)); err != nil {
+		t.Fatalf("cursor not persisted: %v", err)
+	}
+	db.Close()
+
+	// A restarted registry continues after vm-2 instead of starting over at vm-1
+	initDB()
+	if got := mustAllocate(t, "c"); got != "vm-3" {
+		t.Fatalf("got %s after restart, want vm-3", got)
+	}
+}
+
+func TestRoundRobinOrderSurvivesPoolGrowth(t *testing.T) {
+	setupTestDB(t, StrategyRoundRobin, "vm-[1-4]")
+	config.Identifiers.Pools = []PoolConfig{{Name: "gpu", Patterns: []string{"gpu-[1-2]"}, MaxPerClient: 1}}
+	preloadIdentifiers()
+
+	mustAllocate(t, "a") // vm-1
+	mustAllocate(t, "b") // vm-2
+	mustRelease(t, "vm-1", time.Now())
+	mustRelease(t, "vm-2", time.Now())
+
+	// Growing another pool whose identifiers sort first renumbers every sort key
+	if err := resizePool(true, "gpu", 1, []string{"gpu-3", "gpu-4"}, time.Now()); err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+
+	for _, want := range []string{"vm-3", "vm-4", "vm-1"} {
+		if got := mustAllocate(t, want+"-client"); got != want {
+			t.Fatalf("got %s after growth, want %s", got, want)
+		}
+	}
+}
+
+func TestRoundRobinCursorMigratesFromSortKey(t *testing.T) {
+	setupTestDB(t, StrategyRoundRobin, "vm-[1-4]")
+
+	// A database from before cursors named their identifier
+	if _, err := db.Exec(`
+		DROP TABLE allocation_cursors;
+		CREATE TABLE allocation_cursors (pool TEXT PRIMARY KEY, sort_key INTEGER NOT NULL);
+		INSERT INTO allocation_cursors (pool, sort_key) VALUES ('default', 2);`); err != nil {
+		t.Fatal(err)
+	}
+	initAllocationCursors()
+
+	if got := mustAllocate(t, "a"); got != "vm-3" {
+		t.Fatalf("got %s after migrating the cursor, want vm-3", got)
+	}
+}
+
+func TestRandomAllocatesEveryIdentifierOnce(t *testing.T) {
+	setupTestDB(t, StrategyRandom, "vm-[1-20]")
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		id := mustAllocate(t, "client-"+string(rune('a'+i)))
+		if seen[id] {
+			t.Fatalf("identifier %s allocated twice", id)
+		}
+		seen[id] = true
+	}
+
+	if _, err := allocateNextIdentifier(db, DefaultPool, "overflow", 0, nil, time.Now()); err != sql.ErrNoRows {
+		t.Fatalf("exhausted pool returned %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestReuseCooldownSkipsQuarantinedIdentifiers(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	config.Server.ReuseCooldown = 5 * time.Minute
+
+	mustAllocate(t, "a") // vm-1
+	now := time.Now()
+	mustRelease(t, "vm-1", now.Add(-time.Minute))
+
+	// vm-1 is still cooling down, so the next allocation skips it
+	if got := mustAllocate(t, "b"); got != "vm-2" {
+		t.Fatalf("got %s, want vm-2", got)
+	}
+	if _, err := allocateNextIdentifier(db, DefaultPool, "c", 0, nil, now); err != sql.ErrNoRows {
+		t.Fatalf("quarantined pool returned %v, want sql.ErrNoRows", err)
+	}
+
+	// Once the cooldown has elapsed vm-1 is allocatable again
+	if _, err := allocateNextIdentifier(db, DefaultPool, "c", 0, nil, now.Add(5*time.Minute)); err != nil {
+		t.Fatalf("allocate after cooldown: %v", err)
+	}
+}
+
+func TestAllocateIdentifiersIsAllOrNothing(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-5]")
+
+	held, err := allocateIdentifiers(DefaultPool, "host-a", 3, 0, nil, time.Now())
+	if err != nil || len(held) != 3 {
+		t.Fatalf("allocate 3 = %v, %v", held, err)
+	}
+
+	// Asking again for the same count is idempotent
+	again, err := allocateIdentifiers(DefaultPool, "host-a", 3, 0, nil, time.Now())
+	if err != nil || len(again) != 3 || again[0] != held[0] {
+		t.Fatalf("repeat allocate = %v, %v; want %v", again, err, held)
+	}
+
+	// Only two identifiers remain, so a request for three must allocate none
+	if _, err := allocateIdentifiers(DefaultPool, "host-b", 3, 0, nil, time.Now()); err != sql.ErrNoRows {
+		t.Fatalf("oversized allocation returned %v, want sql.ErrNoRows", err)
+	}
+	var free int
+	db.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE locked_by IS NULL`).Scan(&free)
+	if free != 2 {
+		t.Fatalf("%d identifiers free after failed batch, want 2", free)
+	}
+}
+
+func TestTouchOnlyGivenIdentifiers(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+	config.Identifiers.MaxPerClient = 2
+
+	now := time.Now()
+	if _, err := allocateIdentifiers(DefaultPool, "a", 2, 0, nil, now); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	// A streaming lease keeps alive only the identifiers it was allocated
+	if touched, err := touchClientIdentifiers("a", []string{"vm-1"}, nil, now.Add(time.Minute)); err != nil || touched != 1 {
+		t.Fatalf("touch vm-1 = %d, %v; want 1", touched, err)
+	}
+	if touched, err := touchClientIdentifiers("a", nil, nil, now.Add(2*time.Minute)); err != nil || touched != 2 {
+		t.Fatalf("touch all = %d, %v; want 2", touched, err)
+	}
+	if touched, err := touchClientIdentifiers("b", []string{"vm-1"}, nil, now.Add(2*time.Minute)); err != nil || touched != 0 {
+		t.Fatalf("touch by another client = %d, %v; want 0", touched, err)
+	}
+}
+
+func TestOnlyPreviousOwnerReclaimsDuringCooldown(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	config.Server.ReuseCooldown = 5 * time.Minute
+
+	now := time.Now()
+	mustAllocate(t, "a")
+	if _, err := releaseIdentifiers("a", "vm-1", now); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	// Another client cannot jump the cooldown with a liveness probe
+	result, err := recordLiveness(db, LivenessRequest{ClientID: "b", Identifier: "vm-1"}, now.Add(time.Minute))
+	if err != nil || result.Status != LivenessConflict || result.Owner != "a" {
+		t.Fatalf("probe from b = %+v, %v; want a conflict with a", result, err)
+	}
+
+	// The client that released it can take it back
+	result, err = recordLiveness(db, LivenessRequest{ClientID: "a", Identifier: "vm-1"}, now.Add(time.Minute))
+	if err != nil || result.Status != LivenessReassociated {
+		t.Fatalf("probe from a = %+v, %v; want reassociated", result, err)
+	}
+	if _, err := releaseIdentifiers("a", "vm-1", now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	// Once the cooldown has elapsed anyone may claim it
+	result, err = recordLiveness(db, LivenessRequest{ClientID: "b", Identifier: "vm-1"}, now.Add(8*time.Minute))
+	if err != nil || result.Status != LivenessReassociated {
+		t.Fatalf("probe from b after the cooldown = %+v, %v; want reassociated", result, err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupPrefix and backupLayout name the files in the backup directory, so that they sort by age
+const (
+	backupPrefix = "identifiers-"
+	backupLayout = "20060102-150405.000"
+)
+
+// BackupInfo describes a backup file
+type BackupInfo struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// backupDatabase writes a consistent copy of the live database to dest. VACUUM INTO refuses
+// to write over a file that is not empty, and reads inside a single transaction. It runs on a
+// read-only connection of its own rather than one from the pool, which may have a single
+// connection, so writers carry on while it runs.
+func backupDatabase(dest string) error {
+	source, err := sql.Open("sqlite3", readOnlyDatasource(config.Database))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	ctx := context.Background()
+	conn, err := source.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", databasePath(config.Database.Datasource), err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `VACUUM INTO ?`, dest); err != nil {
+		return fmt.Errorf("back up to %s: %v", dest, err)
+	}
+	return nil
+}
+
+// readOnlyDatasource opens the file behind a SQLite datasource read-only, waiting for the
+// configured busy timeout like the pool's connections
+func readOnlyDatasource(c DatabaseConfig) string {
+	datasource := "file:" + databasePath(c.Datasource) + "?mode=ro"
+	if c.BusyTimeout > 0 {
+		datasource += fmt.Sprintf("&_busy_timeout=%d", c.BusyTimeout.Milliseconds())
+	}
+	return datasource
+}
+
+// createBackup takes a backup into the backup directory and prunes old backups down to the
+// configured retention
+func createBackup(now time.Time) (BackupInfo, error) {
+	dir := config.Database.Backup.Directory
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return BackupInfo{}, err
+	}
+
+	path := filepath.Join(dir, backupPrefix+now.UTC().Format(backupLayout)+".db")
+	if err := backupDatabase(path); err != nil {
+		return BackupInfo{}, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	if err := pruneBackups(dir, config.Database.Backup.Retain); err != nil {
+		log.Printf("Error pruning backups: %v", err)
+	}
+
+	return BackupInfo{Path: path, Size: stat.Size(), CreatedAt: now}, nil
+}
+
+// pruneBackups deletes all but the newest retain backups in dir
+func pruneBackups(dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*.db"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+
+	for len(backups) > retain {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		log.Printf("Deleted old backup %s", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// startBackupScheduler takes a backup every configured interval, if one is set
+func startBackupScheduler() {
+	interval := config.Database.Backup.Interval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !isLeader() {
+				continue
+			}
+
+			backup, err := createBackup(time.Now())
+			if err != nil {
+				log.Printf("Scheduled backup failed: %v", err)
+				continue
+			}
+			log.Printf("Scheduled backup written to %s (%d bytes)", backup.Path, backup.Size)
+		}
+	}()
+
+	log.Printf("Backing up the database every %s to %s", interval, config.Database.Backup.Directory)
+}
+
+// verifyDatabase checks that the file at path is an intact registry database
+func verifyDatabase(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	check, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer check.Close()
+
+	var result string
+	if err := check.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("integrity check: %v", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check: %s", result)
+	}
+
+	var identifiers int
+	if err := check.QueryRow(`SELECT COUNT(*) FROM identifiers`).Scan(&identifiers); err != nil {
+		return fmt.Errorf("not a registry database: %v", err)
+	}
+	return nil
+}
+
+// restoreDatabase verifies the backup at src and swaps it in as the database file at dest.
+// The file it replaces is kept next to it with a .pre-restore suffix, together with its
+// write-ahead log if one is left. The server must not be running.
+func restoreDatabase(src, dest string) error {
+	if err := verifyDatabase(src); err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+
+	// Copy next to the destination first, so that the swap itself is a rename
+	staged := dest + ".restoring"
+	if err := copyFile(src, staged); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	if err := verifyDatabase(staged); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("copy of %s: %v", src, err)
+	}
+
+	if _, err := os.Stat(dest); err == nil {
+		// Fold a leftover write-ahead log into the old file, so the copy kept aside is complete
+		if _, err := os.Stat(dest + "-wal"); err == nil {
+			if err := checkpointDatabase(dest); err != nil {
+				log.Printf("Could not checkpoint %s before restoring over it: %v", dest, err)
+			}
+		}
+		if err := os.Rename(dest, dest+".pre-restore"); err != nil {
+			os.Remove(staged)
+			return err
+		}
+		// Whatever is left of the log moves with the file it belongs to
+		for _, suffix := range []string{"-wal", "-shm"} {
+			if err := os.Rename(dest+suffix, dest+".pre-restore"+suffix); err != nil && !os.IsNotExist(err) {
+				os.Remove(staged)
+				return err
+			}
+		}
+	} else {
+		// A write-ahead log without its database would be applied to the restored file
+		for _, suffix := range []string{"-wal", "-shm"} {
+			os.Remove(dest + suffix)
+		}
+	}
+	return os.Rename(staged, dest)
+}
+
+// checkpointDatabase writes the write-ahead log of the database at path into the file and truncates it
+func checkpointDatabase(path string) error {
+	conn, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var busy, pages, checkpointed int
+	if err := conn.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &pages, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("database is in use")
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// databasePath returns the file behind a SQLite datasource such as "file:x.db?mode=rwc"
+func databasePath(datasource string) string {
+	path := strings.TrimPrefix(datasource, "file:")
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// backupHandler takes an online backup into the backup directory
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	backup, err := createBackup(time.Now())
+	if err != nil {
+		log.Printf("Error backing up database: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Backup written to %s (%d bytes)", backup.Path, backup.Size)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backup)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRetentionAndRestore(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+	config.Database.Backup = BackupConfig{Directory: filepath.Join(t.TempDir(), "backups"), Retain: 2}
+
+	mustAllocate(t, "a")
+
+	start := time.Now()
+	var backups []BackupInfo
+	for i := 0; i < 3; i++ {
+		backup, err := createBackup(start.Add(time.Duration(i) * time.Second))
+		if err != nil {
+			t.Fatalf("backup %d: %v", i, err)
+		}
+		backups = append(backups, backup)
+	}
+
+	// Only the newest backups are kept
+	kept, _ := filepath.Glob(filepath.Join(config.Database.Backup.Directory, "*.db"))
+	if len(kept) != 2 || kept[0] != backups[1].Path || kept[1] != backups[2].Path {
+		t.Fatalf("kept %v, want the last two of %+v", kept, backups)
+	}
+
+	if err := verifyDatabase(backups[2].Path); err != nil {
+		t.Fatalf("verify backup: %v", err)
+	}
+
+	// Restore the backup over a fresh database file
+	dest := filepath.Join(t.TempDir(), "restored.db")
+	if err := os.WriteFile(dest, []byte("previous"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreDatabase(backups[2].Path, dest); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if previous, err := os.ReadFile(dest + ".pre-restore"); err != nil || string(previous) != "previous" {
+		t.Errorf("previous database not kept: %q, %v", previous, err)
+	}
+
+	restored, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	var owner string
+	if err := restored.QueryRow(`SELECT locked_by FROM identifiers WHERE identifier = 'vm-1'`).Scan(&owner); err != nil || owner != "a" {
+		t.Fatalf("restored vm-1 owner = %q, %v; want a", owner, err)
+	}
+}
+
+func TestBackupDoesNotOverwrite(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+
+	dest := filepath.Join(t.TempDir(), "taken.db")
+	if err := os.WriteFile(dest, []byte("earlier backup"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupDatabase(dest); err == nil {
+		t.Fatalf("backed up over an existing file")
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "earlier backup" {
+		t.Fatalf("existing file changed to %q", data)
+	}
+}
+
+func TestBackupRunsWhileAWriterHoldsTheConnection(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+
+	// The pool's only connection is busy in a write transaction for the whole backup
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE identifiers SET locked_by = 'a' WHERE identifier = 'vm-1'`); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- backupDatabase(filepath.Join(t.TempDir(), "backup.db")) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("backup: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backup waited for the writer")
+	}
+}
+
+func TestRestoreRejectsCorruptBackup(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.db")
+	if err := os.WriteFile(corrupt, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An intact SQLite file without the registry schema is rejected too
+	empty := filepath.Join(dir, "empty.db")
+	other, err := sql.Open("sqlite3", empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Exec(`CREATE TABLE unrelated (id INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+
+	dest := filepath.Join(dir, "live.db")
+	if err := os.WriteFile(dest, []byte("live"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, backup := range []string{corrupt, empty, filepath.Join(dir, "missing.db")} {
+		if err := restoreDatabase(backup, dest); err == nil {
+			t.Errorf("restore from %s succeeded, want an error", filepath.Base(backup))
+		}
+	}
+	if live, _ := os.ReadFile(dest); string(live) != "live" {
+		t.Errorf("live database was replaced by a failed restore")
+	}
+}
+
+func TestRestoreRefusedUnderRaft(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	config.Raft.Enabled = true
+
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	if err := backupDatabase(backup); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	mustAllocate(t, "a")
+
+	var stdout, stderr bytes.Buffer
+	if err := restoreCommand([]string{backup}, &stdout, &stderr); err != errRaftLocalChange {
+		t.Fatalf("restore = %v, want %v", err, errRaftLocalChange)
+	}
+	if owner := lockedBy(t, "vm-1"); owner != "a" {
+		t.Fatalf("vm-1 held by %q after a refused restore, want a", owner)
+	}
+
+	// Verifying changes nothing, so it is still allowed
+	if err := restoreCommand([]string{"-verify", backup}, &stdout, &stderr); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestRestoreKeepsUncheckpointedWrites(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	config.Database.Backup = BackupConfig{Directory: filepath.Join(t.TempDir(), "backups"), Retain: 1}
+
+	backup, err := createBackup(time.Now())
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	// The old database has a write that only exists in its write-ahead log
+	dest := filepath.Join(t.TempDir(), "live.db")
+	live, err := sql.Open("sqlite3", "file:"+dest+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	live.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		`PRAGMA wal_autocheckpoint = 0`,
+		`CREATE TABLE leases (client TEXT)`,
+		`INSERT INTO leases VALUES ('a')`,
+	} {
+		if _, err := live.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if _, err := os.Stat(dest + "-wal"); err != nil {
+		t.Fatalf("no write-ahead log: %v", err)
+	}
+
+	if err := restoreDatabase(backup.Path, dest); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	previous, err := sql.Open("sqlite3", dest+".pre-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer previous.Close()
+	var client string
+	if err := previous.QueryRow(`SELECT client FROM leases`).Scan(&client); err != nil || client != "a" {
+		t.Fatalf("previous database lost its write: %q, %v", client, err)
+	}
+}
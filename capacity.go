@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// capacityCheckInterval is how often the waitlist is retried and the pool watermarks are checked,
+// besides whenever a lease changes. Identifiers leaving their reuse cooldown change nothing else.
+const capacityCheckInterval = 1 * time.Second
+
+// waitlistEntry is a client waiting for identifiers from a pool
+type waitlistEntry struct {
+	clientID string
+	pool     string
+	count    int
+	ttl      time.Duration
+	metadata Metadata
+	expires  time.Time
+
+	// serving is set while the waitlist allocates for the entry, which can then no longer leave,
+	// and finished once it has an outcome
+	serving  bool
+	finished bool
+	// done is closed once the entry is served or expires, with its outcome
+	done        chan struct{}
+	identifiers []string
+	allocatedAt time.Time
+	err         error
+}
+
+// allocationWaitlist queues clients waiting for identifiers, first come first served per pool.
+// It is kept in memory by the replica that received the requests.
+type allocationWaitlist struct {
+	mu    sync.Mutex
+	pools map[string][]*waitlistEntry
+	wake  chan struct{}
+}
+
+var waitlist = newAllocationWaitlist()
+
+func newAllocationWaitlist() *allocationWaitlist {
+	return &allocationWaitlist{
+		pools: make(map[string][]*waitlistEntry),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// notify asks the capacity monitor to retry the waitlist
+func (w *allocationWaitlist) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// join queues a client until expires, and returns its entry and 1-based position. A client that
+// is already queued for the pool keeps its place, and its entry lasts until the later expiry.
+func (w *allocationWaitlist) join(pool, clientID string, count int, ttl time.Duration, metadata Metadata, expires time.Time) (*waitlistEntry, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, e := range w.pools[pool] {
+		if e.clientID == clientID {
+			if expires.After(e.expires) {
+				e.expires = expires
+			}
+			return e, i + 1
+		}
+	}
+
+	e := &waitlistEntry{
+		clientID: clientID,
+		pool:     pool,
+		count:    count,
+		ttl:      ttl,
+		metadata: metadata,
+		expires:  expires,
+		done:     make(chan struct{}),
+	}
+	w.pools[pool] = append(w.pools[pool], e)
+	return e, len(w.pools[pool])
+}
+
+// ahead reports whether other clients are queued for the pool before clientID
+func (w *allocationWaitlist) ahead(pool, clientID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, e := range w.pools[pool] {
+		if e.clientID == clientID {
+			return i > 0
+		}
+	}
+	return len(w.pools[pool]) > 0
+}
+
+// leave takes an entry off the waitlist. It returns false if the entry has already been served,
+// or is being served, in which case the caller must wait for its outcome.
+func (w *allocationWaitlist) leave(entry *waitlistEntry) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if entry.serving || entry.finished {
+		return false
+	}
+	w.remove(entry)
+	return true
+}
+
+// remove deletes an entry from its queue and reports whether it was there. w.mu must be held.
+func (w *allocationWaitlist) remove(entry *waitlistEntry) bool {
+	queue := w.pools[entry.pool]
+	for i, e := range queue {
+		if e == entry {
+			w.pools[entry.pool] = append(queue[:i:i], queue[i+1:]...)
+			if len(w.pools[entry.pool]) == 0 {
+				delete(w.pools, entry.pool)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// finish removes an entry and hands its outcome to whoever waits on it
+func (w *allocationWaitlist) finish(entry *waitlistEntry, identifiers []string, err error) {
+	w.mu.Lock()
+	w.remove(entry)
+	entry.serving = false
+	entry.finished = true
+	w.mu.Unlock()
+
+	entry.identifiers, entry.err = identifiers, err
+	close(entry.done)
+}
+
+// length returns the number of queued clients
+func (w *allocationWaitlist) length() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := 0
+	for _, queue := range w.pools {
+		n += len(queue)
+	}
+	return n
+}
+
+// next returns the first entry of the pool's queue that has not expired, marked as being served.
+// Expired entries are dropped with sql.ErrNoRows.
+func (w *allocationWaitlist) next(pool string, now time.Time) *waitlistEntry {
+	for {
+		w.mu.Lock()
+		queue := w.pools[pool]
+		if len(queue) == 0 {
+			w.mu.Unlock()
+			return nil
+		}
+		head := queue[0]
+		head.serving = true
+		w.mu.Unlock()
+
+		if head.expires.After(now) {
+			return head
+		}
+		log.Printf("Client %s left the waitlist for pool %s without an identifier", head.clientID, pool)
+		w.finish(head, nil, sql.ErrNoRows)
+	}
+}
+
+// serve allocates to waiting clients in the order they joined, until a pool runs out again
+func (w *allocationWaitlist) serve(now time.Time) {
+	w.mu.Lock()
+	pools := make([]string, 0, len(w.pools))
+	for pool := range w.pools {
+		pools = append(pools, pool)
+	}
+	w.mu.Unlock()
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		for {
+			head := w.next(pool, now)
+			if head == nil {
+				break
+			}
+
+			identifiers, err := allocateIdentifiers(pool, head.clientID, head.count, head.ttl, head.metadata, now)
+			if err == sql.ErrNoRows {
+				// Still no room; the client keeps its place
+				w.mu.Lock()
+				head.serving = false
+				w.mu.Unlock()
+				break
+			}
+			if err != nil {
+				log.Printf("Error allocating identifiers for waiting client %s: %v", head.clientID, err)
+			} else {
+				log.Printf("Identifiers allocated from the waitlist: ClientID=%s, Pool=%s, Identifiers=%v", head.clientID, pool, identifiers)
+				head.allocatedAt = now
+			}
+			w.finish(head, identifiers, err)
+		}
+	}
+}
+
+// allocateOrWait allocates like allocate. If the pool is exhausted it queues the client: with
+// join it returns the client's waitlist position at once, otherwise it blocks for up to wait
+// and returns sql.ErrNoRows if no identifiers came free. It also returns when the identifiers
+// were allocated, which for a client that waited is when the waitlist served it.
+func allocateOrWait(ctx context.Context, req AllocateRequest, wait time.Duration, join bool, now time.Time) ([]string, time.Time, int, error) {
+	identifiers, err := allocate(req, now)
+	if err != sql.ErrNoRows || (wait == 0 && !join) {
+		return identifiers, now, 0, err
+	}
+
+	pool, count, ttl, err := validateAllocation(req)
+	if err != nil {
+		return nil, now, 0, err
+	}
+	if join {
+		wait = config.Server.AllocationMaxWait
+	}
+	entry, position := waitlist.join(pool.Name, req.ClientID, count, ttl, req.Metadata, now.Add(wait))
+	log.Printf("Client %s is number %d on the waitlist for pool %s", req.ClientID, position, pool.Name)
+	if join {
+		return nil, now, position, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-entry.done:
+		return entry.identifiers, entry.allocatedAt, 0, entry.err
+	case <-timer.C:
+		err = sql.ErrNoRows
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if !waitlist.leave(entry) {
+		<-entry.done
+		return entry.identifiers, entry.allocatedAt, 0, entry.err
+	}
+	return nil, now, 0, err
+}
+
+// poolLevels remembers, per pool, whether the last watermark check found it low or exhausted
+var poolLevels = struct {
+	sync.Mutex
+	levels map[string]EventType
+}{levels: make(map[string]EventType)}
+
+// availableIdentifiers counts the identifiers each pool could allocate now
+func availableIdentifiers(now time.Time) (map[string]int, error) {
+	rows, err := db.Query(`
+		SELECT pool, COUNT(*)
+		FROM identifiers
+		WHERE locked_by IS NULL AND (released_at IS NULL OR released_at <= ?)
+		GROUP BY pool`,
+		cooldownThreshold(now),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	available := make(map[string]int)
+	for rows.Next() {
+		var pool string
+		var n int
+		if err := rows.Scan(&pool, &n); err != nil {
+			return nil, err
+		}
+		available[pool] = n
+	}
+	return available, rows.Err()
+}
+
+// lowPools counts the pools with no more available identifiers than their low watermark
+func lowPools(now time.Time) (int, error) {
+	available, err := availableIdentifiers(now)
+	if err != nil {
+		return 0, err
+	}
+
+	low := 0
+	for _, pool := range config.Identifiers.AllPools() {
+		if available[pool.Name] <= pool.LowWatermark {
+			low++
+		}
+	}
+	return low, nil
+}
+
+// checkWatermarks publishes pool_low when a pool's available identifiers fall to its low
+// watermark, and pool_exhausted when none are left. Each is published once until the pool recovers.
+func checkWatermarks(now time.Time) error {
+	available, err := availableIdentifiers(now)
+	if err != nil {
+		return err
+	}
+
+	var alerts []Event
+	poolLevels.Lock()
+	for _, pool := range config.Identifiers.AllPools() {
+		n := available[pool.Name]
+		var level EventType
+		switch {
+		case n == 0:
+			level = EventPoolExhausted
+		case n <= pool.LowWatermark:
+			level = EventPoolLow
+		}
+
+		previous := poolLevels.levels[pool.Name]
+		poolLevels.levels[pool.Name] = level
+		switch {
+		case level == previous:
+		case level == "":
+			log.Printf("Pool %s recovered: %d identifier(s) available", pool.Name, n)
+		case level == EventPoolLow && previous == EventPoolExhausted:
+			// Recovering from exhaustion is no reason for an alert
+		default:
+			log.Printf("Pool %s has %d identifier(s) available: %s", pool.Name, n, level)
+			alerts = append(alerts, Event{Type: level, Time: now, Pool: pool.Name, Count: n})
+		}
+	}
+	poolLevels.Unlock()
+
+	if len(alerts) == 0 {
+		return nil
+	}
+	if cluster != nil {
+		return cluster.alert(alerts, now)
+	}
+	// Alerts change nothing, so their transaction only queues the webhook deliveries
+	_, err = commitEvents(func(*sql.Tx) ([]Event, error) { return alerts, nil })
+	return err
+}
+
+// startCapacityMonitor serves the waitlist and, on the leader, resizes the growable pools and
+// checks the pool watermarks whenever a lease changes and every capacityCheckInterval
+func startCapacityMonitor() {
+	events.subscribe(func([]Event) { waitlist.notify() })
+
+	go func() {
+		ticker := time.NewTicker(capacityCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-waitlist.wake:
+			case <-ticker.C:
+			}
+
+			now := time.Now()
+			if isLeader() {
+				if err := resizePools(now); err != nil {
+					log.Printf("Error resizing pools: %v", err)
+				}
+			}
+			waitlist.serve(now)
+			if isLeader() {
+				if err := checkWatermarks(now); err != nil {
+					log.Printf("Error checking pool watermarks: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllocationWaitsForRelease(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	mustAllocate(t, "a")
+
+	type outcome struct {
+		identifiers []string
+		err         error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		identifiers, _, _, err := allocateOrWait(context.Background(), AllocateRequest{ClientID: "b"}, 5*time.Second, false, time.Now())
+		done <- outcome{identifiers, err}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); waitlist.length() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("b never joined the waitlist")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := releaseIdentifiers("a", "vm-1", time.Now()); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	waitlist.serve(time.Now())
+
+	got := <-done
+	if got.err != nil || len(got.identifiers) != 1 || got.identifiers[0] != "vm-1" {
+		t.Fatalf("b got %v, %v; want vm-1", got.identifiers, got.err)
+	}
+
+	// A wait that runs out fails like an exhausted pool, and leaves the waitlist
+	if _, _, _, err := allocateOrWait(context.Background(), AllocateRequest{ClientID: "c"}, 10*time.Millisecond, false, time.Now()); err != sql.ErrNoRows {
+		t.Fatalf("c got %v, want sql.ErrNoRows", err)
+	}
+	if n := waitlist.length(); n != 0 {
+		t.Fatalf("%d client(s) left on the waitlist", n)
+	}
+}
+
+func TestWaitedAllocationReportsLeaseFromServing(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	config.Server.AllocationMaxWait = 5 * time.Minute
+	mustAllocate(t, "a")
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		allocateHandler(rec, httptest.NewRequest("POST", "/allocate", strings.NewReader(`{"client_id": "b", "wait": "5m"}`)))
+	}()
+	for deadline := time.Now().Add(5 * time.Second); waitlist.length() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("b never joined the waitlist")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := releaseIdentifiers("a", "vm-1", time.Now()); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	// The waitlist serves b well after b asked, but before its wait ran out
+	served := time.Now().Add(time.Minute).Truncate(time.Second)
+	waitlist.serve(served)
+	<-done
+
+	var resp AllocateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("allocate = %d %s, %v", rec.Code, rec.Body, err)
+	}
+	if want := served.Add(config.Server.StaleTimeout); !resp.ExpiresAt.Equal(want) || !resp.ServerTime.Equal(served) {
+		t.Fatalf("lease expires %s at server time %s, want %s at %s", resp.ExpiresAt, resp.ServerTime, want, served)
+	}
+}
+
+func TestWaitlistServesClientsInOrder(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1", "vm-2")
+	config.Server.AllocationMaxWait = time.Minute
+	mustAllocate(t, "a")
+	mustAllocate(t, "b")
+
+	now := time.Now()
+	for i, client := range []string{"c", "d", "c"} {
+		_, _, position, err := allocateOrWait(context.Background(), AllocateRequest{ClientID: client, Waitlist: true}, 0, true, now)
+		if err != nil {
+			t.Fatalf("join %s: %v", client, err)
+		}
+		if want := []int{1, 2, 1}[i]; position != want {
+			t.Fatalf("%s is number %d, want %d", client, position, want)
+		}
+	}
+
+	// Once an identifier is free, newcomers do not get ahead of the waiting clients
+	if _, err := releaseIdentifiers("b", "", now); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := allocate(AllocateRequest{ClientID: "e"}, now); err != sql.ErrNoRows {
+		t.Fatalf("e got %v, want sql.ErrNoRows", err)
+	}
+
+	waitlist.serve(now)
+	if identifiers, err := allocate(AllocateRequest{ClientID: "c"}, now); err != nil || identifiers[0] != "vm-2" {
+		t.Fatalf("c got %v, %v; want vm-2 from the waitlist", identifiers, err)
+	}
+	_, _, position, err := allocateOrWait(context.Background(), AllocateRequest{ClientID: "d", Waitlist: true}, 0, true, now)
+	if err != nil || position != 1 {
+		t.Fatalf("d is number %d, %v; want 1", position, err)
+	}
+
+	// Entries expire after the maximum wait
+	waitlist.serve(now.Add(2 * time.Minute))
+	if n := waitlist.length(); n != 0 {
+		t.Fatalf("%d client(s) left on the waitlist", n)
+	}
+}
+
+func TestWatermarkAlerts(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+	config.Identifiers.LowWatermark = 1
+
+	var alerts []Event
+	check := func() {
+		t.Helper()
+		_, _, cursor, _ := events.since(0, EventFilter{})
+		if err := checkWatermarks(time.Now()); err != nil {
+			t.Fatalf("check watermarks: %v", err)
+		}
+		alerts, _, _, _ = events.since(cursor, EventFilter{Types: map[EventType]bool{EventPoolLow: true, EventPoolExhausted: true}})
+	}
+
+	mustAllocate(t, "a")
+	if check(); len(alerts) != 0 {
+		t.Fatalf("alerts %+v with 2 identifiers available", alerts)
+	}
+	mustAllocate(t, "b")
+	if check(); len(alerts) != 1 || alerts[0].Type != EventPoolLow || alerts[0].Count != 1 {
+		t.Fatalf("alerts %+v, want pool_low with 1 available", alerts)
+	}
+	if check(); len(alerts) != 0 {
+		t.Fatalf("pool_low repeated: %+v", alerts)
+	}
+	mustAllocate(t, "c")
+	if check(); len(alerts) != 1 || alerts[0].Type != EventPoolExhausted || alerts[0].Pool != DefaultPool {
+		t.Fatalf("alerts %+v, want pool_exhausted", alerts)
+	}
+	if low, err := lowPools(time.Now()); err != nil || low != 1 {
+		t.Fatalf("lowPools = %d, %v", low, err)
+	}
+}
@@ -0,0 +1,388 @@
+// Package client is a Go client for the identifier registry API.
+//
+// A Client wraps the HTTP endpoints with context support, typed errors and retries.
+// Acquire returns a Lease that keeps its identifier alive in the background and reports
+// on Lost() when the registry no longer considers the client its owner.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Sentinel errors matched by APIError through errors.Is
+var (
+	// ErrNotFound is returned when the identifier or client does not exist (HTTP 404)
+	ErrNotFound = errors.New("registry: not found")
+	// ErrConflict is returned when another client owns the identifier (HTTP 409)
+	ErrConflict = errors.New("registry: identifier owned by another client")
+	// ErrUnavailable is returned when no identifiers are available (HTTP 503)
+	ErrUnavailable = errors.New("registry: no identifiers available")
+)
+
+// APIError is a non-2xx response from the registry
+type APIError struct {
+	StatusCode int
+	Message    string
+	// Owner is the client holding the identifier, set on conflicts
+	Owner string
+}
+
+func (e *APIError) Error() string {
+	if e.Owner != "" {
+		return fmt.Sprintf("registry: HTTP %d: %s (owned by %s)", e.StatusCode, e.Message, e.Owner)
+	}
+	return fmt.Sprintf("registry: HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// Is maps status codes onto the sentinel errors
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrUnavailable:
+		return e.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// AllocateRequest asks for identifiers for a client
+type AllocateRequest struct {
+	ClientID string            `json:"client_id"`
+	Pool     string            `json:"pool,omitempty"`
+	Count    int               `json:"count,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// TTLSeconds asks for a lease TTL within the pool's bounds instead of its default
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+	// Wait lets the registry hold the request for up to this long, e.g. "30s", until
+	// identifiers come free. The request's timeout is extended by it.
+	Wait string `json:"wait,omitempty"`
+}
+
+// AllocateResponse lists every identifier the client holds in the pool
+type AllocateResponse struct {
+	Identifier  string   `json:"identifier"`
+	Identifiers []string `json:"identifiers"`
+	LeaseExpiry
+}
+
+// LeaseExpiry is when a lease expires without another heartbeat, and how often the registry
+// recommends sending one
+type LeaseExpiry struct {
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds int       `json:"ttl_seconds"`
+	// HeartbeatInterval is in seconds; see Interval
+	HeartbeatInterval int       `json:"heartbeat_interval"`
+	ServerTime        time.Time `json:"server_time"`
+}
+
+// TTL returns the lease TTL, or 0 if the registry did not report one
+func (e LeaseExpiry) TTL() time.Duration {
+	return time.Duration(e.TTLSeconds) * time.Second
+}
+
+// Interval returns the recommended time between heartbeats, or 0 if the registry did not
+// report one
+func (e LeaseExpiry) Interval() time.Duration {
+	return time.Duration(e.HeartbeatInterval) * time.Second
+}
+
+// Skew returns how far the registry's clock is ahead of received, the local time the response
+// arrived. Add it to a local time before comparing it with ExpiresAt.
+func (e LeaseExpiry) Skew(received time.Time) time.Duration {
+	if e.ServerTime.IsZero() {
+		return 0
+	}
+	return e.ServerTime.Sub(received)
+}
+
+// LivenessRequest is a heartbeat for one identifier, or for all of a client's identifiers
+// when Identifier is empty
+type LivenessRequest struct {
+	ClientID   string            `json:"client_id"`
+	Identifier string            `json:"identifier,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// LivenessResponse acknowledges a heartbeat. For a heartbeat without an identifier the
+// expiry is that of the client's lease with the shortest TTL.
+type LivenessResponse struct {
+	Status string `json:"status"`
+	LeaseExpiry
+}
+
+// LivenessBatchResult is the outcome of one entry of a batched heartbeat. Status is "ok",
+// "reassociated", "conflict", "not_found" or "invalid".
+type LivenessBatchResult struct {
+	ClientID   string `json:"client_id"`
+	Identifier string `json:"identifier"`
+	Status     string `json:"status"`
+	// Owner is the client holding the identifier, set on conflicts
+	Owner string `json:"owner,omitempty"`
+	Error string `json:"error,omitempty"`
+	// LeaseExpiry is set for an entry that renewed its lease
+	*LeaseExpiry
+}
+
+// LivenessBatchResponse lists the outcome of every entry in request order
+type LivenessBatchResponse struct {
+	Results []LivenessBatchResult `json:"results"`
+}
+
+// ClientIdentifier is one identifier held by a client
+type ClientIdentifier struct {
+	Identifier string            `json:"identifier"`
+	Pool       string            `json:"pool"`
+	LastSeen   string            `json:"last_seen"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// ClientDetails describes the identifiers a client holds
+type ClientDetails struct {
+	ClientID    string             `json:"client_id"`
+	Identifier  string             `json:"identifier"`
+	LastSeen    string             `json:"last_seen"`
+	Metadata    map[string]string  `json:"metadata"`
+	Identifiers []ClientIdentifier `json:"identifiers"`
+}
+
+// RetryPolicy controls how transient failures are retried. Requests are retried on network
+// errors and on 500, 502, 503 and 504 responses, with exponential backoff and full jitter.
+// Allocate does not retry 503: the pool is exhausted, and waiting for it is what Wait is for.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is used by clients created with New
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// Client talks to one registry
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Retry      RetryPolicy
+}
+
+// New returns a client for the registry at baseURL, e.g. "http://registry:8080"
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 15 * time.Second},
+		Retry:      DefaultRetryPolicy,
+	}
+}
+
+// Allocate asks the registry for identifiers. Calling it again for a client that already
+// holds identifiers returns them. An exhausted pool fails with ErrUnavailable at once, or
+// after Wait.
+func (c *Client) Allocate(ctx context.Context, req AllocateRequest) (*AllocateResponse, error) {
+	opts := requestOptions{final: []int{http.StatusServiceUnavailable}}
+	if wait, err := time.ParseDuration(req.Wait); err == nil && wait > 0 {
+		// The registry may hold the request for wait before it answers
+		opts.extraTimeout = wait
+	}
+
+	var resp AllocateResponse
+	if err := c.send(ctx, http.MethodPost, "/allocate", req, &resp, opts); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Heartbeat sends a liveness probe
+func (c *Client) Heartbeat(ctx context.Context, req LivenessRequest) (*LivenessResponse, error) {
+	var resp LivenessResponse
+	if err := c.do(ctx, http.MethodPost, "/liveness", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// HeartbeatBatch sends many liveness probes in one request. Each entry needs an identifier.
+// The registry reports the outcome of each entry instead of failing the request.
+func (c *Client) HeartbeatBatch(ctx context.Context, entries []LivenessRequest) (*LivenessBatchResponse, error) {
+	var resp LivenessBatchResponse
+	req := struct {
+		Entries []LivenessRequest `json:"entries"`
+	}{entries}
+	if err := c.do(ctx, http.MethodPost, "/liveness/batch", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Release gives an identifier back to the pool. An empty identifier releases every
+// identifier the client holds.
+func (c *Client) Release(ctx context.Context, clientID, identifier string) error {
+	req := map[string]string{"client_id": clientID, "identifier": identifier}
+	return c.do(ctx, http.MethodPost, "/release", req, nil)
+}
+
+// Get returns the identifiers held by a client
+func (c *Client) Get(ctx context.Context, clientID string) (*ClientDetails, error) {
+	var details ClientDetails
+	if err := c.do(ctx, http.MethodGet, "/client/"+url.PathEscape(clientID), nil, &details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// requestOptions adjust how send treats one request
+type requestOptions struct {
+	// final lists status codes that are not retried, although the retry policy covers them
+	final []int
+	// extraTimeout is added to the HTTP client's timeout
+	extraTimeout time.Duration
+}
+
+// do sends a request, retrying transient failures, and decodes a JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	return c.send(ctx, method, path, in, out, requestOptions{})
+}
+
+// send is do with options
+func (c *Client) send(ctx context.Context, method, path string, in, out interface{}, opts requestOptions) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	attempts := c.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.Retry.backoff(attempt)); err != nil {
+				return err
+			}
+		}
+
+		retry, err := c.once(ctx, method, path, body, out, opts)
+		if err == nil || !retry {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// once performs a single attempt and reports whether a failure is worth retrying
+func (c *Client) once(ctx context.Context, method, path string, body []byte, out interface{}, opts requestOptions) (bool, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if opts.extraTimeout > 0 && httpClient.Timeout > 0 {
+		extended := *httpClient
+		extended.Timeout += opts.extraTimeout
+		httpClient = &extended
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		// Network errors are retried unless the caller gave up
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := parseAPIError(resp.StatusCode, data)
+		for _, status := range opts.final {
+			if resp.StatusCode == status {
+				return false, apiErr
+			}
+		}
+		switch resp.StatusCode {
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, apiErr
+		}
+		return false, apiErr
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return false, fmt.Errorf("registry: decoding response: %w", err)
+		}
+	}
+	return false, nil
+}
+
+// parseAPIError builds an APIError from a plain-text or JSON error body
+func parseAPIError(status int, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: status, Message: strings.TrimSpace(string(body))}
+
+	var conflict struct {
+		Error      string `json:"error"`
+		ExpectedID string `json:"expected_id"`
+	}
+	if json.Unmarshal(body, &conflict) == nil && conflict.Error != "" {
+		apiErr.Message = conflict.Error
+		apiErr.Owner = conflict.ExpectedID
+	}
+	return apiErr
+}
+
+// backoff returns a random delay up to BaseDelay * 2^(attempt-1), capped at MaxDelay
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testClient(url string) *Client {
+	c := New(url)
+	c.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	return c
+}
+
+func TestErrorsMapStatusCodes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/client/{client_id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Client not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("/liveness", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"Identifier mismatch","expected_id":"vm-a","your_id":"vm-b"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := testClient(server.URL)
+
+	if _, err := c.Get(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get error = %v, want ErrNotFound", err)
+	}
+
+	_, err := c.Heartbeat(context.Background(), LivenessRequest{ClientID: "vm-b", Identifier: "id-1"})
+	var apiErr *APIError
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &apiErr) || apiErr.Owner != "vm-a" {
+		t.Fatalf("Heartbeat error = %v, want conflict owned by vm-a", err)
+	}
+}
+
+func TestAllocateRetriesTransientFailures(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"identifier":"id-1","identifiers":["id-1"]}`))
+	}))
+	defer server.Close()
+
+	resp, err := testClient(server.URL).Allocate(context.Background(), AllocateRequest{ClientID: "vm"})
+	if err != nil || resp.Identifier != "id-1" || calls != 3 {
+		t.Fatalf("Allocate = %+v, %v after %d calls", resp, err, calls)
+	}
+}
+
+func TestAllocateDoesNotRetryExhaustedPool(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "No available identifiers", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := testClient(server.URL).Allocate(context.Background(), AllocateRequest{ClientID: "vm"})
+	if !errors.Is(err, ErrUnavailable) || calls != 1 {
+		t.Fatalf("Allocate error = %v after %d calls, want ErrUnavailable after 1", err, calls)
+	}
+}
+
+func TestAllocateWaitExtendsTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The registry holds the request while it waits for identifiers
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte(`{"identifier":"id-1","identifiers":["id-1"]}`))
+	}))
+	defer server.Close()
+
+	c := testClient(server.URL)
+	c.Retry.MaxAttempts = 1
+	c.HTTPClient.Timeout = 100 * time.Millisecond
+
+	if _, err := c.Allocate(context.Background(), AllocateRequest{ClientID: "vm"}); err == nil {
+		t.Fatal("Allocate without wait outlived the client timeout")
+	}
+	if _, err := c.Allocate(context.Background(), AllocateRequest{ClientID: "vm", Wait: "1s"}); err != nil {
+		t.Fatalf("Allocate with wait: %v", err)
+	}
+}
+
+func TestLeaseReportsLoss(t *testing.T) {
+	var heartbeats int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocate", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"identifier":"id-1","identifiers":["id-1"]}`))
+	})
+	mux.HandleFunc("/liveness", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&heartbeats, 1) < 2 {
+			return
+		}
+		// The identifier was reaped and handed to someone else
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"Identifier mismatch","expected_id":"other"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	lease, err := testClient(server.URL).Acquire(context.Background(), AllocateRequest{ClientID: "vm"},
+		LeaseOptions{HeartbeatInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	select {
+	case <-lease.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("lease was not reported lost")
+	}
+	if !errors.Is(lease.Err(), ErrConflict) {
+		t.Fatalf("lease error = %v, want ErrConflict", lease.Err())
+	}
+}
+
+func TestLeaseFollowsRegistryTimeouts(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocate", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"identifier":"id-1","identifiers":["id-1"],"expires_at":"2026-01-01T00:03:00Z","ttl_seconds":180,"heartbeat_interval":60,"server_time":"2026-01-01T00:00:00Z"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	lease, err := testClient(server.URL).Acquire(context.Background(), AllocateRequest{ClientID: "vm"}, LeaseOptions{})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer lease.Stop()
+
+	if lease.opts.HeartbeatInterval != time.Minute || lease.opts.Timeout != 3*time.Minute || !lease.adaptive {
+		t.Fatalf("lease options = %+v, want the registry's interval and TTL", lease.opts)
+	}
+}
+
+func TestLeaseLosesOneOfManyIdentifiers(t *testing.T) {
+	var batches int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocate", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"identifier":"id-1","identifiers":["id-1","id-2"]}`))
+	})
+	mux.HandleFunc("/liveness/batch", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Entries []LivenessRequest `json:"entries"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Entries) != 2 || req.Entries[1].Identifier != "id-2" {
+			http.Error(w, "bad batch", http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&batches, 1) < 2 {
+			w.Write([]byte(`{"results":[{"client_id":"vm","identifier":"id-1","status":"ok"},{"client_id":"vm","identifier":"id-2","status":"ok"}]}`))
+			return
+		}
+		// id-2 was reaped and handed to someone else while id-1 is still held
+		w.Write([]byte(`{"results":[{"client_id":"vm","identifier":"id-1","status":"ok"},{"client_id":"vm","identifier":"id-2","status":"conflict","owner":"other"}]}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	lease, err := testClient(server.URL).Acquire(context.Background(), AllocateRequest{ClientID: "vm", Count: 2},
+		LeaseOptions{HeartbeatInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	select {
+	case <-lease.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatal("lease was not reported lost")
+	}
+	var apiErr *APIError
+	if !errors.Is(lease.Err(), ErrConflict) || !errors.As(lease.Err(), &apiErr) || apiErr.Owner != "other" {
+		t.Fatalf("lease error = %v, want a conflict owned by other", lease.Err())
+	}
+}
+
+func TestLeaseReleasesOnlyItsOwnIdentifiers(t *testing.T) {
+	var mu sync.Mutex
+	held := map[string]bool{"id-1": true, "id-2": true, "gpu-1": true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocate", func(w http.ResponseWriter, r *http.Request) {
+		var req AllocateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Pool == "gpu" {
+			w.Write([]byte(`{"identifier":"gpu-1","identifiers":["gpu-1"]}`))
+			return
+		}
+		w.Write([]byte(`{"identifier":"id-1","identifiers":["id-1","id-2"]}`))
+	})
+	mux.HandleFunc("/release", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case req["identifier"] == "":
+			// Releasing without an identifier would return every lease of the client
+			for identifier := range held {
+				delete(held, identifier)
+			}
+		case req["identifier"] == "id-2":
+			http.Error(w, "Failed to release identifier", http.StatusInternalServerError)
+		default:
+			delete(held, req["identifier"])
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := testClient(server.URL)
+	c.Retry = RetryPolicy{MaxAttempts: 1}
+	ctx := context.Background()
+	opts := LeaseOptions{HeartbeatInterval: time.Hour}
+
+	lease, err := c.Acquire(ctx, AllocateRequest{ClientID: "vm", Count: 2}, opts)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	gpu, err := c.Acquire(ctx, AllocateRequest{ClientID: "vm", Pool: "gpu"}, opts)
+	if err != nil {
+		t.Fatalf("Acquire gpu: %v", err)
+	}
+	defer gpu.Stop()
+
+	// A failure for one identifier is reported, and the others are still released
+	err = lease.Release(ctx)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Release error = %v, want the failure for id-2", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if held["id-1"] || !held["id-2"] || !held["gpu-1"] {
+		t.Fatalf("held after release = %v, want id-2 and gpu-1", held)
+	}
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LeaseOptions controls how a Lease heartbeats
+type LeaseOptions struct {
+	// HeartbeatInterval is the time between liveness probes. Defaults to the interval the
+	// registry recommends, following it as it changes, or 10s if the registry does not say.
+	HeartbeatInterval time.Duration
+	// Timeout is how long heartbeats may keep failing before the lease is considered lost.
+	// Defaults to the lease TTL the registry reports, or 90s if it does not say.
+	Timeout time.Duration
+}
+
+// Lease holds an identifier and keeps it alive in the background
+type Lease struct {
+	ClientID    string
+	Identifier  string
+	Identifiers []string
+
+	client *Client
+	opts   LeaseOptions
+	// adaptive follows the heartbeat interval recommended by the registry
+	adaptive bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	lost     chan struct{}
+	mu       sync.Mutex
+	err      error
+	stopped  bool
+}
+
+// Acquire allocates identifiers and starts heartbeating them until the lease is released,
+// stopped or lost
+func (c *Client) Acquire(ctx context.Context, req AllocateRequest, opts LeaseOptions) (*Lease, error) {
+	resp, err := c.Allocate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	adaptive := opts.HeartbeatInterval <= 0
+	if adaptive {
+		opts.HeartbeatInterval = resp.Interval()
+		if opts.HeartbeatInterval <= 0 {
+			opts.HeartbeatInterval = 10 * time.Second
+		}
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = resp.TTL()
+		if opts.Timeout <= 0 {
+			opts.Timeout = 90 * time.Second
+		}
+	}
+
+	heartbeatCtx, cancel := context.WithCancel(context.Background())
+	l := &Lease{
+		ClientID:    req.ClientID,
+		Identifier:  resp.Identifier,
+		Identifiers: resp.Identifiers,
+		client:      c,
+		opts:        opts,
+		adaptive:    adaptive,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		lost:        make(chan struct{}),
+	}
+	go l.heartbeat(heartbeatCtx)
+	return l, nil
+}
+
+// Lost is closed when the registry no longer considers the client the owner of the lease
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err reports why the lease was lost, or nil while it is held
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Stop ends heartbeating without releasing the identifiers. The registry reclaims them
+// once they go stale.
+func (l *Lease) Stop() {
+	l.mu.Lock()
+	l.stopped = true
+	l.mu.Unlock()
+
+	l.cancel()
+	<-l.done
+}
+
+// Release stops heartbeating and returns every identifier of the lease to the pool. Other
+// leases of the same client, e.g. in other pools, are left alone.
+func (l *Lease) Release(ctx context.Context) error {
+	l.Stop()
+
+	identifiers := l.Identifiers
+	if len(identifiers) == 0 {
+		identifiers = []string{l.Identifier}
+	}
+	var errs []error
+	for _, identifier := range identifiers {
+		if err := l.client.Release(ctx, l.ClientID, identifier); err != nil {
+			errs = append(errs, fmt.Errorf("release %s: %w", identifier, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *Lease) heartbeat(ctx context.Context) {
+	defer close(l.done)
+
+	interval := l.opts.HeartbeatInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastOK := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, interval)
+		next, err := l.probe(probeCtx)
+		cancel()
+
+		switch {
+		case err == nil:
+			lastOK = time.Now()
+			// Follow the registry if its timeouts change
+			if l.adaptive && next > 0 && next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, ErrConflict), errors.Is(err, ErrNotFound):
+			l.markLost(err)
+			return
+		case time.Since(lastOK) > l.opts.Timeout:
+			l.markLost(fmt.Errorf("registry: no successful heartbeat for %s: %w", l.opts.Timeout, err))
+			return
+		}
+	}
+}
+
+// probe heartbeats every identifier of the lease and returns the heartbeat interval the
+// registry recommends, the shortest one if the identifiers differ. Losing any one of the
+// identifiers loses the lease.
+func (l *Lease) probe(ctx context.Context) (time.Duration, error) {
+	if len(l.Identifiers) <= 1 {
+		resp, err := l.client.Heartbeat(ctx, LivenessRequest{ClientID: l.ClientID, Identifier: l.Identifier})
+		if err != nil {
+			return 0, err
+		}
+		return resp.Interval(), nil
+	}
+
+	entries := make([]LivenessRequest, len(l.Identifiers))
+	for i, identifier := range l.Identifiers {
+		entries[i] = LivenessRequest{ClientID: l.ClientID, Identifier: identifier}
+	}
+	resp, err := l.client.HeartbeatBatch(ctx, entries)
+	if err != nil {
+		return 0, err
+	}
+
+	var interval time.Duration
+	for _, r := range resp.Results {
+		switch r.Status {
+		case "conflict":
+			return 0, &APIError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("identifier %s is held by another client", r.Identifier), Owner: r.Owner}
+		case "not_found":
+			return 0, &APIError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("identifier %s not found", r.Identifier)}
+		case "invalid":
+			return 0, &APIError{StatusCode: http.StatusBadRequest, Message: r.Error}
+		}
+		if r.LeaseExpiry != nil && r.Interval() > 0 && (interval == 0 || r.Interval() < interval) {
+			interval = r.Interval()
+		}
+	}
+	return interval, nil
+}
+
+func (l *Lease) markLost(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopped {
+		return
+	}
+	l.err = err
+	close(l.lost)
+}
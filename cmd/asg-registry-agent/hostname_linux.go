@@ -0,0 +1,10 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// setHostname changes the kernel hostname; it requires CAP_SYS_ADMIN
+func setHostname(name string) error {
+	return syscall.Sethostname([]byte(name))
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func setHostname(name string) error {
+	return errors.New("setting the hostname is only supported on linux")
+}
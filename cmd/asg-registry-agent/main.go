@@ -0,0 +1,252 @@
+// Command asg-registry-agent runs on VM boot. It allocates an identifier from the registry,
+// publishes it to a file and/or env-file, keeps the lease alive, and releases it on shutdown.
+//
+// If the lease is lost the agent runs the -on-lost hook, if any, and exits with status 1
+// whatever the hook returns, so that a supervisor never mistakes a lost lease for a clean exit.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/liftedkilt/ci-registry/client"
+)
+
+// Options holds the agent's command-line configuration
+type Options struct {
+	ServerURL         string
+	ClientID          string
+	Pool              string
+	Metadata          map[string]string
+	OutputFile        string
+	EnvFile           string
+	EnvVar            string
+	SetHostname       bool
+	StaleTimeout      time.Duration
+	HeartbeatFraction float64
+	AllocateTimeout   time.Duration
+	OnLost            string
+}
+
+func main() {
+	opts, err := parseFlags(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+
+	os.Exit(run(opts))
+}
+
+func parseFlags(args []string) (Options, error) {
+	fs := flag.NewFlagSet("asg-registry-agent", flag.ContinueOnError)
+
+	hostname, _ := os.Hostname()
+
+	var opts Options
+	var metadata string
+	fs.StringVar(&opts.ServerURL, "server", envOr("ASG_REGISTRY_URL", "http://localhost:8080"), "registry base URL")
+	fs.StringVar(&opts.ClientID, "client-id", hostname, "client_id to allocate for")
+	fs.StringVar(&opts.Pool, "pool", "", "identifier pool (default pool if empty)")
+	fs.StringVar(&metadata, "metadata", "", "comma-separated key=value metadata, e.g. az=us-east-1a,asg=build")
+	fs.StringVar(&opts.OutputFile, "output", "", "file to write the identifier to")
+	fs.StringVar(&opts.EnvFile, "env-file", "", "env-file to write the identifier to")
+	fs.StringVar(&opts.EnvVar, "env-var", "ASG_IDENTIFIER", "variable name used in the env-file")
+	fs.BoolVar(&opts.SetHostname, "set-hostname", false, "set the hostname to the allocated identifier")
+	fs.DurationVar(&opts.StaleTimeout, "stale-timeout", 0, "the lease TTL (default: as reported by the registry)")
+	fs.Float64Var(&opts.HeartbeatFraction, "heartbeat-fraction", 1.0/3, "heartbeat every this fraction of -stale-timeout, if set")
+	fs.DurationVar(&opts.AllocateTimeout, "allocate-timeout", 5*time.Minute, "how long to keep retrying the initial allocation")
+	fs.StringVar(&opts.OnLost, "on-lost", "", "command to run (via /bin/sh -c) if the lease is lost")
+
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	if opts.ClientID == "" {
+		return opts, errors.New("-client-id is required")
+	}
+	if opts.HeartbeatFraction <= 0 || opts.HeartbeatFraction >= 1 {
+		return opts, errors.New("-heartbeat-fraction must be between 0 and 1")
+	}
+
+	opts.Metadata = make(map[string]string)
+	for _, pair := range strings.Split(metadata, ",") {
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return opts, fmt.Errorf("invalid metadata %q", pair)
+		}
+		opts.Metadata[key] = value
+	}
+
+	return opts, nil
+}
+
+// run acquires the lease and blocks until a shutdown signal or lease loss, returning the exit code
+func run(opts Options) int {
+	registry := client.New(opts.ServerURL)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	lease, err := acquire(ctx, registry, opts)
+	if err != nil {
+		log.Printf("Failed to allocate identifier: %v", err)
+		return 1
+	}
+	log.Printf("Allocated identifier %s for client %s", lease.Identifier, opts.ClientID)
+
+	if err := publish(opts, lease.Identifier); err != nil {
+		log.Printf("Failed to publish identifier: %v", err)
+		releaseLease(lease)
+		return 1
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down, releasing identifier %s", lease.Identifier)
+		if err := releaseLease(lease); err != nil {
+			log.Printf("Failed to release identifier: %v", err)
+			return 1
+		}
+		return 0
+
+	case <-lease.Lost():
+		log.Printf("Lost identifier %s: %v", lease.Identifier, lease.Err())
+		runLostHook(opts, lease)
+		return 1
+	}
+}
+
+// acquire keeps trying to allocate until it succeeds, the allocate timeout passes or the agent is stopped
+func acquire(ctx context.Context, registry *client.Client, opts Options) (*client.Lease, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.AllocateTimeout)
+	defer cancel()
+
+	// Without a stale timeout the lease follows the registry's TTL and recommended interval
+	leaseOpts := client.LeaseOptions{
+		HeartbeatInterval: time.Duration(float64(opts.StaleTimeout) * opts.HeartbeatFraction),
+		Timeout:           opts.StaleTimeout,
+	}
+	req := client.AllocateRequest{ClientID: opts.ClientID, Pool: opts.Pool, Metadata: opts.Metadata}
+
+	delay := time.Second
+	for {
+		lease, err := registry.Acquire(ctx, req, leaseOpts)
+		if err == nil {
+			return lease, nil
+		}
+
+		var apiErr *client.APIError
+		if errors.As(err, &apiErr) && !errors.Is(err, client.ErrUnavailable) {
+			// The request itself was rejected; retrying will not help
+			return nil, err
+		}
+
+		log.Printf("Allocation attempt failed, retrying in %s: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(delay):
+		}
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// publish writes the identifier wherever the operator asked for it
+func publish(opts Options, identifier string) error {
+	if opts.OutputFile != "" {
+		if err := writeFileAtomic(opts.OutputFile, identifier+"\n"); err != nil {
+			return err
+		}
+	}
+	if opts.EnvFile != "" {
+		if err := writeFileAtomic(opts.EnvFile, fmt.Sprintf("%s=%s\n", opts.EnvVar, identifier)); err != nil {
+			return err
+		}
+	}
+	if opts.SetHostname {
+		if err := setHostname(identifier); err != nil {
+			return fmt.Errorf("setting hostname: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path so readers never see a partially written file
+func writeFileAtomic(path, content string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func releaseLease(lease *client.Lease) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return lease.Release(ctx)
+}
+
+// runLostHook runs the -on-lost command, if there is one, and logs its failure
+func runLostHook(opts Options, lease *client.Lease) {
+	if opts.OnLost == "" {
+		return
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", opts.OnLost)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		opts.EnvVar+"="+lease.Identifier,
+		"ASG_CLIENT_ID="+opts.ClientID,
+		"ASG_LOST_REASON="+fmt.Sprint(lease.Err()),
+	)
+
+	if err := cmd.Run(); err != nil {
+		log.Printf("Lost hook failed: %v", err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
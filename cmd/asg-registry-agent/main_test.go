@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/liftedkilt/ci-registry/client"
+)
+
+// testRegistry serves /allocate, answering the first unavailable allocations with 503, and
+// /liveness, answering with 409 once lostAfter probes have succeeded
+type testRegistry struct {
+	unavailable int32
+	lostAfter   int32
+
+	allocations atomic.Int32
+	probes      atomic.Int32
+	request     client.AllocateRequest
+}
+
+func (r *testRegistry) start(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocate", func(w http.ResponseWriter, req *http.Request) {
+		if r.allocations.Add(1) <= r.unavailable {
+			http.Error(w, "No available identifiers", http.StatusServiceUnavailable)
+			return
+		}
+		if err := json.NewDecoder(req.Body).Decode(&r.request); err != nil || r.request.ClientID == "" {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"identifier":"vm-7","identifiers":["vm-7"]}`))
+	})
+	mux.HandleFunc("/liveness", func(w http.ResponseWriter, req *http.Request) {
+		if n := r.probes.Add(1); r.lostAfter > 0 && n > r.lostAfter {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"Identifier mismatch","expected_id":"other"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testOptions(url string) Options {
+	return Options{
+		ServerURL:         url,
+		ClientID:          "i-0abc",
+		Pool:              "build",
+		Metadata:          map[string]string{"az": "us-east-1a"},
+		EnvVar:            "ASG_IDENTIFIER",
+		StaleTimeout:      60 * time.Millisecond,
+		HeartbeatFraction: 1.0 / 3,
+		AllocateTimeout:   5 * time.Second,
+	}
+}
+
+func TestAcquireRetriesUnavailablePool(t *testing.T) {
+	registry := &testRegistry{unavailable: 1}
+	opts := testOptions(registry.start(t).URL)
+
+	lease, err := acquire(context.Background(), client.New(opts.ServerURL), opts)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer lease.Stop()
+
+	if lease.Identifier != "vm-7" || registry.allocations.Load() != 2 {
+		t.Fatalf("acquired %s after %d attempt(s), want vm-7 after 2", lease.Identifier, registry.allocations.Load())
+	}
+	if registry.request.Pool != "build" || registry.request.Metadata["az"] != "us-east-1a" {
+		t.Fatalf("allocate request = %+v, want the pool and metadata", registry.request)
+	}
+}
+
+func TestAcquireGivesUpOnRejectedRequest(t *testing.T) {
+	registry := &testRegistry{}
+	opts := testOptions(registry.start(t).URL)
+	opts.ClientID = ""
+
+	if _, err := acquire(context.Background(), client.New(opts.ServerURL), opts); err == nil {
+		t.Fatal("acquire succeeded with a rejected request")
+	}
+	if n := registry.allocations.Load(); n != 1 {
+		t.Fatalf("%d allocation attempt(s), want 1", n)
+	}
+}
+
+func TestLeaseHeartbeats(t *testing.T) {
+	registry := &testRegistry{}
+	opts := testOptions(registry.start(t).URL)
+
+	lease, err := acquire(context.Background(), client.New(opts.ServerURL), opts)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer lease.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for registry.probes.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d heartbeat(s) after 2s, want at least 3", registry.probes.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-lease.Lost():
+		t.Fatalf("lease lost: %v", lease.Err())
+	default:
+	}
+}
+
+func TestRunExitsNonZeroOnLossWhateverTheHookReturns(t *testing.T) {
+	registry := &testRegistry{lostAfter: 1}
+	opts := testOptions(registry.start(t).URL)
+
+	dir := t.TempDir()
+	opts.OutputFile = filepath.Join(dir, "identifier")
+	hookOutput := filepath.Join(dir, "hook")
+	opts.OnLost = `echo "$ASG_IDENTIFIER $ASG_CLIENT_ID" > ` + hookOutput + `; exit 0`
+
+	done := make(chan int, 1)
+	go func() { done <- run(opts) }()
+
+	var code int
+	select {
+	case code = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after the lease was lost")
+	}
+	if code == 0 {
+		t.Fatal("run exited 0 after losing the lease")
+	}
+
+	if published, err := os.ReadFile(opts.OutputFile); err != nil || string(published) != "vm-7\n" {
+		t.Fatalf("published %q, %v; want vm-7", published, err)
+	}
+	ran, err := os.ReadFile(hookOutput)
+	if err != nil {
+		t.Fatalf("the lost hook did not run: %v", err)
+	}
+	if got := strings.TrimSpace(string(ran)); got != "vm-7 i-0abc" {
+		t.Fatalf("hook saw %q, want the identifier and client ID", got)
+	}
+}
@@ -0,0 +1,308 @@
+// Command loadtest drives a registry with many simulated clients and optional fault injection,
+// then reports latency percentiles, error rates and ownership invariant violations.
+//
+// It exits with status 2 if two simulated clients ever believed they owned the same identifier.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/liftedkilt/ci-registry/client"
+)
+
+// simClient is one simulated VM. Several simClients share a client ID when duplicate IDs are injected.
+type simClient struct {
+	instance int
+	ID       string
+	// skew scales the client's heartbeat interval to simulate a fast or slow clock
+	skew float64
+
+	identifier    string
+	nextHeartbeat time.Time
+	busy          bool
+	gone          bool
+}
+
+type job struct {
+	op     string
+	client *simClient
+}
+
+// Simulation holds the state of a run. Its mutex only guards in-memory state and is never held
+// across a request to the registry.
+type Simulation struct {
+	scenario Scenario
+	registry *client.Client
+	stats    *Stats
+	jobs     chan job
+
+	mu       sync.Mutex
+	clients  []*simClient
+	spawned  int
+	released bool
+	// owners maps each identifier to the ID of the client that believes it holds it. The
+	// registry leases to client IDs, so simClients sharing an ID share their identifier.
+	owners map[string]string
+}
+
+func main() {
+	scenario, err := loadScenario(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid scenario: %v", err)
+	}
+
+	registry := client.New(scenario.Server)
+	// Every request is measured on its own, so failures are not hidden by retries
+	registry.Retry = client.RetryPolicy{MaxAttempts: 1}
+
+	sim := &Simulation{
+		scenario: scenario,
+		registry: registry,
+		stats:    newStats(),
+		jobs:     make(chan job, scenario.Workers*4),
+		owners:   make(map[string]string),
+	}
+
+	log.Printf("Starting load test against %s: %d clients, %d workers, %s", scenario.Server, scenario.Clients, scenario.Workers, scenario.Duration)
+	start := time.Now()
+	sim.run()
+	sim.stats.write(os.Stdout, time.Since(start))
+
+	if len(sim.stats.violations) > 0 {
+		os.Exit(2)
+	}
+}
+
+// run schedules work until the scenario's duration has passed, then waits for the workers
+func (s *Simulation) run() {
+	var wg sync.WaitGroup
+	for i := 0; i < s.scenario.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range s.jobs {
+				s.process(j)
+			}
+		}()
+	}
+
+	start := time.Now()
+	stop := time.After(s.scenario.Duration)
+	ticker := time.NewTicker(s.scenario.SpawnInterval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-stop:
+			break loop
+		case now := <-ticker.C:
+			s.tick(now, now.Sub(start))
+		}
+	}
+
+	close(s.jobs)
+	wg.Wait()
+}
+
+// tick spawns clients, injects faults and queues due heartbeats
+func (s *Simulation) tick(now time.Time, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.spawned < s.scenario.Clients && rand.Float64() < s.scenario.SpawnChance {
+		s.spawn(now)
+	}
+
+	massRelease := s.scenario.Faults.MassRelease
+	if !s.released && massRelease.Fraction > 0 && elapsed >= massRelease.At {
+		s.released = true
+		s.massRelease(massRelease.Fraction)
+	}
+
+	active := s.clients[:0]
+	for _, c := range s.clients {
+		if c.gone {
+			continue
+		}
+		active = append(active, c)
+		if c.busy || c.identifier == "" {
+			continue
+		}
+
+		// Chance for expiration
+		if rand.Float64() < s.scenario.ExpirationChance {
+			c.gone = true
+			s.disown(c)
+			continue
+		}
+
+		if now.Before(c.nextHeartbeat) {
+			continue
+		}
+		c.nextHeartbeat = now.Add(time.Duration(float64(s.scenario.HeartbeatInterval) * c.skew))
+
+		if rand.Float64() < s.scenario.Faults.DropHeartbeats {
+			s.stats.fault("dropped_heartbeat")
+			continue
+		}
+		s.enqueue(job{op: OpHeartbeat, client: c})
+	}
+	s.clients = active
+}
+
+// spawn adds a new simulated client and queues its allocation
+func (s *Simulation) spawn(now time.Time) {
+	c := &simClient{instance: s.spawned, ID: uuid.New().String(), skew: 1}
+
+	if len(s.clients) > 0 && rand.Float64() < s.scenario.Faults.DuplicateClientIDs {
+		c.ID = s.clients[rand.Intn(len(s.clients))].ID
+		s.stats.fault("duplicate_client_id")
+	}
+	if skew := s.scenario.Faults.ClockSkew; skew > 0 {
+		c.skew = 1 + skew*(2*rand.Float64()-1)
+		s.stats.fault("clock_skewed_client")
+	}
+
+	s.spawned++
+	s.clients = append(s.clients, c)
+	s.enqueue(job{op: OpAllocate, client: c})
+}
+
+// massRelease releases a fraction of the clients holding identifiers at once
+func (s *Simulation) massRelease(fraction float64) {
+	count := 0
+	for _, c := range s.clients {
+		if c.gone || c.busy || c.identifier == "" || rand.Float64() >= fraction {
+			continue
+		}
+		if s.enqueue(job{op: OpRelease, client: c}) {
+			count++
+		}
+	}
+	s.stats.mu.Lock()
+	s.stats.faults["mass_released_client"] += count
+	s.stats.mu.Unlock()
+	log.Printf("Mass release of %d client(s)", count)
+}
+
+// enqueue hands a job to the workers, leaving the client idle if they are saturated
+func (s *Simulation) enqueue(j job) bool {
+	select {
+	case s.jobs <- j:
+		j.client.busy = true
+		return true
+	default:
+		s.stats.fault("saturated_" + j.op)
+		if j.op == OpAllocate {
+			// Retry the allocation on a later spawn tick
+			j.client.gone = true
+			s.spawned--
+		}
+		return false
+	}
+}
+
+// process performs one request and updates the client's view of what it owns
+func (s *Simulation) process(j job) {
+	c := j.client
+	ctx := context.Background()
+
+	start := time.Now()
+	var err error
+	var identifier string
+	switch j.op {
+	case OpAllocate:
+		var resp *client.AllocateResponse
+		resp, err = s.registry.Allocate(ctx, client.AllocateRequest{ClientID: c.ID, Pool: s.scenario.Pool})
+		if err == nil {
+			identifier = resp.Identifier
+		}
+	case OpHeartbeat:
+		_, err = s.registry.Heartbeat(ctx, client.LivenessRequest{ClientID: c.ID, Identifier: c.identifier})
+	case OpRelease:
+		err = s.registry.Release(ctx, c.ID, c.identifier)
+	}
+	s.stats.record(j.op, time.Since(start), err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.busy = false
+	if c.gone && j.op != OpAllocate {
+		// A client sharing its ID released or lost the identifier meanwhile
+		return
+	}
+
+	switch j.op {
+	case OpAllocate:
+		if err != nil {
+			c.gone = true
+			return
+		}
+		c.identifier = identifier
+		c.nextHeartbeat = time.Now()
+		s.claim(c)
+	case OpHeartbeat:
+		switch {
+		case err == nil:
+			s.claim(c)
+		case errors.Is(err, client.ErrNotFound), errors.Is(err, client.ErrConflict):
+			// The registry no longer leases the identifier to this client ID
+			s.lose(c)
+		}
+		// Other failures, such as 5xx responses and timeouts, say nothing about the lease,
+		// so the client keeps it and heartbeats again on schedule
+	case OpRelease:
+		if err == nil {
+			s.lose(c)
+		} else {
+			c.gone = true
+			s.disown(c)
+		}
+	}
+}
+
+// claim records that c believes it holds its identifier, flagging a violation if a client
+// with another ID believes the same
+func (s *Simulation) claim(c *simClient) {
+	if owner, ok := s.owners[c.identifier]; ok && owner != c.ID {
+		s.stats.violation("identifier %s held by client %s and client #%d (%s)",
+			c.identifier, owner, c.instance, c.ID)
+	}
+	s.owners[c.identifier] = c.ID
+}
+
+// disown forgets c's belief that it holds its identifier, unless another live client
+// sharing its ID still holds it
+func (s *Simulation) disown(c *simClient) {
+	if s.owners[c.identifier] != c.ID {
+		return
+	}
+	for _, other := range s.clients {
+		if other != c && !other.gone && other.ID == c.ID && other.identifier == c.identifier {
+			return
+		}
+	}
+	delete(s.owners, c.identifier)
+}
+
+// lose marks c and every client sharing its ID and identifier as gone, because the
+// registry no longer leases the identifier to that ID
+func (s *Simulation) lose(c *simClient) {
+	for _, other := range s.clients {
+		if other.ID == c.ID && other.identifier == c.identifier {
+			other.gone = true
+		}
+	}
+	c.gone = true
+	if s.owners[c.identifier] == c.ID {
+		delete(s.owners, c.identifier)
+	}
+}
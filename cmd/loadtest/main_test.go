@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/liftedkilt/ci-registry/client"
+)
+
+func testSimulation(url string) *Simulation {
+	registry := client.New(url)
+	registry.Retry = client.RetryPolicy{MaxAttempts: 1}
+	return &Simulation{
+		scenario: defaultScenario(),
+		registry: registry,
+		stats:    newStats(),
+		owners:   make(map[string]string),
+	}
+}
+
+func TestClaimKeysOwnersByClientID(t *testing.T) {
+	s := testSimulation("http://127.0.0.1:0")
+	first := &simClient{instance: 0, ID: "vm-a", identifier: "id-1"}
+	duplicate := &simClient{instance: 1, ID: "vm-a", identifier: "id-1"}
+	other := &simClient{instance: 2, ID: "vm-b", identifier: "id-1"}
+	s.clients = []*simClient{first, duplicate, other}
+
+	// Clients sharing an ID share the lease, so both may believe they hold it
+	s.claim(first)
+	s.claim(duplicate)
+	if len(s.stats.violations) != 0 {
+		t.Fatalf("violations for a duplicate client ID: %v", s.stats.violations)
+	}
+
+	// One of them going away leaves the identifier with the other
+	first.gone = true
+	s.disown(first)
+	if s.owners["id-1"] != "vm-a" {
+		t.Fatalf("owner after one duplicate left = %q, want vm-a", s.owners["id-1"])
+	}
+
+	s.claim(other)
+	if len(s.stats.violations) != 1 {
+		t.Fatalf("violations = %v, want one for vm-b", s.stats.violations)
+	}
+
+	duplicate.gone = true
+	s.disown(duplicate)
+	if s.owners["id-1"] != "vm-b" {
+		t.Fatalf("owner = %q, want vm-b to stay", s.owners["id-1"])
+	}
+}
+
+func TestProcessHeartbeatOnlyDropsLostLeases(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		lost   bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusNotFound, true},
+		{http.StatusConflict, true},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.status != http.StatusOK {
+				http.Error(w, http.StatusText(tc.status), tc.status)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"ok"}`))
+		}))
+
+		s := testSimulation(server.URL)
+		c := &simClient{ID: "vm-a", identifier: "id-1", busy: true}
+		duplicate := &simClient{ID: "vm-a", identifier: "id-1"}
+		s.clients = []*simClient{c, duplicate}
+		s.claim(c)
+
+		s.process(job{op: OpHeartbeat, client: c})
+		server.Close()
+
+		if c.busy {
+			t.Errorf("HTTP %d: client still busy", tc.status)
+		}
+		if c.gone != tc.lost || duplicate.gone != tc.lost {
+			t.Errorf("HTTP %d: gone = %v, duplicate gone = %v, want %v", tc.status, c.gone, duplicate.gone, tc.lost)
+		}
+		if _, owned := s.owners["id-1"]; owned == tc.lost {
+			t.Errorf("HTTP %d: owned = %v, want %v", tc.status, owned, !tc.lost)
+		}
+	}
+}
+
+func TestProcessHeartbeatNetworkErrorKeepsLease(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	s := testSimulation(url)
+	c := &simClient{ID: "vm-a", identifier: "id-1", busy: true}
+	s.clients = []*simClient{c}
+	s.claim(c)
+
+	s.process(job{op: OpHeartbeat, client: c})
+	if c.gone || s.owners["id-1"] != "vm-a" {
+		t.Fatalf("network error dropped the lease: gone = %v, owners = %v", c.gone, s.owners)
+	}
+	if s.stats.outcomes[OpHeartbeat]["network"] != 1 {
+		t.Fatalf("outcomes = %v, want one network error", s.stats.outcomes[OpHeartbeat])
+	}
+}
+
+func TestProcessReleaseDropsDuplicates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	s := testSimulation(server.URL)
+	c := &simClient{ID: "vm-a", identifier: "id-1", busy: true}
+	duplicate := &simClient{ID: "vm-a", identifier: "id-1"}
+	s.clients = []*simClient{c, duplicate}
+	s.claim(c)
+	s.claim(duplicate)
+
+	s.process(job{op: OpRelease, client: c})
+	if !c.gone || !duplicate.gone {
+		t.Fatalf("gone = %v, duplicate gone = %v, want both after a release", c.gone, duplicate.gone)
+	}
+	if _, ok := s.owners["id-1"]; ok {
+		t.Fatalf("owners = %v, want id-1 released", s.owners)
+	}
+
+	// A heartbeat that was in flight for the duplicate must not reclaim the identifier
+	duplicate.busy = true
+	s.process(job{op: OpHeartbeat, client: duplicate})
+	if _, ok := s.owners["id-1"]; ok {
+		t.Fatalf("owners = %v, want id-1 to stay released", s.owners)
+	}
+}
+
+func TestProcessAllocateClaims(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"identifier":"id-7","identifiers":["id-7"]}`))
+	}))
+	defer server.Close()
+
+	s := testSimulation(server.URL)
+	c := &simClient{ID: "vm-a", busy: true}
+	s.clients = []*simClient{c}
+
+	s.process(job{op: OpAllocate, client: c})
+	if c.gone || c.identifier != "id-7" || s.owners["id-7"] != "vm-a" {
+		t.Fatalf("after allocate: gone = %v, identifier = %q, owners = %v", c.gone, c.identifier, s.owners)
+	}
+}
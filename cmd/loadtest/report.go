@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liftedkilt/ci-registry/client"
+)
+
+// Operation names used in the report
+const (
+	OpAllocate  = "allocate"
+	OpHeartbeat = "heartbeat"
+	OpRelease   = "release"
+)
+
+// Stats collects latencies, outcomes and invariant violations across workers
+type Stats struct {
+	mu         sync.Mutex
+	latencies  map[string][]time.Duration
+	outcomes   map[string]map[string]int
+	faults     map[string]int
+	violations []string
+}
+
+func newStats() *Stats {
+	return &Stats{
+		latencies: make(map[string][]time.Duration),
+		outcomes:  make(map[string]map[string]int),
+		faults:    make(map[string]int),
+	}
+}
+
+// record notes the latency and outcome of one request
+func (s *Stats) record(op string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latencies[op] = append(s.latencies[op], latency)
+	if s.outcomes[op] == nil {
+		s.outcomes[op] = make(map[string]int)
+	}
+	s.outcomes[op][outcome(err)]++
+}
+
+// fault counts an injected fault
+func (s *Stats) fault(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[name]++
+}
+
+// violation records a broken invariant
+func (s *Stats) violation(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.violations = append(s.violations, fmt.Sprintf(format, args...))
+}
+
+// outcome classifies a request result for the error-rate table
+func outcome(err error) string {
+	var apiErr *client.APIError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &apiErr):
+		return fmt.Sprintf("http_%d", apiErr.StatusCode)
+	default:
+		return "network"
+	}
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+// write prints the report
+func (s *Stats) write(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "\nLoad test finished after %s\n\n", elapsed.Round(time.Millisecond))
+
+	fmt.Fprintf(w, "%-10s %8s %8s %10s %10s %10s %10s\n", "operation", "count", "errors", "p50", "p90", "p99", "max")
+	for _, op := range []string{OpAllocate, OpHeartbeat, OpRelease} {
+		latencies := append([]time.Duration(nil), s.latencies[op]...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		errs := len(latencies) - s.outcomes[op]["ok"]
+		fmt.Fprintf(w, "%-10s %8d %8d %10s %10s %10s %10s\n", op, len(latencies), errs,
+			percentile(latencies, 0.50).Round(time.Microsecond),
+			percentile(latencies, 0.90).Round(time.Microsecond),
+			percentile(latencies, 0.99).Round(time.Microsecond),
+			percentile(latencies, 1).Round(time.Microsecond))
+	}
+
+	fmt.Fprintln(w, "\nOutcomes:")
+	for _, op := range []string{OpAllocate, OpHeartbeat, OpRelease} {
+		total := len(s.latencies[op])
+		names := make([]string, 0, len(s.outcomes[op]))
+		for name := range s.outcomes[op] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			n := s.outcomes[op][name]
+			fmt.Fprintf(w, "  %-10s %-10s %8d (%.2f%%)\n", op, name, n, 100*float64(n)/float64(total))
+		}
+	}
+
+	if len(s.faults) > 0 {
+		fmt.Fprintln(w, "\nInjected faults:")
+		names := make([]string, 0, len(s.faults))
+		for name := range s.faults {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %-22s %8d\n", name, s.faults[name])
+		}
+	}
+
+	fmt.Fprintf(w, "\nInvariant violations: %d\n", len(s.violations))
+	for i, v := range s.violations {
+		if i == 20 {
+			fmt.Fprintf(w, "  ... and %d more\n", len(s.violations)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+}
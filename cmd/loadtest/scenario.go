@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario describes one load test run. It can be read from a YAML file and overridden by flags.
+type Scenario struct {
+	Server            string        `yaml:"server"`
+	Clients           int           `yaml:"clients"`
+	SpawnInterval     time.Duration `yaml:"spawn_interval"`
+	SpawnChance       float64       `yaml:"spawn_chance"`
+	Duration          time.Duration `yaml:"duration"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	ExpirationChance  float64       `yaml:"expiration_chance"`
+	Workers           int           `yaml:"workers"`
+	Pool              string        `yaml:"pool"`
+	Faults            Faults        `yaml:"faults"`
+}
+
+// Faults configures the chaos injected into the run
+type Faults struct {
+	// DropHeartbeats is the chance that a due heartbeat is silently skipped
+	DropHeartbeats float64 `yaml:"drop_heartbeats"`
+	// DuplicateClientIDs is the chance that a new client reuses the ID of an existing one
+	DuplicateClientIDs float64 `yaml:"duplicate_client_ids"`
+	// ClockSkew is the maximum fraction by which a client's heartbeat clock runs fast or slow
+	ClockSkew float64 `yaml:"clock_skew"`
+	// MassRelease releases a fraction of all clients at once, at a point in the run
+	MassRelease MassRelease `yaml:"mass_release"`
+}
+
+// MassRelease releases Fraction of the active clients At the given offset into the run
+type MassRelease struct {
+	At       time.Duration `yaml:"at"`
+	Fraction float64       `yaml:"fraction"`
+}
+
+// defaultScenario matches the original hardcoded simulation
+func defaultScenario() Scenario {
+	return Scenario{
+		Server:            "http://localhost:8080",
+		Clients:           1200,
+		SpawnInterval:     10 * time.Millisecond,
+		SpawnChance:       0.8,
+		Duration:          5 * time.Minute,
+		HeartbeatInterval: 10 * time.Second,
+		ExpirationChance:  0.02,
+		Workers:           32,
+	}
+}
+
+// loadScenario builds the scenario from defaults, an optional scenario file, then flags
+func loadScenario(args []string) (Scenario, error) {
+	s := defaultScenario()
+
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	file := fs.String("scenario", "", "YAML scenario file; flags override its values")
+	server := fs.String("server", "", "registry base URL")
+	clients := fs.Int("clients", 0, "total clients to simulate")
+	spawnInterval := fs.Duration("spawn-interval", 0, "time between client spawn attempts")
+	spawnChance := fs.Float64("spawn-chance", -1, "chance a spawn attempt adds a client")
+	duration := fs.Duration("duration", 0, "length of the run")
+	heartbeat := fs.Duration("heartbeat-interval", 0, "liveness interval per client")
+	expiration := fs.Float64("expiration-chance", -1, "chance per tick that a client lets its identifier expire")
+	workers := fs.Int("workers", 0, "concurrent request workers")
+	pool := fs.String("pool", "", "identifier pool to allocate from")
+	drop := fs.Float64("drop-heartbeats", -1, "chance a heartbeat is dropped")
+	duplicate := fs.Float64("duplicate-ids", -1, "chance a new client reuses an existing client ID")
+	skew := fs.Float64("clock-skew", -1, "maximum heartbeat clock skew as a fraction, e.g. 0.2")
+	releaseAt := fs.Duration("mass-release-at", 0, "offset into the run at which to mass-release clients")
+	releaseFraction := fs.Float64("mass-release-fraction", -1, "fraction of clients to mass-release")
+
+	if err := fs.Parse(args); err != nil {
+		return s, err
+	}
+
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return s, err
+		}
+		if err := yaml.Unmarshal(data, &s); err != nil {
+			return s, err
+		}
+	}
+
+	if *server != "" {
+		s.Server = *server
+	}
+	if *clients > 0 {
+		s.Clients = *clients
+	}
+	if *spawnInterval > 0 {
+		s.SpawnInterval = *spawnInterval
+	}
+	if *spawnChance >= 0 {
+		s.SpawnChance = *spawnChance
+	}
+	if *duration > 0 {
+		s.Duration = *duration
+	}
+	if *heartbeat > 0 {
+		s.HeartbeatInterval = *heartbeat
+	}
+	if *expiration >= 0 {
+		s.ExpirationChance = *expiration
+	}
+	if *workers > 0 {
+		s.Workers = *workers
+	}
+	if *pool != "" {
+		s.Pool = *pool
+	}
+	if *drop >= 0 {
+		s.Faults.DropHeartbeats = *drop
+	}
+	if *duplicate >= 0 {
+		s.Faults.DuplicateClientIDs = *duplicate
+	}
+	if *skew >= 0 {
+		s.Faults.ClockSkew = *skew
+	}
+	if *releaseAt > 0 {
+		s.Faults.MassRelease.At = *releaseAt
+	}
+	if *releaseFraction >= 0 {
+		s.Faults.MassRelease.Fraction = *releaseFraction
+	}
+
+	return s, s.validate()
+}
+
+func (s Scenario) validate() error {
+	switch {
+	case s.Clients < 1:
+		return errors.New("clients must be positive")
+	case s.Workers < 1:
+		return errors.New("workers must be positive")
+	case s.SpawnInterval <= 0 || s.Duration <= 0 || s.HeartbeatInterval <= 0:
+		return errors.New("spawn_interval, duration and heartbeat_interval must be positive")
+	case s.Faults.ClockSkew < 0 || s.Faults.ClockSkew >= 1:
+		return errors.New("clock_skew must be in [0, 1)")
+	case s.Faults.MassRelease.Fraction < 0 || s.Faults.MassRelease.Fraction > 1:
+		return errors.New("mass_release.fraction must be in [0, 1]")
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// command is a maintenance subcommand of the registry binary
+type command struct {
+	run func(args []string, stdout, stderr io.Writer) error
+	// openDB opens the database before run, and closes it after
+	openDB bool
+}
+
+// commands work on the database named in config.yaml directly, so they also work while the
+// server is down
+var commands = map[string]command{
+	"export":  {run: exportCommand, openDB: true},
+	"import":  {run: importCommand, openDB: true},
+	"backup":  {run: backupCommand, openDB: true},
+	"restore": {run: restoreCommand},
+}
+
+// errRaftLocalChange refuses a command that would change the database outside the raft log,
+// leaving the node out of step with its peers until a snapshot or log replay overwrites it
+var errRaftLocalChange = errors.New("raft is enabled: the database can only be changed through the raft log")
+
+// runCommand runs a maintenance subcommand and returns the process exit status
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		return 2
+	}
+
+	var err error
+	config, err = LoadConfig("config.yaml")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	if cmd.openDB {
+		initDB()
+		defer db.Close()
+	}
+
+	if err := cmd.run(args, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// exportCommand writes the identifier table to stdout or a file
+func exportCommand(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "", "csv or ndjson (default from the -o extension, else ndjson)")
+	output := fs.String("o", "", "write to this file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *format == "" {
+		*format = formatFromPath(*output)
+	}
+	if !validExportFormat(*format) {
+		return fmt.Errorf("format must be csv or ndjson")
+	}
+
+	records, err := loadExportRecords(db)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return writeExport(stdout, *format, records)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeExport(f, *format, records); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Exported %d identifiers to %s\n", len(records), *output)
+	return nil
+}
+
+// importCommand loads an export into the identifier table, printing the changes it makes
+func importCommand(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "", "csv or ndjson (default from the file extension, else ndjson)")
+	mode := fs.String("mode", ImportMerge, "merge keeps identifiers missing from the file, replace deletes them")
+	dryRun := fs.Bool("dry-run", false, "print the changes without making them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import [-format csv|ndjson] [-mode merge|replace] [-dry-run] FILE")
+	}
+	if config.Raft.Enabled && !*dryRun {
+		return errRaftLocalChange
+	}
+
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = formatFromPath(path)
+	}
+	if !validExportFormat(*format) {
+		return fmt.Errorf("format must be csv or ndjson")
+	}
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	records, err := readExport(in, *format)
+	if err != nil {
+		return err
+	}
+
+	changes, err := planImport(records, *mode)
+	if err != nil {
+		return err
+	}
+
+	var added, updated, removed int
+	for _, c := range changes {
+		fmt.Fprintln(stdout, c)
+		switch {
+		case c.Before == nil:
+			added++
+		case c.After == nil:
+			removed++
+		default:
+			updated++
+		}
+	}
+	summary := fmt.Sprintf("%d added, %d updated, %d removed", added, updated, removed)
+
+	if *dryRun {
+		fmt.Fprintf(stderr, "Dry run: %s\n", summary)
+		return nil
+	}
+	if err := applyImport(changes); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Imported %d identifiers: %s\n", len(records), summary)
+	return nil
+}
+
+// backupCommand takes an online backup, into the backup directory or to a given file
+func backupCommand(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	output := fs.String("o", "", "write the backup to this file instead of the backup directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *output != "" {
+		if err := backupDatabase(*output); err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, *output)
+		return nil
+	}
+
+	backup, err := createBackup(time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, backup.Path)
+	return nil
+}
+
+// restoreCommand verifies a backup and swaps it in as the database file. The server must be stopped.
+func restoreCommand(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	verifyOnly := fs.Bool("verify", false, "only check the backup's integrity")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-verify] FILE")
+	}
+
+	backup := fs.Arg(0)
+	if *verifyOnly {
+		if err := verifyDatabase(backup); err != nil {
+			return fmt.Errorf("%s: %v", backup, err)
+		}
+		fmt.Fprintf(stdout, "%s: ok\n", backup)
+		return nil
+	}
+
+	if config.Raft.Enabled {
+		return errRaftLocalChange
+	}
+
+	dest := databasePath(config.Database.Datasource)
+	if err := restoreDatabase(backup, dest); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Restored %s from %s\n", dest, backup)
+	return nil
+}
+
+// formatFromPath picks the export format from a file extension
+func formatFromPath(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return FormatCSV
+	}
+	return FormatNDJSON
+}
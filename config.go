@@ -14,9 +14,12 @@ import (
 
 // Config holds the application configuration
 type Config struct {
-	Server      ServerConfig     `yaml:"server"`
-	Database    DatabaseConfig   `yaml:"database"`
-	Identifiers IdentifierConfig `yaml:"identifiers"`
+	Server        ServerConfig        `yaml:"server"`
+	Database      DatabaseConfig      `yaml:"database"`
+	Identifiers   IdentifierConfig    `yaml:"identifiers"`
+	Webhooks      []WebhookConfig     `yaml:"webhooks"`
+	LocalReplicas LocalReplicasConfig `yaml:"local_replicas"`
+	Raft          RaftConfig          `yaml:"raft"`
 }
 
 // ServerConfig holds server-specific configurations
@@ -26,17 +29,294 @@ type ServerConfig struct {
 	WriteTimeout time.Duration `yaml:"write_timeout"`
 	IdleTimeout  time.Duration `yaml:"idle_timeout"`
 	StaleTimeout time.Duration `yaml:"stale_timeout"`
+	// ReuseCooldown keeps released identifiers out of allocation for this long
+	ReuseCooldown time.Duration `yaml:"reuse_cooldown"`
+	// GRPCAddress serves the gRPC API on a second port when set
+	GRPCAddress string `yaml:"grpc_address"`
+	// StreamGracePeriod is how long a streaming lease survives a dropped connection
+	StreamGracePeriod time.Duration `yaml:"stream_grace_period"`
+	// HeartbeatFlushInterval is how often buffered liveness probes are written to the
+	// database; a negative value writes every probe through
+	HeartbeatFlushInterval time.Duration `yaml:"heartbeat_flush_interval"`
+	// MaxReapFraction pauses the reaper when more than this fraction of the held leases are
+	// stale at once; 0 disables the guard
+	MaxReapFraction float64 `yaml:"max_reap_fraction"`
+	// ReapGuardMinimum is the number of stale leases the reaper expires regardless of the fraction
+	ReapGuardMinimum int `yaml:"reap_guard_minimum"`
+	// AllocationMaxWait is the longest an allocation may wait for identifiers, blocking or on
+	// the waitlist; a negative value disables waiting
+	AllocationMaxWait time.Duration `yaml:"allocation_max_wait"`
+	// AdminToken is the bearer token the admin endpoints require; they are disabled without one
+	AdminToken string `yaml:"admin_token"`
+	// WebhookRetention is how long delivered and failed webhook deliveries are kept
+	WebhookRetention time.Duration `yaml:"webhook_retention"`
 }
 
 // DatabaseConfig holds database-specific configurations
 type DatabaseConfig struct {
 	Driver     string `yaml:"driver"`
 	Datasource string `yaml:"datasource"`
+
+	// JournalMode, Synchronous and BusyTimeout are applied to every SQLite connection
+	JournalMode string        `yaml:"journal_mode"`
+	Synchronous string        `yaml:"synchronous"`
+	BusyTimeout time.Duration `yaml:"busy_timeout"`
+
+	// MaxOpenConns limits the connection pool; a negative value leaves it unlimited.
+	// SQLite allows one writer at a time, so a single connection avoids "database is locked".
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+
+	Backup BackupConfig `yaml:"backup"`
+}
+
+// applyDefaults fills in the SQLite settings that are not configured
+func (c *DatabaseConfig) applyDefaults() {
+	if c.JournalMode == "" {
+		c.JournalMode = "wal"
+	}
+	if c.Synchronous == "" {
+		c.Synchronous = "normal"
+	}
+	if c.BusyTimeout == 0 {
+		c.BusyTimeout = 5 * time.Second
+	}
+	if c.MaxOpenConns == 0 {
+		c.MaxOpenConns = 1
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = c.MaxOpenConns
+	}
+	if c.Backup.Directory == "" {
+		c.Backup.Directory = "backups"
+	}
+	if c.Backup.Retain == 0 {
+		c.Backup.Retain = 7
+	}
+}
+
+// BackupConfig holds where online backups are written and how often they are taken
+type BackupConfig struct {
+	Directory string `yaml:"directory"`
+	// Interval takes a backup on a schedule when set
+	Interval time.Duration `yaml:"interval"`
+	// Retain is the number of backups kept in Directory; older ones are deleted
+	Retain int `yaml:"retain"`
+}
+
+// LocalReplicasConfig enables running several replicas on one host against the same SQLite
+// file, so that a crashed or restarting process does not take the registry down. The replicas
+// elect a leader through a lease row in the database; only the leader runs the background
+// tasks. They share their events through the database, so watchers on any replica see every
+// change. It does not survive the loss of the host; Raft does.
+type LocalReplicasConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// NodeID must be unique among the replicas
+	NodeID        string        `yaml:"node_id"`
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	RenewInterval time.Duration `yaml:"renew_interval"`
+}
+
+// RaftConfig replicates the identifier table across registry nodes with Raft, each node
+// keeping its own database, as an alternative to local replicas sharing one file
+type RaftConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// NodeID is this node's member ID, unique in the cluster and not zero
+	NodeID uint64 `yaml:"node_id"`
+	// ListenAddress serves the messages members exchange, apart from the API
+	ListenAddress string `yaml:"listen_address"`
+	// Secret signs the messages members exchange; every member needs the same one
+	Secret string `yaml:"secret"`
+	// Peers are the members the cluster starts with, including this node
+	Peers []RaftPeer `yaml:"peers"`
+	// Join starts this node without members, to be added to a running cluster through
+	// /admin/raft/members
+	Join bool `yaml:"join"`
+
+	TickInterval time.Duration `yaml:"tick_interval"`
+	// ElectionTicks without hearing from a leader start an election; the leader sends a
+	// heartbeat every HeartbeatTicks
+	ElectionTicks  int `yaml:"election_ticks"`
+	HeartbeatTicks int `yaml:"heartbeat_ticks"`
+	// SnapshotEntries is how many applied entries trigger a snapshot, after which the log is compacted
+	SnapshotEntries uint64 `yaml:"snapshot_entries"`
+	// ProposalTimeout bounds how long a write waits to be committed and applied
+	ProposalTimeout time.Duration `yaml:"proposal_timeout"`
+}
+
+// RaftPeer is a cluster member and the base URL of its raft.listen_address
+type RaftPeer struct {
+	ID  uint64 `yaml:"id"`
+	URL string `yaml:"url"`
+}
+
+// applyDefaults fills in the Raft timings that are not configured, and checks the membership
+func (c *RaftConfig) applyDefaults() error {
+	if c.TickInterval == 0 {
+		c.TickInterval = 100 * time.Millisecond
+	}
+	if c.ElectionTicks == 0 {
+		c.ElectionTicks = 10
+	}
+	if c.HeartbeatTicks == 0 {
+		c.HeartbeatTicks = 1
+	}
+	if c.SnapshotEntries == 0 {
+		c.SnapshotEntries = 1000
+	}
+	if c.ProposalTimeout == 0 {
+		c.ProposalTimeout = 5 * time.Second
+	}
+
+	if !c.Enabled {
+		return nil
+	}
+	if c.NodeID == 0 {
+		return fmt.Errorf("raft.node_id is required")
+	}
+	if c.ListenAddress == "" {
+		return fmt.Errorf("raft.listen_address is required")
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("raft.secret is required")
+	}
+	if c.HeartbeatTicks >= c.ElectionTicks {
+		return fmt.Errorf("raft.heartbeat_ticks must be fewer than raft.election_ticks")
+	}
+	if c.Join {
+		return nil
+	}
+	for _, peer := range c.Peers {
+		if peer.ID == c.NodeID {
+			return nil
+		}
+	}
+	return fmt.Errorf("raft.peers must include node %d unless raft.join is set", c.NodeID)
+}
+
+// WebhookConfig describes an HTTP endpoint that receives signed lease events
+type WebhookConfig struct {
+	Name        string        `yaml:"name"`
+	URL         string        `yaml:"url"`
+	Secret      string        `yaml:"secret"`
+	Events      []string      `yaml:"events"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
 }
 
-// IdentifierConfig holds identifier patterns
+// IdentifierConfig holds identifier patterns and the allocation strategy.
+// The top-level patterns form the default pool; Pools declares additional named pools.
 type IdentifierConfig struct {
-	Patterns []string `yaml:"patterns"`
+	Patterns     []string           `yaml:"patterns"`
+	Strategy     AllocationStrategy `yaml:"allocation_strategy"`
+	MaxPerClient int                `yaml:"max_per_client"`
+	Pools        []PoolConfig       `yaml:"pools"`
+	// LowWatermark, Growth and TTL apply to the default pool, as in PoolConfig
+	LowWatermark int          `yaml:"low_watermark"`
+	Growth       GrowthConfig `yaml:"growth"`
+	TTL          TTLConfig    `yaml:"ttl"`
+}
+
+// PoolConfig holds the identifier patterns and limits of a single pool
+type PoolConfig struct {
+	Name         string   `yaml:"name"`
+	Patterns     []string `yaml:"patterns"`
+	MaxPerClient int      `yaml:"max_per_client"`
+	// LowWatermark raises pool_low once no more than this many identifiers are available
+	LowWatermark int `yaml:"low_watermark"`
+	// Growth adds identifiers to the pool when it runs low
+	Growth GrowthConfig `yaml:"growth"`
+	// TTL bounds how long the pool's leases survive without a liveness probe
+	TTL TTLConfig `yaml:"ttl"`
+}
+
+// leaseTTL returns the TTL of a lease asking for seconds, or the pool's default for 0
+func (p PoolConfig) leaseTTL(seconds int) time.Duration {
+	switch {
+	case seconds != 0:
+		return time.Duration(seconds) * time.Second
+	case p.TTL.Default > 0:
+		return p.TTL.Default
+	}
+	return config.Server.StaleTimeout
+}
+
+// TTLConfig holds the lease TTL a pool grants by default, and the range a client may ask for
+// instead. Unset, the default is the server's stale timeout and the range is just the default.
+type TTLConfig struct {
+	Default time.Duration `yaml:"default"`
+	Min     time.Duration `yaml:"min"`
+	Max     time.Duration `yaml:"max"`
+}
+
+// applyDefaults fills in the TTLs that are not configured and checks that they are consistent
+func (t *TTLConfig) applyDefaults(staleTimeout time.Duration) error {
+	if t.Default == 0 {
+		t.Default = staleTimeout
+	}
+	if t.Min == 0 {
+		t.Min = t.Default
+	}
+	if t.Max == 0 {
+		t.Max = t.Default
+	}
+	for _, d := range []time.Duration{t.Default, t.Min, t.Max} {
+		if d <= 0 || d%time.Second != 0 {
+			return fmt.Errorf("ttl must be a positive whole number of seconds")
+		}
+	}
+	if t.Min > t.Default || t.Default > t.Max {
+		return fmt.Errorf("ttl.default must be between ttl.min and ttl.max")
+	}
+	return nil
+}
+
+// GrowthConfig lets a pool grow beyond its patterns. Once no more than the pool's low watermark
+// of identifiers are available, the next BlockSize identifiers expanded from Patterns are added.
+// The last block added is removed again once all of it is free and the pool can spare it.
+type GrowthConfig struct {
+	Patterns  []string `yaml:"patterns"`
+	BlockSize int      `yaml:"block_size"`
+}
+
+// blocks returns the identifiers the pool can grow by, in the order they are added
+func (g GrowthConfig) blocks() [][]string {
+	if g.BlockSize <= 0 {
+		return nil
+	}
+	var blocks [][]string
+	identifiers := ExpandIdentifiers(g.Patterns)
+	for start := 0; start < len(identifiers); start += g.BlockSize {
+		end := min(start+g.BlockSize, len(identifiers))
+		blocks = append(blocks, identifiers[start:end])
+	}
+	return blocks
+}
+
+// DefaultPool is the name of the pool formed by the top-level identifier patterns
+const DefaultPool = "default"
+
+// AllPools returns every configured pool, starting with the default pool if it has patterns
+func (c IdentifierConfig) AllPools() []PoolConfig {
+	var pools []PoolConfig
+	if len(c.Patterns) > 0 {
+		pools = append(pools, PoolConfig{Name: DefaultPool, Patterns: c.Patterns, MaxPerClient: c.MaxPerClient, LowWatermark: c.LowWatermark, Growth: c.Growth, TTL: c.TTL})
+	}
+	return append(pools, c.Pools...)
+}
+
+// Pool looks up a pool by name. An empty name selects the default pool.
+func (c IdentifierConfig) Pool(name string) (PoolConfig, bool) {
+	if name == "" {
+		name = DefaultPool
+	}
+	for _, pool := range c.AllPools() {
+		if pool.Name == name {
+			return pool, true
+		}
+	}
+	return PoolConfig{}, false
 }
 
 // LoadConfig loads configuration from a YAML file
@@ -53,6 +333,111 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if config.Server.StreamGracePeriod == 0 {
+		config.Server.StreamGracePeriod = 5 * time.Second
+	}
+	if config.Server.HeartbeatFlushInterval == 0 {
+		config.Server.HeartbeatFlushInterval = time.Second
+	}
+
+	if config.Server.WebhookRetention == 0 {
+		config.Server.WebhookRetention = 7 * 24 * time.Hour
+	}
+
+	if config.Server.AllocationMaxWait == 0 {
+		config.Server.AllocationMaxWait = 5 * time.Minute
+	}
+	if config.Server.MaxReapFraction < 0 || config.Server.MaxReapFraction > 1 {
+		return nil, fmt.Errorf("server.max_reap_fraction must be between 0 and 1")
+	}
+
+	config.Database.applyDefaults()
+
+	replicas := &config.LocalReplicas
+	if replicas.NodeID == "" {
+		replicas.NodeID = defaultNodeID()
+	}
+	if replicas.LeaseDuration == 0 {
+		replicas.LeaseDuration = 15 * time.Second
+	}
+	if replicas.RenewInterval == 0 {
+		replicas.RenewInterval = replicas.LeaseDuration / 3
+	}
+	if replicas.RenewInterval >= replicas.LeaseDuration {
+		return nil, fmt.Errorf("local_replicas.renew_interval must be shorter than local_replicas.lease_duration")
+	}
+	if replicas.Enabled && isMemoryDatasource(config.Database.Datasource) {
+		return nil, fmt.Errorf("local_replicas needs a database file; an in-memory database cannot be shared")
+	}
+
+	if err := config.Raft.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if config.Raft.Enabled && replicas.Enabled {
+		return nil, fmt.Errorf("local_replicas and raft are alternatives; enable one of them")
+	}
+
+	strategy, err := parseAllocationStrategy(string(config.Identifiers.Strategy))
+	if err != nil {
+		return nil, err
+	}
+	config.Identifiers.Strategy = strategy
+
+	// Every node must pick the same identifier when it applies an allocation
+	if config.Raft.Enabled && strategy == StrategyRandom {
+		return nil, fmt.Errorf("allocation strategy %s is not supported with raft", strategy)
+	}
+
+	if config.Identifiers.MaxPerClient == 0 {
+		config.Identifiers.MaxPerClient = 1
+	}
+	if err := config.Identifiers.TTL.applyDefaults(config.Server.StaleTimeout); err != nil {
+		return nil, fmt.Errorf("identifiers: %v", err)
+	}
+	seen := map[string]bool{DefaultPool: len(config.Identifiers.Patterns) > 0}
+	for i := range config.Identifiers.Pools {
+		pool := &config.Identifiers.Pools[i]
+		if pool.Name == "" {
+			return nil, fmt.Errorf("identifier pool %d has no name", i)
+		}
+		if seen[pool.Name] {
+			return nil, fmt.Errorf("duplicate identifier pool %q", pool.Name)
+		}
+		seen[pool.Name] = true
+		if pool.MaxPerClient == 0 {
+			pool.MaxPerClient = 1
+		}
+		if err := pool.TTL.applyDefaults(config.Server.StaleTimeout); err != nil {
+			return nil, fmt.Errorf("identifier pool %q: %v", pool.Name, err)
+		}
+	}
+	if err := validatePoolGrowth(config.Identifiers.AllPools()); err != nil {
+		return nil, err
+	}
+
+	webhooks := make(map[string]bool)
+	for i := range config.Webhooks {
+		hook := &config.Webhooks[i]
+		if hook.Name == "" || hook.URL == "" {
+			return nil, fmt.Errorf("webhook %d needs a name and url", i)
+		}
+		if webhooks[hook.Name] {
+			return nil, fmt.Errorf("duplicate webhook %q", hook.Name)
+		}
+		webhooks[hook.Name] = true
+		for _, name := range hook.Events {
+			if !EventType(name).known() {
+				return nil, fmt.Errorf("webhook %q: unknown event %q", hook.Name, name)
+			}
+		}
+		if hook.Timeout == 0 {
+			hook.Timeout = 5 * time.Second
+		}
+		if hook.MaxAttempts == 0 {
+			hook.MaxAttempts = 10
+		}
+	}
+
 	return &config, nil
 }
 
@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,7 +15,7 @@ var db *sql.DB
 // initDB initializes the database connection and schema.
 func initDB() {
 	var err error
-	db, err = sql.Open(config.Database.Driver, config.Database.Datasource)
+	db, err = openDatabase(config.Database)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -31,43 +33,320 @@ func initDB() {
 		log.Fatalf("Failed to create table: %v", err)
 	}
 
+	// Columns added after the original schema
+	migrations := []struct{ column, definition string }{
+		{"sort_key", "INTEGER NOT NULL DEFAULT 0"},
+		{"released_at", "TIMESTAMP"},
+		{"metadata", "TEXT"},
+		{"pool", "TEXT NOT NULL DEFAULT '" + DefaultPool + "'"},
+		{"ttl", "INTEGER"},
+		{"released_by", "TEXT"},
+	}
+	for _, m := range migrations {
+		if err := ensureColumn("identifiers", m.column, m.definition); err != nil {
+			log.Fatalf("Failed to add column %s: %v", m.column, err)
+		}
+	}
+
+	// Indexes for filtering and sorting large listings
+	_, err = db.Exec(`
+	CREATE INDEX IF NOT EXISTS identifiers_sort_key ON identifiers (sort_key);
+	CREATE INDEX IF NOT EXISTS identifiers_pool ON identifiers (pool, sort_key);
+	CREATE INDEX IF NOT EXISTS identifiers_locked_by ON identifiers (locked_by);
+	CREATE INDEX IF NOT EXISTS identifiers_last_seen ON identifiers (last_seen);`)
+	if err != nil {
+		log.Fatalf("Failed to create indexes: %v", err)
+	}
+
+	initWebhookOutbox()
+	initLeaderLease()
+	initReaperState()
+	initPoolGrowth()
+	initAllocationCursors()
+
 	log.Println("Database initialized and schema verified.")
 }
 
-// preloadIdentifiers preloads a set of identifiers into the database.
+// openDatabase opens the connection pool with the configured SQLite settings
+func openDatabase(c DatabaseConfig) (*sql.DB, error) {
+	datasource := c.Datasource
+	if c.Driver == "sqlite3" {
+		datasource = sqliteDatasource(c)
+	}
+
+	conn, err := sql.Open(c.Driver, datasource)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(c.MaxOpenConns)
+	conn.SetMaxIdleConns(c.MaxIdleConns)
+	conn.SetConnMaxLifetime(c.ConnMaxLifetime)
+
+	if c.Driver == "sqlite3" {
+		var journalMode string
+		if err := conn.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		log.Printf("SQLite journal mode %s, synchronous %s, busy timeout %s, %d max open connection(s)",
+			journalMode, c.Synchronous, c.BusyTimeout, c.MaxOpenConns)
+	}
+	return conn, nil
+}
+
+// sqliteDatasource adds the connection settings to the datasource, so that the driver applies
+// them to every connection it opens
+func sqliteDatasource(c DatabaseConfig) string {
+	var params []string
+	if c.JournalMode != "" {
+		params = append(params, "_journal_mode="+c.JournalMode)
+	}
+	if c.Synchronous != "" {
+		params = append(params, "_synchronous="+c.Synchronous)
+	}
+	if c.BusyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_busy_timeout=%d", c.BusyTimeout.Milliseconds()))
+	}
+	// Writers take the lock when their transaction starts rather than on their first write,
+	// so a busy writer waits instead of failing on a lock upgrade
+	params = append(params, "_txlock=immediate")
+
+	separator := "?"
+	if strings.Contains(c.Datasource, "?") {
+		separator = "&"
+	}
+	return c.Datasource + separator + strings.Join(params, "&")
+}
+
+// preloadIdentifiers preloads the identifiers of every configured pool into the database.
 func preloadIdentifiers() {
-	expandedIdentifiers := ExpandIdentifiers(config.Identifiers.Patterns)
+	total := 0
+	for _, pool := range config.Identifiers.AllPools() {
+		expandedIdentifiers := ExpandIdentifiers(pool.Patterns)
 
-	for _, id := range expandedIdentifiers {
-		_, err := db.Exec("INSERT OR IGNORE INTO identifiers (identifier) VALUES (?)", id)
-		if err != nil {
-			log.Printf("Failed to preload identifier %s: %v", id, err)
+		for _, id := range expandedIdentifiers {
+			_, err := db.Exec(`
+				INSERT INTO identifiers (identifier, pool) VALUES (?, ?)
+				ON CONFLICT (identifier) DO UPDATE SET pool = excluded.pool`,
+				id, pool.Name,
+			)
+			if err != nil {
+				log.Printf("Failed to preload identifier %s: %v", id, err)
+			}
 		}
+		total += len(expandedIdentifiers)
+	}
+	log.Printf("Preloaded %d identifiers into the database", total)
+
+	if err := assignSortKeys(); err != nil {
+		log.Printf("Failed to assign identifier sort order: %v", err)
+	}
+}
+
+// staleLease is the SQL condition matching held leases whose last liveness probe is older than
+// their TTL, taking the arguments from staleLeaseArgs. Leases without a TTL of their own, such as
+// those allocated before TTLs were stored, use the stale timeout.
+const staleLease = `locked_by IS NOT NULL AND julianday(last_seen) < julianday(?, '-' || COALESCE(ttl, ?) || ' seconds')`
+
+// staleLeaseArgs returns the arguments of staleLease at now
+func staleLeaseArgs(now time.Time) []interface{} {
+	return []interface{}{now, config.Server.StaleTimeout.Seconds()}
+}
+
+// leaseTTL returns the TTL of a lease from its ttl column
+func leaseTTL(column sql.NullInt64) time.Duration {
+	if !column.Valid {
+		return config.Server.StaleTimeout
+	}
+	return time.Duration(column.Int64) * time.Second
+}
+
+// ttlColumn returns the ttl column value of a lease with the given TTL. A zero TTL is stored as
+// NULL, for the stale timeout.
+func ttlColumn(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
 	}
-	log.Printf("Preloaded %d identifiers into the database", len(expandedIdentifiers))
+	return int64(ttl / time.Second)
 }
 
 // releaseStaleIdentifiers clears stale identifier locks based on the stale timeout from the config.
 func releaseStaleIdentifiers() {
-	ticker := time.NewTicker(1 * time.Minute)
+	ticker := time.NewTicker(reapInterval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		threshold := time.Now().Add(-config.Server.StaleTimeout)
-		result, err := db.Exec(`
-			UPDATE identifiers
-			SET locked_by = NULL, last_seen = NULL
-			WHERE last_seen < ? AND locked_by IS NOT NULL`,
-			threshold,
-		)
+		if !isLeader() {
+			continue
+		}
 
+		reaped, err := reapStaleIdentifiers(time.Now(), false)
 		if err != nil {
 			log.Printf("Error releasing stale identifiers: %v", err)
-		} else {
-			rowsAffected, _ := result.RowsAffected()
-			if rowsAffected > 0 {
-				log.Printf("Expired %d stale client(s) due to timeout (%s)", rowsAffected, config.Server.StaleTimeout)
+			continue
+		}
+		expired := 0
+		for _, e := range reaped {
+			if e.Type == EventReap {
+				expired++
 			}
 		}
+		if expired > 0 {
+			log.Printf("Expired %d stale client(s) due to their lease TTL", expired)
+		}
+	}
+}
+
+// reapStaleIdentifiers releases every lease whose last liveness probe is older than its TTL
+// and publishes a reap event for each one. Unless force is set, it holds them all back
+// while more than the maximum reap fraction of the held leases are stale.
+func reapStaleIdentifiers(now time.Time, force bool) ([]Event, error) {
+	if cluster != nil {
+		return cluster.reapStaleIdentifiers(now, force)
+	}
+
+	// Buffered probes may keep leases alive that look stale in the database
+	if heartbeats != nil {
+		if err := heartbeats.flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return commitEvents(func(tx *sql.Tx) ([]Event, error) {
+		return reapStaleIdentifiersTx(tx, now, force)
+	})
+}
+
+// reapStaleIdentifiersTx does the work of reapStaleIdentifiers inside a transaction, and
+// returns the events to publish once it commits
+func reapStaleIdentifiersTx(q queryer, now time.Time, force bool) ([]Event, error) {
+	if err := extendLeasesAfterDowntime(q, now); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`
+		SELECT identifier, pool, locked_by
+		FROM identifiers
+		WHERE `+staleLease,
+		staleLeaseArgs(now)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var reaped []Event
+	for rows.Next() {
+		e := Event{Type: EventReap, Time: now}
+		if err := rows.Scan(&e.Identifier, &e.Pool, &e.ClientID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		reaped = append(reaped, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var held int
+	if err := q.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE locked_by IS NOT NULL`).Scan(&held); err != nil {
+		return nil, err
+	}
+	paused, alerts, err := guardReap(q, len(reaped), held, force, now)
+	if err != nil || paused {
+		return alerts, err
+	}
+
+	_, err = q.Exec(`
+		UPDATE identifiers
+		SET released_by = locked_by, locked_by = NULL, last_seen = NULL, released_at = ?, metadata = NULL, ttl = NULL
+		WHERE `+staleLease,
+		append([]interface{}{now}, staleLeaseArgs(now)...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return reaped, nil
+}
+
+// reapClientIdentifiers releases the given identifiers if the client still holds them, and
+// publishes a reap event for each one. It is used when a streaming lease is not resumed in time.
+func reapClientIdentifiers(clientID string, identifiers []string, now time.Time) ([]Event, error) {
+	if len(identifiers) == 0 {
+		return nil, nil
+	}
+	if cluster != nil {
+		return cluster.reapClientIdentifiers(clientID, identifiers, now)
+	}
+
+	return commitEvents(func(tx *sql.Tx) ([]Event, error) {
+		return reapClientIdentifiersTx(tx, clientID, identifiers, now)
+	})
+}
+
+// reapClientIdentifiersTx releases the client's given identifiers and returns the reap events
+// to publish
+func reapClientIdentifiersTx(q queryer, clientID string, identifiers []string, now time.Time) ([]Event, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(identifiers)), ", ")
+	args := []interface{}{now, clientID}
+	for _, identifier := range identifiers {
+		args = append(args, identifier)
+	}
+
+	rows, err := q.Query(`
+		UPDATE identifiers
+		SET released_by = locked_by, locked_by = NULL, last_seen = NULL, released_at = ?, metadata = NULL, ttl = NULL
+		WHERE locked_by = ? AND identifier IN (`+placeholders+`)
+		RETURNING identifier, pool`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var reaped []Event
+	for rows.Next() {
+		e := Event{Type: EventReap, Time: now, ClientID: clientID}
+		if err := rows.Scan(&e.Identifier, &e.Pool); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		reaped = append(reaped, e)
+	}
+	rows.Close()
+	return reaped, rows.Err()
+}
+
+// ensureColumn adds a column to an existing table if an older schema lacks it
+func ensureColumn(table, column, definition string) error {
+	exists, err := hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
+// hasColumn reports whether a table has a column. It reports false if the table does not exist.
+func hasColumn(table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, columnType string
+		var notNull int
+		var defaultValue sql.NullString
+		var pk int
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
 	}
+	return false, rows.Err()
 }
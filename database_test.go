@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSQLiteSettingsApplied(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+
+	var journalMode string
+	var busyTimeout, synchronous int
+	db.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode)
+	db.QueryRow(`PRAGMA busy_timeout`).Scan(&busyTimeout)
+	db.QueryRow(`PRAGMA synchronous`).Scan(&synchronous)
+
+	// synchronous NORMAL is 1
+	if journalMode != "wal" || busyTimeout != 5000 || synchronous != 1 {
+		t.Errorf("journal_mode %s, busy_timeout %d, synchronous %d; want wal, 5000, 1", journalMode, busyTimeout, synchronous)
+	}
+	if open := db.Stats().MaxOpenConnections; open != 1 {
+		t.Errorf("max open connections %d, want 1", open)
+	}
+}
+
+// BenchmarkConcurrentLiveness sends liveness probes from many clients at once, mixed with
+// lease lookups, against the original connection settings and the configured defaults.
+// Failed operations are reported as errors/op.
+func BenchmarkConcurrentLiveness(b *testing.B) {
+	const clients = 64
+
+	settings := []struct {
+		name string
+		open func() (*sql.DB, error)
+	}{
+		{"untuned", func() (*sql.DB, error) {
+			// How initDB opened the database before the settings existed, with the
+			// rollback journal a new database file starts with
+			conn, err := sql.Open("sqlite3", config.Database.Datasource)
+			if err != nil {
+				return nil, err
+			}
+			_, err = conn.Exec(`PRAGMA journal_mode = DELETE`)
+			return conn, err
+		}},
+		{"defaults", func() (*sql.DB, error) {
+			return openDatabase(config.Database)
+		}},
+	}
+
+	for _, s := range settings {
+		b.Run(s.name, func(b *testing.B) {
+			setupTestDB(b, StrategyLowestFirst, fmt.Sprintf("vm-[1-%d]", clients))
+			for i := 1; i <= clients; i++ {
+				if _, err := allocateNextIdentifier(db, DefaultPool, fmt.Sprintf("client-%d", i), 0, nil, time.Now()); err != nil {
+					b.Fatalf("allocate: %v", err)
+				}
+			}
+
+			db.Close()
+			var err error
+			if db, err = s.open(); err != nil {
+				b.Fatalf("open: %v", err)
+			}
+
+			var next, failures atomic.Int64
+			b.SetParallelism(clients / 4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				n := next.Add(1)%clients + 1
+				probe := LivenessRequest{ClientID: fmt.Sprintf("client-%d", n), Identifier: fmt.Sprintf("vm-%d", n)}
+				for i := 0; pb.Next(); i++ {
+					var err error
+					switch i % 4 {
+					case 0, 1:
+						_, err = heartbeat(probe, time.Now())
+					case 2:
+						// Probes without an identifier read and update in one transaction
+						_, err = heartbeat(LivenessRequest{ClientID: probe.ClientID}, time.Now())
+					case 3:
+						_, err = clientLeases(probe.ClientID)
+					}
+					if err != nil {
+						failures.Add(1)
+					}
+				}
+			})
+			b.ReportMetric(float64(failures.Load())/float64(b.N), "errors/op")
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType names a lease lifecycle event
+type EventType string
+
+const (
+	EventAllocate      EventType = "allocate"
+	EventRelease       EventType = "release"
+	EventReap          EventType = "reap"
+	EventHeartbeatLost EventType = "heartbeat_lost"
+	EventConflict      EventType = "conflict"
+	EventReapPaused    EventType = "reap_paused"
+	EventPoolLow       EventType = "pool_low"
+	EventPoolExhausted EventType = "pool_exhausted"
+	EventPoolGrown     EventType = "pool_grown"
+	EventPoolShrunk    EventType = "pool_shrunk"
+)
+
+// eventTypes lists every event type, for checking names given in the configuration
+var eventTypes = []EventType{
+	EventAllocate, EventRelease, EventReap, EventHeartbeatLost, EventConflict,
+	EventReapPaused, EventPoolLow, EventPoolExhausted, EventPoolGrown, EventPoolShrunk,
+}
+
+// known reports whether t is one of the event types the registry emits
+func (t EventType) known() bool {
+	for _, known := range eventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Event describes a change to a lease. For conflicts Owner is the client that holds the
+// identifier; for heartbeat_lost it is the client that took the identifier over. reap_paused
+// alerts that the reaper is holding back Count stale leases, pool_low and pool_exhausted that
+// Pool has Count identifiers left, and pool_grown and pool_shrunk that Pool gained or lost
+// Count identifiers; they name no client.
+type Event struct {
+	ID         uint64    `json:"id"`
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	Pool       string    `json:"pool,omitempty"`
+	ClientID   string    `json:"client_id"`
+	Identifier string    `json:"identifier"`
+	Owner      string    `json:"owner,omitempty"`
+	Count      int       `json:"count,omitempty"`
+}
+
+// EventFilter selects the events a watcher is interested in. Empty fields match everything.
+type EventFilter struct {
+	Pool     string
+	ClientID string
+	Types    map[EventType]bool
+}
+
+// parseEventTypes parses a comma-separated list of event types
+func parseEventTypes(raw string) map[EventType]bool {
+	if raw == "" {
+		return nil
+	}
+	types := make(map[EventType]bool)
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[EventType(t)] = true
+		}
+	}
+	return types
+}
+
+// Matches reports whether the event passes the filter
+func (f EventFilter) Matches(e Event) bool {
+	if f.Pool != "" && e.Pool != f.Pool {
+		return false
+	}
+	if f.ClientID != "" && e.ClientID != f.ClientID {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types[e.Type] {
+		return false
+	}
+	return true
+}
+
+// eventBus keeps a bounded history of recent events and wakes up watchers when new ones arrive
+type eventBus struct {
+	mu     sync.Mutex
+	lastID uint64
+	// nextID is the last ID handed out. IDs between lastID and nextID belong to staged
+	// events whose transaction has not finished yet, or to events waiting behind them.
+	nextID    uint64
+	staged    map[uint64]bool
+	ready     []Event
+	history   []Event
+	size      int
+	changed   chan struct{}
+	listeners []func([]Event)
+}
+
+// EventHistorySize is the number of events kept for watchers resuming from a cursor
+const EventHistorySize = 4096
+
+var events = newEventBus(EventHistorySize)
+
+// newEventBus creates a bus retaining up to size events. Event IDs start from the current time
+// in milliseconds times 1000, so cursors from before a restart are recognised as expired.
+func newEventBus(size int) *eventBus {
+	start := uint64(time.Now().UnixMilli()) * 1000
+	return &eventBus{
+		lastID:  start,
+		nextID:  start,
+		staged:  make(map[uint64]bool),
+		size:    size,
+		changed: make(chan struct{}),
+	}
+}
+
+// subscribe registers a function that is called synchronously with every published batch
+func (b *eventBus) subscribe(listener func([]Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, listener)
+}
+
+// stamp gives events their IDs and, if unset, their time. The caller must publish or
+// discard the stamped events; until then watchers see no event with a later ID.
+func (b *eventBus) stamp(batch []Event) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	stamped := make([]Event, 0, len(batch))
+	for _, e := range batch {
+		b.nextID++
+		e.ID = b.nextID
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		b.staged[e.ID] = true
+		stamped = append(stamped, e)
+	}
+	return stamped
+}
+
+// stage stamps the events of a change made in transaction q and queues their webhook
+// deliveries in q, so that the deliveries are stored if and only if the change commits.
+// With local replicas the events are recorded in q for the other replicas as well.
+func (b *eventBus) stage(q queryer, batch []Event) ([]Event, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	stamped := b.stamp(batch)
+	if err := enqueueWebhookEvents(q, stamped, 0); err != nil {
+		b.discard(stamped)
+		return nil, err
+	}
+	if leadership != nil {
+		if err := recordReplicaEvents(q, leadership.nodeID, stamped); err != nil {
+			b.discard(stamped)
+			return nil, err
+		}
+	}
+	return stamped, nil
+}
+
+// publish records events, wakes every waiting watcher and hands the events to subscribers.
+// Events that were not staged are stamped first; staged events that were already published
+// or discarded are ignored.
+func (b *eventBus) publish(batch ...Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	for _, e := range batch {
+		if e.ID == 0 {
+			b.nextID++
+			e.ID = b.nextID
+			if e.Time.IsZero() {
+				e.Time = now
+			}
+		} else if !b.staged[e.ID] {
+			continue
+		}
+		delete(b.staged, e.ID)
+		b.ready = append(b.ready, e)
+	}
+	b.release()
+}
+
+// discard drops staged events whose transaction did not commit. It does nothing for events
+// that were already published, so it can be deferred right after staging.
+func (b *eventBus) discard(batch []Event) {
+	b.mu.Lock()
+	for _, e := range batch {
+		delete(b.staged, e.ID)
+	}
+	b.release()
+}
+
+// release moves the ready events that no staged event precedes into the history, then
+// unlocks the bus and notifies watchers and subscribers. It is called with b.mu held.
+func (b *eventBus) release() {
+	settled := b.nextID
+	for id := range b.staged {
+		if id <= settled {
+			settled = id - 1
+		}
+	}
+	if settled == b.lastID {
+		b.mu.Unlock()
+		return
+	}
+
+	sort.Slice(b.ready, func(i, j int) bool { return b.ready[i].ID < b.ready[j].ID })
+	n := sort.Search(len(b.ready), func(i int) bool { return b.ready[i].ID > settled })
+	released := append([]Event(nil), b.ready[:n]...)
+	b.ready = append(b.ready[:0:0], b.ready[n:]...)
+	b.lastID = settled
+
+	b.history = append(b.history, released...)
+	if over := len(b.history) - b.size; over > 0 {
+		b.history = append([]Event(nil), b.history[over:]...)
+	}
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+	listeners := b.listeners
+
+	b.mu.Unlock()
+
+	if len(released) == 0 {
+		return
+	}
+	for _, listener := range listeners {
+		listener(released)
+	}
+}
+
+// commitEvents runs change in a transaction together with the webhook deliveries of the events
+// it returns, and publishes the events once the transaction commits
+func commitEvents(change func(tx *sql.Tx) ([]Event, error)) ([]Event, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	batch, err := change(tx)
+	if err != nil {
+		return nil, err
+	}
+	staged, err := events.stage(tx, batch)
+	if err != nil {
+		return nil, err
+	}
+	defer events.discard(staged)
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	events.publish(staged...)
+	return staged, nil
+}
+
+// since returns the events after cursor that match filter, along with a channel that is closed
+// when the next event is published and the cursor to resume from. ok is false if events after
+// the cursor have already been dropped from the history, or the cursor is from a previous run.
+func (b *eventBus) since(cursor uint64, filter EventFilter) (matched []Event, changed <-chan struct{}, next uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if cursor == 0 {
+		// No cursor: start from now
+		return nil, b.changed, b.lastID, true
+	}
+	oldest := b.lastID + 1
+	if len(b.history) > 0 {
+		oldest = b.history[0].ID
+	}
+	if cursor > b.lastID || cursor < oldest-1 {
+		return nil, b.changed, b.lastID, false
+	}
+
+	for _, e := range b.history {
+		if e.ID > cursor && filter.Matches(e) {
+			matched = append(matched, e)
+		}
+	}
+	return matched, b.changed, b.lastID, true
+}
+
+// livenessEvents returns the events implied by the outcome of a liveness probe
+func livenessEvents(req LivenessRequest, result livenessResult) []Event {
+	switch result.Status {
+	case LivenessConflict:
+		return []Event{{Type: EventConflict, Pool: result.Pool, ClientID: req.ClientID, Identifier: req.Identifier, Owner: result.Owner}}
+	case LivenessReassociated:
+		if result.Owner == req.ClientID {
+			return nil
+		}
+		var batch []Event
+		if result.Owner != "" {
+			// The previous owner stopped heartbeating and has lost the identifier
+			batch = append(batch, Event{Type: EventHeartbeatLost, Pool: result.Pool, ClientID: result.Owner, Identifier: req.Identifier, Owner: req.ClientID})
+		}
+		return append(batch, Event{Type: EventAllocate, Pool: result.Pool, ClientID: req.ClientID, Identifier: req.Identifier})
+	}
+	return nil
+}
+
+// errLeaseWatchBehind means that events a lease loss watcher should have seen were dropped from
+// the history, so the client may have lost an identifier without being told
+var errLeaseWatchBehind = errors.New("lease events were missed; check the leases again")
+
+// watchLeaseLoss calls notify for every identifier the client loses to the reaper or to a
+// takeover after cursor. It returns nil once ctx is done, notify's error if it fails, or
+// errLeaseWatchBehind if it falls behind the event history.
+func watchLeaseLoss(ctx context.Context, clientID string, cursor uint64, notify func(Event) error) error {
+	filter := EventFilter{
+		ClientID: clientID,
+		Types:    map[EventType]bool{EventReap: true, EventHeartbeatLost: true},
+	}
+
+	for {
+		matched, changed, next, ok := events.since(cursor, filter)
+		if !ok {
+			log.Printf("Lease loss watcher for client %s fell behind the event history", clientID)
+			return errLeaseWatchBehind
+		}
+		for _, e := range matched {
+			if err := notify(e); err != nil {
+				return err
+			}
+		}
+		cursor = next
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestEventBusResumesFromCursor(t *testing.T) {
+	bus := newEventBus(3)
+
+	_, changed, start, ok := bus.since(0, EventFilter{})
+	if !ok {
+		t.Fatal("fresh bus rejected an empty cursor")
+	}
+
+	bus.publish(
+		Event{Type: EventAllocate, Pool: "default", ClientID: "a", Identifier: "vm-1"},
+		Event{Type: EventAllocate, Pool: "gpu", ClientID: "b", Identifier: "gpu-1"},
+	)
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("publish did not wake watchers")
+	}
+
+	matched, _, next, ok := bus.since(start, EventFilter{Pool: "gpu"})
+	if !ok || len(matched) != 1 || matched[0].ClientID != "b" || next != start+2 {
+		t.Fatalf("since(start, pool=gpu) = %v, %d, %v", matched, next, ok)
+	}
+
+	// Overflowing the history expires cursors that point before the oldest retained event
+	bus.publish(
+		Event{Type: EventRelease, ClientID: "a", Identifier: "vm-1"},
+		Event{Type: EventReap, ClientID: "b", Identifier: "gpu-1"},
+	)
+	if _, _, _, ok := bus.since(start, EventFilter{}); ok {
+		t.Fatal("cursor older than the history was accepted")
+	}
+	matched, _, _, ok = bus.since(start+1, EventFilter{Types: parseEventTypes("reap")})
+	if !ok || len(matched) != 1 || matched[0].Type != EventReap {
+		t.Fatalf("since(start+1, types=reap) = %v, %v", matched, ok)
+	}
+
+	// Cursors from another run of the registry are rejected
+	if _, _, _, ok := bus.since(next+100, EventFilter{}); ok {
+		t.Fatal("cursor from the future was accepted")
+	}
+}
+
+func TestLivenessEventsForTakeover(t *testing.T) {
+	req := LivenessRequest{ClientID: "new", Identifier: "vm-1"}
+
+	got := livenessEvents(req, livenessResult{Status: LivenessReassociated, Owner: "old", Pool: "default"})
+	if len(got) != 2 || got[0].Type != EventHeartbeatLost || got[0].ClientID != "old" || got[1].Type != EventAllocate {
+		t.Fatalf("takeover events = %+v", got)
+	}
+
+	if got := livenessEvents(req, livenessResult{Status: LivenessOK, Owner: "new"}); len(got) != 0 {
+		t.Fatalf("ok probe produced events %+v", got)
+	}
+}
+
+func TestStagedEventsHoldBackWatchers(t *testing.T) {
+	bus := newEventBus(16)
+	_, _, start, _ := bus.since(0, EventFilter{})
+
+	first := bus.stamp([]Event{{Type: EventAllocate, ClientID: "a", Identifier: "vm-1"}})
+	second := bus.stamp([]Event{{Type: EventAllocate, ClientID: "b", Identifier: "vm-2"}})
+
+	// The later transaction commits first; watchers must not skip past the earlier one
+	bus.publish(second...)
+	if matched, _, next, _ := bus.since(start, EventFilter{}); len(matched) != 0 || next != start {
+		t.Fatalf("since(start) before the first event settled = %v, %d", matched, next)
+	}
+
+	bus.publish(first...)
+	matched, _, next, ok := bus.since(start, EventFilter{})
+	if !ok || len(matched) != 2 || matched[0].ClientID != "a" || matched[1].ClientID != "b" || next != start+2 {
+		t.Fatalf("since(start) = %v, %d, %v", matched, next, ok)
+	}
+
+	// A rolled back event leaves a gap, and publishing it afterwards does nothing
+	dropped := bus.stamp([]Event{{Type: EventRelease, ClientID: "a", Identifier: "vm-1"}})
+	bus.publish(Event{Type: EventRelease, ClientID: "b", Identifier: "vm-2"})
+	bus.discard(dropped)
+	bus.publish(dropped...)
+	matched, _, _, _ = bus.since(next, EventFilter{})
+	if len(matched) != 1 || matched[0].ClientID != "b" {
+		t.Fatalf("since(next) after a discard = %v", matched)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Import modes. Merge leaves identifiers missing from the file untouched; replace deletes them.
+const (
+	ImportMerge   = "merge"
+	ImportReplace = "replace"
+)
+
+// exportColumns is the header row of a CSV export. Exports taken by earlier versions lack the
+// columns after metadata, and can still be imported.
+var exportColumns = []string{"identifier", "pool", "locked_by", "last_seen", "released_at", "metadata", "ttl_seconds", "released_by"}
+
+// legacyExportColumns is the number of columns of the oldest CSV exports
+const legacyExportColumns = 6
+
+// ExportRecord is one identifier with its allocation state, as exported and imported
+type ExportRecord struct {
+	Identifier string     `json:"identifier"`
+	Pool       string     `json:"pool"`
+	LockedBy   string     `json:"locked_by,omitempty"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+	Metadata   Metadata   `json:"metadata,omitempty"`
+	// TTLSeconds is the lease TTL, or 0 for the stale timeout
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+	// ReleasedBy is the client that last held a free identifier, the only one that may
+	// reclaim it during its reuse cooldown
+	ReleasedBy string `json:"released_by,omitempty"`
+}
+
+// equal reports whether importing r over other would change nothing
+func (r ExportRecord) equal(other ExportRecord) bool {
+	if r.Identifier != other.Identifier || r.Pool != other.Pool || r.LockedBy != other.LockedBy || r.TTLSeconds != other.TTLSeconds || r.ReleasedBy != other.ReleasedBy {
+		return false
+	}
+	if !equalTimes(r.LastSeen, other.LastSeen) || !equalTimes(r.ReleasedAt, other.ReleasedAt) {
+		return false
+	}
+	if len(r.Metadata) != len(other.Metadata) {
+		return false
+	}
+	for k, v := range r.Metadata {
+		if other.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func equalTimes(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// validExportFormat reports whether format is one of the export formats
+func validExportFormat(format string) bool {
+	return format == FormatCSV || format == FormatNDJSON
+}
+
+// loadExportRecords reads every identifier in natural order
+func loadExportRecords(q queryer) ([]ExportRecord, error) {
+	rows, err := q.Query(`
+		SELECT identifier, pool, locked_by, last_seen, released_at, metadata, COALESCE(ttl, 0), COALESCE(released_by, '')
+		FROM identifiers
+		ORDER BY sort_key, identifier`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ExportRecord
+	for rows.Next() {
+		var r ExportRecord
+		var lockedBy, metadata sql.NullString
+		var lastSeen, releasedAt sql.NullTime
+		if err := rows.Scan(&r.Identifier, &r.Pool, &lockedBy, &lastSeen, &releasedAt, &metadata, &r.TTLSeconds, &r.ReleasedBy); err != nil {
+			return nil, err
+		}
+		r.LockedBy = lockedBy.String
+		if lastSeen.Valid {
+			r.LastSeen = &lastSeen.Time
+		}
+		if releasedAt.Valid {
+			r.ReleasedAt = &releasedAt.Time
+		}
+		r.Metadata = parseMetadata(metadata)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// writeExport writes records in the given format
+func writeExport(w io.Writer, format string, records []ExportRecord) error {
+	switch format {
+	case FormatNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, r := range records {
+			if err := encoder.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportColumns); err != nil {
+			return err
+		}
+		for _, r := range records {
+			metadata := ""
+			if len(r.Metadata) > 0 {
+				encoded, err := json.Marshal(r.Metadata)
+				if err != nil {
+					return err
+				}
+				metadata = string(encoded)
+			}
+			ttl := ""
+			if r.TTLSeconds > 0 {
+				ttl = strconv.Itoa(r.TTLSeconds)
+			}
+			row := []string{r.Identifier, r.Pool, r.LockedBy, formatExportTime(r.LastSeen), formatExportTime(r.ReleasedAt), metadata, ttl, r.ReleasedBy}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+func formatExportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseExportTime(raw string) (*time.Time, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// readExport parses an export in the given format
+func readExport(r io.Reader, format string) ([]ExportRecord, error) {
+	var records []ExportRecord
+	switch format {
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var record ExportRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			records = append(records, record)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+	case FormatCSV:
+		// Every row must have as many fields as the header
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("read header: %v", err)
+		}
+		columns := strings.Join(header, ",")
+		if len(header) < legacyExportColumns || len(header) > len(exportColumns) || columns != strings.Join(exportColumns[:len(header)], ",") {
+			return nil, fmt.Errorf("unexpected header %q", columns)
+		}
+		for line := 2; ; line++ {
+			row, err := cr.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			record := ExportRecord{Identifier: row[0], Pool: row[1], LockedBy: row[2]}
+			if record.LastSeen, err = parseExportTime(row[3]); err != nil {
+				return nil, fmt.Errorf("line %d: last_seen: %v", line, err)
+			}
+			if record.ReleasedAt, err = parseExportTime(row[4]); err != nil {
+				return nil, fmt.Errorf("line %d: released_at: %v", line, err)
+			}
+			if row[5] != "" {
+				if err := json.Unmarshal([]byte(row[5]), &record.Metadata); err != nil {
+					return nil, fmt.Errorf("line %d: metadata: %v", line, err)
+				}
+			}
+			if len(row) > 6 && row[6] != "" {
+				if record.TTLSeconds, err = strconv.Atoi(row[6]); err != nil {
+					return nil, fmt.Errorf("line %d: ttl_seconds: %v", line, err)
+				}
+			}
+			if len(row) > 7 {
+				record.ReleasedBy = row[7]
+			}
+			records = append(records, record)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	seen := make(map[string]bool, len(records))
+	for i, record := range records {
+		switch {
+		case record.Identifier == "":
+			return nil, fmt.Errorf("record %d: identifier is required", i+1)
+		case seen[record.Identifier]:
+			return nil, fmt.Errorf("record %d: duplicate identifier %s", i+1, record.Identifier)
+		case record.LockedBy != "" && record.LastSeen == nil:
+			return nil, fmt.Errorf("record %d: allocated identifier %s has no last_seen", i+1, record.Identifier)
+		case record.TTLSeconds < 0:
+			return nil, fmt.Errorf("record %d: ttl_seconds of %s is negative", i+1, record.Identifier)
+		}
+		if err := validateMetadata(record.Metadata); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i+1, err)
+		}
+		if records[i].Pool == "" {
+			records[i].Pool = DefaultPool
+		}
+		seen[record.Identifier] = true
+	}
+	return records, nil
+}
+
+// importChange is one difference between the identifier table and an import
+type importChange struct {
+	// Before is nil for an added identifier, After is nil for a removed one
+	Before *ExportRecord
+	After  *ExportRecord
+}
+
+// String describes the change as a line of a diff
+func (c importChange) String() string {
+	switch {
+	case c.Before == nil:
+		return "+ " + describeExportRecord(*c.After)
+	case c.After == nil:
+		return "- " + describeExportRecord(*c.Before)
+	default:
+		return fmt.Sprintf("~ %s -> %s", describeExportRecord(*c.Before), describeExportRecord(*c.After))
+	}
+}
+
+func describeExportRecord(r ExportRecord) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s pool=%s", r.Identifier, r.Pool)
+	if r.LockedBy != "" {
+		fmt.Fprintf(&b, " locked_by=%s last_seen=%s", r.LockedBy, formatExportTime(r.LastSeen))
+		if r.TTLSeconds > 0 {
+			fmt.Fprintf(&b, " ttl=%ds", r.TTLSeconds)
+		}
+	}
+	if r.ReleasedAt != nil {
+		fmt.Fprintf(&b, " released_at=%s", formatExportTime(r.ReleasedAt))
+	}
+	if r.ReleasedBy != "" {
+		fmt.Fprintf(&b, " released_by=%s", r.ReleasedBy)
+	}
+	if len(r.Metadata) > 0 {
+		encoded, _ := json.Marshal(r.Metadata)
+		fmt.Fprintf(&b, " metadata=%s", encoded)
+	}
+	return b.String()
+}
+
+// events returns the events implied by the change of owner, if any: the previous owner loses
+// the identifier to the reaper, or to the new owner, who is allocated it
+func (c importChange) events() []Event {
+	var before, after string
+	if c.Before != nil {
+		before = c.Before.LockedBy
+	}
+	if c.After != nil {
+		after = c.After.LockedBy
+	}
+	if before == after {
+		return nil
+	}
+
+	var batch []Event
+	switch {
+	case before != "" && after != "":
+		batch = append(batch, Event{Type: EventHeartbeatLost, Pool: c.Before.Pool, ClientID: before, Identifier: c.Before.Identifier, Owner: after})
+	case before != "":
+		batch = append(batch, Event{Type: EventReap, Pool: c.Before.Pool, ClientID: before, Identifier: c.Before.Identifier})
+	}
+	if after != "" {
+		batch = append(batch, Event{Type: EventAllocate, Pool: c.After.Pool, ClientID: after, Identifier: c.After.Identifier})
+	}
+	return batch
+}
+
+// planImport compares records with the identifier table and returns the changes importing
+// them would make, in the order of the file followed by any removals. Records of pools that
+// are not configured are rejected with errUnknownPool.
+func planImport(records []ExportRecord, mode string) ([]importChange, error) {
+	if mode != ImportMerge && mode != ImportReplace {
+		return nil, fmt.Errorf("unknown import mode %q", mode)
+	}
+	for _, record := range records {
+		if _, ok := config.Identifiers.Pool(record.Pool); !ok {
+			return nil, fmt.Errorf("%s: %w %s", record.Identifier, errUnknownPool, record.Pool)
+		}
+	}
+
+	current, err := loadExportRecords(db)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*ExportRecord, len(current))
+	for i := range current {
+		existing[current[i].Identifier] = &current[i]
+	}
+
+	var changes []importChange
+	imported := make(map[string]bool, len(records))
+	for i := range records {
+		after := &records[i]
+		imported[after.Identifier] = true
+		before := existing[after.Identifier]
+		if before != nil && before.equal(*after) {
+			continue
+		}
+		changes = append(changes, importChange{Before: before, After: after})
+	}
+
+	if mode == ImportReplace {
+		for i := range current {
+			if !imported[current[i].Identifier] {
+				changes = append(changes, importChange{Before: &current[i]})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// applyImport makes the planned changes in a single transaction, and publishes the events of
+// every identifier whose owner they change
+func applyImport(changes []importChange) error {
+	_, err := commitEvents(func(tx *sql.Tx) ([]Event, error) {
+		var batch []Event
+		for _, c := range changes {
+			if c.After == nil {
+				if _, err := tx.Exec(`DELETE FROM identifiers WHERE identifier = ?`, c.Before.Identifier); err != nil {
+					return nil, err
+				}
+				batch = append(batch, c.events()...)
+				continue
+			}
+
+			r := c.After
+			var lockedBy, lastSeen, releasedAt, releasedBy interface{}
+			if r.LockedBy != "" {
+				lockedBy = r.LockedBy
+			}
+			if r.ReleasedBy != "" {
+				releasedBy = r.ReleasedBy
+			}
+			// Timestamps are stored in local time so that they compare correctly as text
+			if r.LastSeen != nil {
+				lastSeen = r.LastSeen.Local()
+			}
+			if r.ReleasedAt != nil {
+				releasedAt = r.ReleasedAt.Local()
+			}
+			_, err := tx.Exec(`
+				INSERT INTO identifiers (identifier, pool, locked_by, last_seen, released_at, metadata, ttl, released_by)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (identifier) DO UPDATE SET
+					pool = excluded.pool,
+					locked_by = excluded.locked_by,
+					last_seen = excluded.last_seen,
+					released_at = excluded.released_at,
+					metadata = excluded.metadata,
+					ttl = excluded.ttl,
+					released_by = excluded.released_by`,
+				r.Identifier, r.Pool, lockedBy, lastSeen, releasedAt, r.Metadata, ttlColumn(time.Duration(r.TTLSeconds)*time.Second), releasedBy,
+			)
+			if err != nil {
+				return nil, err
+			}
+			batch = append(batch, c.events()...)
+		}
+		return batch, assignSortKeysTx(tx)
+	})
+	return err
+}
+
+// exportHandler dumps the identifier table as CSV or NDJSON
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatNDJSON
+	}
+	if !validExportFormat(format) {
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	records, err := loadExportRecords(db)
+	if err != nil {
+		log.Printf("Error exporting identifiers: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if format == FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="identifiers.%s"`, format))
+	if err := writeExport(w, format, records); err != nil {
+		log.Printf("Error writing export: %v", err)
+	}
+}
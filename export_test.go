@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		t.Run(format, func(t *testing.T) {
+			setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+
+			now := time.Now().Truncate(time.Second)
+			if _, err := allocateIdentifiers(DefaultPool, "a", 1, 0, Metadata{"az": "us-east-1a", "note": `quoted "value", with comma`}, now); err != nil {
+				t.Fatalf("allocate: %v", err)
+			}
+			if _, err := allocateNextIdentifier(db, DefaultPool, "b", 0, nil, now); err != nil {
+				t.Fatalf("allocate: %v", err)
+			}
+			if _, err := releaseIdentifiers("b", "vm-2", now); err != nil {
+				t.Fatalf("release: %v", err)
+			}
+
+			before, err := loadExportRecords(db)
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			var dump bytes.Buffer
+			if err := writeExport(&dump, format, before); err != nil {
+				t.Fatalf("export: %v", err)
+			}
+
+			// Restoring into an empty table reproduces every row
+			if _, err := db.Exec(`DELETE FROM identifiers`); err != nil {
+				t.Fatalf("clear: %v", err)
+			}
+			records, err := readExport(bytes.NewReader(dump.Bytes()), format)
+			if err != nil {
+				t.Fatalf("read export: %v\n%s", err, dump.String())
+			}
+			changes, err := planImport(records, ImportMerge)
+			if err != nil {
+				t.Fatalf("plan: %v", err)
+			}
+			if len(changes) != 3 {
+				t.Fatalf("planned %d changes, want 3 additions", len(changes))
+			}
+			if err := applyImport(changes); err != nil {
+				t.Fatalf("import: %v", err)
+			}
+
+			after, err := loadExportRecords(db)
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if len(after) != len(before) {
+				t.Fatalf("restored %d identifiers, want %d", len(after), len(before))
+			}
+			for i := range before {
+				if !before[i].equal(after[i]) {
+					t.Errorf("restored %s, want %s", describeExportRecord(after[i]), describeExportRecord(before[i]))
+				}
+			}
+
+			// The restored lease is still live and owned
+			if owner := lockedBy(t, "vm-1"); owner != "a" {
+				t.Errorf("vm-1 held by %q after restore, want a", owner)
+			}
+			if changes, _ := planImport(records, ImportReplace); len(changes) != 0 {
+				t.Errorf("re-importing the same export plans %v, want no changes", changes)
+			}
+		})
+	}
+}
+
+func TestImportModes(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+
+	dump := `{"identifier":"vm-1","pool":"default","locked_by":"a","last_seen":"2026-01-02T03:04:05Z"}
+{"identifier":"vm-4","pool":"default"}
+`
+	records, err := readExport(strings.NewReader(dump), FormatNDJSON)
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+
+	merge, err := planImport(records, ImportMerge)
+	if err != nil {
+		t.Fatalf("plan merge: %v", err)
+	}
+	if got := changeSummary(merge); got != "~vm-1 +vm-4" {
+		t.Errorf("merge plans %q, want ~vm-1 +vm-4", got)
+	}
+
+	replace, err := planImport(records, ImportReplace)
+	if err != nil {
+		t.Fatalf("plan replace: %v", err)
+	}
+	if got := changeSummary(replace); got != "~vm-1 +vm-4 -vm-2 -vm-3" {
+		t.Errorf("replace plans %q, want ~vm-1 +vm-4 -vm-2 -vm-3", got)
+	}
+
+	// Planning is a dry run
+	if owner := lockedBy(t, "vm-1"); owner != "" {
+		t.Fatalf("vm-1 held by %q after planning", owner)
+	}
+
+	if err := applyImport(replace); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	current, _ := loadExportRecords(db)
+	if len(current) != 2 || current[0].Identifier != "vm-1" || current[0].LockedBy != "a" || current[1].Identifier != "vm-4" {
+		t.Errorf("after replace the table holds %+v", current)
+	}
+
+	if _, err := planImport(records, "append"); err == nil {
+		t.Error("planImport accepted an unknown mode")
+	}
+}
+
+func TestImportRejectsUnknownPools(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+
+	records, err := readExport(strings.NewReader(`{"identifier":"gpu-1","pool":"gpu"}`+"\n"), FormatNDJSON)
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+	if _, err := planImport(records, ImportMerge); !errors.Is(err, errUnknownPool) {
+		t.Fatalf("plan = %v, want errUnknownPool", err)
+	}
+}
+
+func TestImportPublishesOwnerChanges(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+	bus := useEventBus(t, 16)
+
+	now := time.Now()
+	mustAllocate(t, "a") // vm-1
+	mustAllocate(t, "b") // vm-2
+	_, _, cursor, _ := bus.since(0, EventFilter{})
+
+	dump := `{"identifier":"vm-1","pool":"default","locked_by":"c","last_seen":"` + now.UTC().Format(time.RFC3339) + `"}
+{"identifier":"vm-2","pool":"default"}
+{"identifier":"vm-3","pool":"default"}
+`
+	records, err := readExport(strings.NewReader(dump), FormatNDJSON)
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+	changes, err := planImport(records, ImportMerge)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if err := applyImport(changes); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	published, _, _, _ := bus.since(cursor, EventFilter{})
+	var got []string
+	for _, e := range published {
+		got = append(got, fmt.Sprintf("%s %s %s", e.Type, e.ClientID, e.Identifier))
+	}
+	want := "heartbeat_lost a vm-1, allocate c vm-1, reap b vm-2"
+	if strings.Join(got, ", ") != want {
+		t.Fatalf("import published %q, want %q", strings.Join(got, ", "), want)
+	}
+}
+
+func TestReadExportRejectsInvalidRecords(t *testing.T) {
+	tests := map[string]string{
+		"missing identifier":  `{"pool":"default"}`,
+		"duplicate":           "{\"identifier\":\"vm-1\"}\n{\"identifier\":\"vm-1\"}",
+		"lease without probe": `{"identifier":"vm-1","locked_by":"a"}`,
+		"bad metadata key":    `{"identifier":"vm-1","metadata":{"a=b":"c"}}`,
+		"not json":            `vm-1`,
+	}
+	for name, dump := range tests {
+		if _, err := readExport(strings.NewReader(dump), FormatNDJSON); err == nil {
+			t.Errorf("%s: readExport succeeded, want an error", name)
+		}
+	}
+
+	if _, err := readExport(strings.NewReader("identifier,pool\nvm-1,default\n"), FormatCSV); err == nil {
+		t.Error("readExport accepted a CSV export with the wrong columns")
+	}
+}
+
+func changeSummary(changes []importChange) string {
+	var parts []string
+	for _, c := range changes {
+		switch {
+		case c.Before == nil:
+			parts = append(parts, "+"+c.After.Identifier)
+		case c.After == nil:
+			parts = append(parts, "-"+c.Before.Identifier)
+		default:
+			parts = append(parts, "~"+c.After.Identifier)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestImportRefusedUnderRaft(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	config.Raft.Enabled = true
+
+	dump := filepath.Join(t.TempDir(), "identifiers.ndjson")
+	if err := os.WriteFile(dump, []byte(`{"identifier":"vm-1","pool":"default","locked_by":"a","last_seen":"2026-01-02T03:04:05Z"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := importCommand([]string{dump}, &stdout, &stderr); err != errRaftLocalChange {
+		t.Fatalf("import = %v, want %v", err, errRaftLocalChange)
+	}
+	if owner := lockedBy(t, "vm-1"); owner != "" {
+		t.Fatalf("vm-1 held by %q after a refused import", owner)
+	}
+
+	// A dry run changes nothing, so it is still allowed
+	if err := importCommand([]string{"-dry-run", dump}, &stdout, &stderr); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "vm-1") {
+		t.Errorf("dry run printed %q, want the change to vm-1", stdout.String())
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// PoolGrowth is one block of identifiers added to a pool beyond its patterns
+type PoolGrowth struct {
+	Pool    string    `json:"pool"`
+	Block   int       `json:"block"`
+	Size    int       `json:"size"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// initPoolGrowth creates the table that records the blocks each pool has grown by
+func initPoolGrowth() {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS pool_growth (
+		pool TEXT NOT NULL,
+		block INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		added_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (pool, block)
+	);`)
+	if err != nil {
+		log.Fatalf("Failed to create pool_growth table: %v", err)
+	}
+}
+
+// validatePoolGrowth checks that every growable pool has a block size, and that no identifier a
+// pool can grow by belongs to another pool or to its own patterns
+func validatePoolGrowth(pools []PoolConfig) error {
+	owner := make(map[string]string)
+	for _, pool := range pools {
+		for _, identifier := range ExpandIdentifiers(pool.Patterns) {
+			owner[identifier] = pool.Name
+		}
+	}
+
+	for _, pool := range pools {
+		if len(pool.Growth.Patterns) == 0 {
+			continue
+		}
+		if pool.Growth.BlockSize <= 0 {
+			return fmt.Errorf("identifier pool %q: growth.block_size must be positive", pool.Name)
+		}
+		for _, identifier := range ExpandIdentifiers(pool.Growth.Patterns) {
+			if other, ok := owner[identifier]; ok {
+				return fmt.Errorf("identifier pool %q: growth identifier %s already belongs to pool %q", pool.Name, identifier, other)
+			}
+			owner[identifier] = pool.Name
+		}
+	}
+	return nil
+}
+
+// poolGrowth returns the blocks each pool has grown by, by pool and in the order they were added
+func poolGrowth(q queryer) (map[string][]PoolGrowth, error) {
+	rows, err := q.Query(`SELECT pool, block, size, added_at FROM pool_growth ORDER BY pool, block`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	growth := make(map[string][]PoolGrowth)
+	for rows.Next() {
+		var g PoolGrowth
+		if err := rows.Scan(&g.Pool, &g.Block, &g.Size, &g.AddedAt); err != nil {
+			return nil, err
+		}
+		growth[g.Pool] = append(growth[g.Pool], g)
+	}
+	return growth, rows.Err()
+}
+
+// resizePools grows every growable pool that has run low by its next block, and shrinks a pool
+// by its last block once all of that block is free and the pool stays above its low watermark
+// without it
+func resizePools(now time.Time) error {
+	available, err := availableIdentifiers(now)
+	if err != nil {
+		return err
+	}
+	growth, err := poolGrowth(db)
+	if err != nil {
+		return err
+	}
+
+	for _, pool := range config.Identifiers.AllPools() {
+		blocks := pool.Growth.blocks()
+		added := len(growth[pool.Name])
+		if len(blocks) == 0 && added == 0 {
+			continue
+		}
+
+		if available[pool.Name] <= pool.LowWatermark {
+			if added >= len(blocks) {
+				continue
+			}
+			if err := resizePool(true, pool.Name, added+1, blocks[added], now); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if added == 0 {
+			continue
+		}
+		last := growth[pool.Name][added-1]
+		var block []string
+		if last.Block <= len(blocks) {
+			block = blocks[last.Block-1]
+		}
+		// Keep the block unless the pool can spare it
+		if available[pool.Name]-len(block) <= pool.LowWatermark {
+			continue
+		}
+		if err := resizePool(false, pool.Name, last.Block, block, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resizePool adds a block of identifiers to a pool, or removes it if all of its identifiers
+// are free, and publishes a pool_grown or pool_shrunk event
+func resizePool(grow bool, pool string, block int, identifiers []string, now time.Time) error {
+	if cluster != nil {
+		// Every node publishes the event when it applies the change
+		return cluster.resizePool(grow, pool, block, identifiers, now)
+	}
+
+	_, err := commitEvents(func(tx *sql.Tx) ([]Event, error) {
+		return resizePoolTx(tx, grow, pool, block, identifiers, now)
+	})
+	return err
+}
+
+// resizePoolTx adds or removes a block of a pool's identifiers and records the change. A block
+// is only removed if none of its identifiers are held or cooling down. It returns the event to
+// publish, if the pool changed.
+func resizePoolTx(q queryer, grow bool, pool string, block int, identifiers []string, now time.Time) ([]Event, error) {
+	if grow {
+		for _, identifier := range identifiers {
+			_, err := q.Exec(`
+				INSERT INTO identifiers (identifier, pool) VALUES (?, ?)
+				ON CONFLICT (identifier) DO UPDATE SET pool = excluded.pool`,
+				identifier, pool,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err := q.Exec(`INSERT OR REPLACE INTO pool_growth (pool, block, size, added_at) VALUES (?, ?, ?, ?)`,
+			pool, block, len(identifiers), now)
+		if err != nil {
+			return nil, err
+		}
+		if err := assignSortKeysTx(q); err != nil {
+			return nil, err
+		}
+
+		log.Printf("Pool %s grew by block %d: %d identifier(s)", pool, block, len(identifiers))
+		return []Event{{Type: EventPoolGrown, Time: now, Pool: pool, Count: len(identifiers)}}, nil
+	}
+
+	if len(identifiers) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(identifiers)), ", ")
+		args := []interface{}{pool, cooldownThreshold(now)}
+		for _, identifier := range identifiers {
+			args = append(args, identifier)
+		}
+
+		var busy int
+		err := q.QueryRow(`
+			SELECT COUNT(*) FROM identifiers
+			WHERE pool = ? AND (locked_by IS NOT NULL OR released_at > ?) AND identifier IN (`+placeholders+`)`,
+			args...,
+		).Scan(&busy)
+		if err != nil {
+			return nil, err
+		}
+		if busy > 0 {
+			return nil, nil
+		}
+
+		if _, err := q.Exec(`DELETE FROM identifiers WHERE pool = ? AND identifier IN (`+placeholders+`)`,
+			append(args[:1:1], args[2:]...)...); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := q.Exec(`DELETE FROM pool_growth WHERE pool = ? AND block = ?`, pool, block); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Pool %s shrank by block %d: %d identifier(s)", pool, block, len(identifiers))
+	return []Event{{Type: EventPoolShrunk, Time: now, Pool: pool, Count: len(identifiers)}}, nil
+}
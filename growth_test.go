@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func poolSize(t *testing.T) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE pool = ?`, DefaultPool).Scan(&n); err != nil {
+		t.Fatalf("count identifiers: %v", err)
+	}
+	return n
+}
+
+func TestPoolGrowsInBlocksAndShrinksWhenFree(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	config.Identifiers.Growth = GrowthConfig{Patterns: []string{"vm-[3-6]"}, BlockSize: 2}
+
+	resize := func() {
+		t.Helper()
+		if err := resizePools(time.Now()); err != nil {
+			t.Fatalf("resize: %v", err)
+		}
+	}
+
+	mustAllocate(t, "a")
+	mustAllocate(t, "b")
+	resize()
+	if n := poolSize(t); n != 4 {
+		t.Fatalf("pool has %d identifiers after growing, want 4", n)
+	}
+	if got := mustAllocate(t, "c"); got != "vm-3" {
+		t.Fatalf("c got %s, want vm-3 from the new block", got)
+	}
+	mustAllocate(t, "d")
+	resize()
+	mustAllocate(t, "e")
+	mustAllocate(t, "f")
+	resize()
+	if n := poolSize(t); n != 6 {
+		t.Fatalf("pool has %d identifiers at its upper bound, want 6", n)
+	}
+
+	growth, err := poolGrowth(db)
+	if err != nil {
+		t.Fatalf("pool growth: %v", err)
+	}
+	if blocks := growth[DefaultPool]; len(blocks) != 2 || blocks[1].Block != 2 || blocks[1].Size != 2 {
+		t.Fatalf("recorded growth %+v, want blocks 1 and 2", blocks)
+	}
+
+	// The last block stays while one of its identifiers is held
+	now := time.Now()
+	for _, client := range []string{"c", "d", "e"} {
+		if _, err := releaseIdentifiers(client, "", now); err != nil {
+			t.Fatalf("release %s: %v", client, err)
+		}
+	}
+	resize()
+	if n := poolSize(t); n != 6 {
+		t.Fatalf("pool has %d identifiers while vm-6 is held, want 6", n)
+	}
+
+	if _, err := releaseIdentifiers("f", "", now); err != nil {
+		t.Fatalf("release f: %v", err)
+	}
+	resize()
+	if n := poolSize(t); n != 4 {
+		t.Fatalf("pool has %d identifiers after shrinking, want 4", n)
+	}
+
+	// Without the first block the pool would have nothing to spare
+	resize()
+	if n := poolSize(t); n != 4 {
+		t.Fatalf("pool has %d identifiers, want 4", n)
+	}
+	if _, err := releaseIdentifiers("a", "", now); err != nil {
+		t.Fatalf("release a: %v", err)
+	}
+	resize()
+	if n := poolSize(t); n != 2 {
+		t.Fatalf("pool has %d identifiers back at its base size, want 2", n)
+	}
+}
+
+func TestValidatePoolGrowth(t *testing.T) {
+	pools := []PoolConfig{
+		{Name: "a", Patterns: []string{"vm-[1-4]"}, Growth: GrowthConfig{Patterns: []string{"vm-[5-8]"}, BlockSize: 2}},
+		{Name: "b", Patterns: []string{"vm-[7-9]"}},
+	}
+	if err := validatePoolGrowth(pools); err == nil {
+		t.Fatal("growth overlapping another pool was accepted")
+	}
+
+	pools[1].Patterns = []string{"vm-[9-10]"}
+	if err := validatePoolGrowth(pools); err != nil {
+		t.Fatalf("valid growth rejected: %v", err)
+	}
+
+	pools[0].Growth.BlockSize = 0
+	if err := validatePoolGrowth(pools); err == nil {
+		t.Fatal("growth without a block size was accepted")
+	}
+}
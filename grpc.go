@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liftedkilt/ci-registry/registrypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// registryServer implements the gRPC Registry service on top of the same operations as the HTTP handlers
+type registryServer struct {
+	registrypb.UnimplementedRegistryServer
+}
+
+// startGRPCServer serves the gRPC API on its own port, if one is configured
+func startGRPCServer() {
+	if config.Server.GRPCAddress == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", config.Server.GRPCAddress)
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC: %v", err)
+	}
+
+	server := newGRPCServer()
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Fatalf("gRPC server failed: %v", err)
+		}
+	}()
+
+	log.Printf("gRPC server started on %s", config.Server.GRPCAddress)
+}
+
+func newGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	registrypb.RegisterRegistryServer(server, &registryServer{})
+	return server
+}
+
+// grpcError maps the errors of the shared operations to gRPC status codes
+func grpcError(err error) error {
+	var invalid requestError
+	switch {
+	case errors.As(err, &invalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case err == errUnknownPool:
+		return status.Error(codes.NotFound, "unknown pool")
+	case err == sql.ErrNoRows:
+		return status.Error(codes.ResourceExhausted, "no available identifiers")
+	default:
+		return status.Error(codes.Internal, "internal server error")
+	}
+}
+
+var livenessStatuses = map[LivenessStatus]registrypb.HeartbeatResponse_Status{
+	LivenessOK:           registrypb.HeartbeatResponse_OK,
+	LivenessReassociated: registrypb.HeartbeatResponse_REASSOCIATED,
+	LivenessConflict:     registrypb.HeartbeatResponse_CONFLICT,
+	LivenessNotFound:     registrypb.HeartbeatResponse_NOT_FOUND,
+	LivenessInvalid:      registrypb.HeartbeatResponse_INVALID,
+}
+
+// Allocate allocates like /allocate, including waiting for identifiers or joining the
+// waitlist when the pool is exhausted. A queued client gets its waitlist_position instead
+// of identifiers.
+func (s *registryServer) Allocate(ctx context.Context, req *registrypb.AllocateRequest) (*registrypb.AllocateResponse, error) {
+	allocation := AllocateRequest{
+		ClientID:   req.ClientId,
+		Pool:       req.Pool,
+		Count:      int(req.Count),
+		Metadata:   Metadata(req.Metadata),
+		TTLSeconds: int(req.TtlSeconds),
+		Wait:       req.Wait,
+		Waitlist:   req.Waitlist,
+	}
+	wait, err := allocationWait(allocation)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	identifiers, allocatedAt, position, err := allocateOrWait(ctx, allocation, wait, req.Waitlist, time.Now())
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return nil, status.FromContextError(err).Err()
+	} else if err != nil {
+		return nil, grpcError(err)
+	}
+	if position > 0 {
+		return &registrypb.AllocateResponse{WaitlistPosition: int32(position)}, nil
+	}
+
+	pool, _ := config.Identifiers.Pool(req.Pool)
+	expiry := newLeaseExpiry(pool.leaseTTL(int(req.TtlSeconds)), allocatedAt)
+	return &registrypb.AllocateResponse{
+		Identifier:        identifiers[0],
+		Identifiers:       identifiers,
+		ExpiresAt:         timestamppb.New(expiry.ExpiresAt),
+		TtlSeconds:        int32(expiry.TTLSeconds),
+		HeartbeatInterval: int32(expiry.HeartbeatInterval),
+		ServerTime:        timestamppb.New(expiry.ServerTime),
+	}, nil
+}
+
+// setLeaseExpiry reports the lease a successful probe renewed on resp
+func setLeaseExpiry(resp *registrypb.HeartbeatResponse, result livenessResult, now time.Time) {
+	if result.Status != LivenessOK && result.Status != LivenessReassociated {
+		return
+	}
+	expiry := newLeaseExpiry(result.TTL, now)
+	resp.ExpiresAt = timestamppb.New(expiry.ExpiresAt)
+	resp.TtlSeconds = int32(expiry.TTLSeconds)
+	resp.HeartbeatInterval = int32(expiry.HeartbeatInterval)
+	resp.ServerTime = timestamppb.New(expiry.ServerTime)
+}
+
+func (s *registryServer) Heartbeat(ctx context.Context, req *registrypb.HeartbeatRequest) (*registrypb.HeartbeatResponse, error) {
+	probe := LivenessRequest{ClientID: req.ClientId, Identifier: req.Identifier, Metadata: Metadata(req.Metadata)}
+	now := time.Now()
+	result, err := heartbeat(probe, now)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	switch result.Status {
+	case LivenessNotFound:
+		if req.Identifier == "" {
+			return nil, status.Error(codes.NotFound, "client not found")
+		}
+		return nil, status.Error(codes.NotFound, "identifier not found")
+	case LivenessConflict:
+		return nil, status.Errorf(codes.FailedPrecondition, "identifier %s is held by %s", req.Identifier, result.Owner)
+	}
+
+	resp := &registrypb.HeartbeatResponse{
+		Status:     livenessStatuses[result.Status],
+		Identifier: req.Identifier,
+		Owner:      result.Owner,
+	}
+	setLeaseExpiry(resp, result, now)
+	return resp, nil
+}
+
+// HeartbeatStream answers each probe on the stream in order. Once the stream's client is known
+// it also watches the event bus and sends LOST as soon as one of its identifiers is reaped
+// or taken over, so the client does not have to wait for its next probe to find out. If the
+// watcher falls behind the event history the stream ends with ABORTED, since a loss may have
+// gone unreported.
+func (s *registryServer) HeartbeatStream(stream registrypb.Registry_HeartbeatStreamServer) error {
+	// Responses and loss notifications are sent from different goroutines
+	var mu sync.Mutex
+	send := func(resp *registrypb.HeartbeatResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return stream.Send(resp)
+	}
+
+	// Probes are received on their own goroutine, so that the watcher can end the stream
+	requests := make(chan *registrypb.HeartbeatRequest)
+	received := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+	behind := make(chan struct{})
+
+	// The stream ends only once its watcher has stopped
+	var watching sync.WaitGroup
+	defer watching.Wait()
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	var clientID string
+	for {
+		var req *registrypb.HeartbeatRequest
+		select {
+		case req = <-requests:
+		case err := <-received:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-behind:
+			return status.Error(codes.Aborted, errLeaseWatchBehind.Error())
+		}
+
+		resp := &registrypb.HeartbeatResponse{Identifier: req.Identifier}
+		if clientID != "" && req.ClientId != clientID {
+			resp.Status = registrypb.HeartbeatResponse_INVALID
+			resp.Error = "client_id cannot change on a stream"
+			if err := send(resp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if clientID == "" && req.ClientId != "" {
+			clientID = req.ClientId
+			// Take the cursor before the first probe so that no loss after it can be missed
+			_, _, cursor, _ := events.since(0, EventFilter{})
+			watching.Add(1)
+			go func() {
+				defer watching.Done()
+				err := watchLeaseLoss(ctx, clientID, cursor, func(e Event) error {
+					return send(&registrypb.HeartbeatResponse{
+						Status:     registrypb.HeartbeatResponse_LOST,
+						Identifier: e.Identifier,
+						Owner:      e.Owner,
+					})
+				})
+				if err == errLeaseWatchBehind {
+					close(behind)
+				}
+			}()
+		}
+
+		probe := LivenessRequest{ClientID: req.ClientId, Identifier: req.Identifier, Metadata: Metadata(req.Metadata)}
+		now := time.Now()
+		result, err := heartbeat(probe, now)
+		var invalid requestError
+		if errors.As(err, &invalid) {
+			resp.Error = err.Error()
+		} else if err != nil {
+			return grpcError(err)
+		}
+
+		resp.Status = livenessStatuses[result.Status]
+		resp.Owner = result.Owner
+		setLeaseExpiry(resp, result, now)
+		if err := send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *registryServer) Release(ctx context.Context, req *registrypb.ReleaseRequest) (*registrypb.ReleaseResponse, error) {
+	if req.ClientId == "" {
+		return nil, status.Error(codes.InvalidArgument, "client_id is required")
+	}
+
+	released, err := releaseIdentifiers(req.ClientId, req.Identifier, time.Now())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &registrypb.ReleaseResponse{}
+	for _, e := range released {
+		resp.Released = append(resp.Released, e.Identifier)
+	}
+	return resp, nil
+}
+
+func (s *registryServer) Get(ctx context.Context, req *registrypb.GetRequest) (*registrypb.GetResponse, error) {
+	if req.ClientId == "" {
+		return nil, status.Error(codes.InvalidArgument, "client_id is required")
+	}
+
+	held, err := clientLeases(req.ClientId)
+	if err != nil {
+		log.Printf("Error fetching client details: %v", err)
+		return nil, grpcError(err)
+	}
+	if len(held) == 0 {
+		return nil, status.Error(codes.NotFound, "client not found")
+	}
+
+	resp := &registrypb.GetResponse{ClientId: req.ClientId}
+	for _, h := range held {
+		lease := &registrypb.Lease{Identifier: h.Identifier, Pool: h.Pool, Metadata: h.Metadata}
+		if lastSeen, err := time.Parse(time.RFC3339Nano, h.LastSeen); err == nil {
+			lease.LastSeen = timestamppb.New(lastSeen)
+		}
+		resp.Leases = append(resp.Leases, lease)
+	}
+	return resp, nil
+}
+
+func (s *registryServer) List(ctx context.Context, req *registrypb.ListRequest) (*registrypb.ListResponse, error) {
+	selector, err := parseSelector(req.Selector)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if req.Limit < 0 || req.Limit > MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", MaxPageSize)
+	}
+	query := identifierQuery{Selector: selector, Sort: "identifier", Limit: int(req.Limit)}
+	if req.AllocatedOnly {
+		query.State = StateAllocated
+	}
+	if req.PageToken != "" {
+		if query.Cursor, err = decodePageCursor(req.PageToken); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid page_token")
+		}
+	}
+
+	identifiers, total, next, err := listIdentifiers(query, time.Now())
+	if err != nil {
+		log.Printf("Error fetching all identifiers: %v", err)
+		return nil, grpcError(err)
+	}
+
+	resp := &registrypb.ListResponse{NextPageToken: next, TotalCount: int32(total)}
+	for _, id := range identifiers {
+		entry := &registrypb.Identifier{
+			Identifier:  id.Identifier,
+			Pool:        id.Pool,
+			Allocated:   id.Allocated,
+			Quarantined: id.Quarantined,
+			Metadata:    id.Metadata,
+		}
+		if id.LockedBy != nil {
+			entry.LockedBy = *id.LockedBy
+		}
+		if id.LastSeen != nil {
+			entry.LastSeen = timestamppb.New(*id.LastSeen)
+		}
+		if id.ReleasedAt != nil {
+			entry.ReleasedAt = timestamppb.New(*id.ReleasedAt)
+		}
+		resp.Identifiers = append(resp.Identifiers, entry)
+	}
+	return resp, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liftedkilt/ci-registry/registrypb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialTestGRPC serves the Registry service in memory and returns a client for it
+func dialTestGRPC(t *testing.T) registrypb.RegistryClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	// Stopping waits for the handlers, so none of them outlives the test
+	server := newGRPCServer(grpc.WaitForHandlers(true))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return registrypb.NewRegistryClient(conn)
+}
+
+func wantCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+
+	if status.Code(err) != code {
+		t.Fatalf("error = %v, want code %s", err, code)
+	}
+}
+
+func TestGRPCLeaseLifecycle(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	registry := dialTestGRPC(t)
+	ctx := context.Background()
+
+	allocated, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "a", Metadata: map[string]string{"az": "x"}})
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if allocated.Identifier != "vm-1" {
+		t.Fatalf("allocated %s, want vm-1", allocated.Identifier)
+	}
+
+	_, err = registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "b", Pool: "missing"})
+	wantCode(t, err, codes.NotFound)
+	_, err = registry.Allocate(ctx, &registrypb.AllocateRequest{})
+	wantCode(t, err, codes.InvalidArgument)
+	if _, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "b"}); err != nil {
+		t.Fatalf("allocate b: %v", err)
+	}
+	_, err = registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "c"})
+	wantCode(t, err, codes.ResourceExhausted)
+
+	beat, err := registry.Heartbeat(ctx, &registrypb.HeartbeatRequest{ClientId: "a", Identifier: "vm-1"})
+	if err != nil || beat.Status != registrypb.HeartbeatResponse_OK {
+		t.Fatalf("heartbeat = %v, %v", beat, err)
+	}
+	_, err = registry.Heartbeat(ctx, &registrypb.HeartbeatRequest{ClientId: "b", Identifier: "vm-1"})
+	wantCode(t, err, codes.FailedPrecondition)
+
+	got, err := registry.Get(ctx, &registrypb.GetRequest{ClientId: "a"})
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if len(got.Leases) != 1 || got.Leases[0].Identifier != "vm-1" || got.Leases[0].LastSeen == nil || got.Leases[0].Metadata["az"] != "x" {
+		t.Fatalf("get = %v", got)
+	}
+
+	list, err := registry.List(ctx, &registrypb.ListRequest{Selector: "az=x", AllocatedOnly: true})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(list.Identifiers) != 1 || list.Identifiers[0].LockedBy != "a" {
+		t.Fatalf("list = %v", list)
+	}
+
+	// Listings come in pages
+	first, err := registry.List(ctx, &registrypb.ListRequest{Limit: 1})
+	if err != nil || len(first.Identifiers) != 1 || first.Identifiers[0].Identifier != "vm-1" || first.TotalCount != 2 || first.NextPageToken == "" {
+		t.Fatalf("first page = %v, %v", first, err)
+	}
+	second, err := registry.List(ctx, &registrypb.ListRequest{Limit: 1, PageToken: first.NextPageToken})
+	if err != nil || len(second.Identifiers) != 1 || second.Identifiers[0].Identifier != "vm-2" || second.NextPageToken != "" {
+		t.Fatalf("second page = %v, %v", second, err)
+	}
+	_, err = registry.List(ctx, &registrypb.ListRequest{Limit: MaxPageSize + 1})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = registry.List(ctx, &registrypb.ListRequest{PageToken: "not a token"})
+	wantCode(t, err, codes.InvalidArgument)
+
+	released, err := registry.Release(ctx, &registrypb.ReleaseRequest{ClientId: "a"})
+	if err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if len(released.Released) != 1 || released.Released[0] != "vm-1" {
+		t.Fatalf("released %v, want [vm-1]", released.Released)
+	}
+	_, err = registry.Get(ctx, &registrypb.GetRequest{ClientId: "a"})
+	wantCode(t, err, codes.NotFound)
+}
+
+func TestGRPCHeartbeatStreamReportsLoss(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	registry := dialTestGRPC(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "a"}); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	stream, err := registry.HeartbeatStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	if err := stream.Send(&registrypb.HeartbeatRequest{ClientId: "a", Identifier: "vm-1"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil || resp.Status != registrypb.HeartbeatResponse_OK || resp.ExpiresAt == nil || resp.TtlSeconds == 0 {
+		t.Fatalf("first response = %v, %v", resp, err)
+	}
+
+	// The reaper runs without the client sending anything; the stream still reports the loss
+	if _, err := reapStaleIdentifiers(time.Now().Add(2*config.Server.StaleTimeout), false); err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	resp, err = stream.Recv()
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if resp.Status != registrypb.HeartbeatResponse_LOST || resp.Identifier != "vm-1" {
+		t.Fatalf("loss notification = %v, want LOST for vm-1", resp)
+	}
+
+	// Probes on the same stream keep working and reassociate the free identifier
+	if err := stream.Send(&registrypb.HeartbeatRequest{ClientId: "a", Identifier: "vm-1"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	resp, err = stream.Recv()
+	if err != nil || resp.Status != registrypb.HeartbeatResponse_REASSOCIATED {
+		t.Fatalf("response after loss = %v, %v", resp, err)
+	}
+
+	if err := stream.Send(&registrypb.HeartbeatRequest{ClientId: "b", Identifier: "vm-1"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	resp, err = stream.Recv()
+	if err != nil || resp.Status != registrypb.HeartbeatResponse_INVALID || resp.ExpiresAt != nil {
+		t.Fatalf("response to another client_id = %v, %v", resp, err)
+	}
+	stream.CloseSend()
+}
+
+func TestGRPCHeartbeatStreamAbortsWhenEventsAreMissed(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	bus := useEventBus(t, 2)
+	registry := dialTestGRPC(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "a"}); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	stream, err := registry.HeartbeatStream(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	if err := stream.Send(&registrypb.HeartbeatRequest{ClientId: "a", Identifier: "vm-1"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.Status != registrypb.HeartbeatResponse_OK {
+		t.Fatalf("first response = %v, %v", resp, err)
+	}
+
+	// More events than the history keeps arrive at once, so a loss may have gone unreported
+	bus.publish(
+		Event{Type: EventAllocate, ClientID: "b", Identifier: "vm-2"},
+		Event{Type: EventRelease, ClientID: "b", Identifier: "vm-2"},
+		Event{Type: EventAllocate, ClientID: "b", Identifier: "vm-2"},
+	)
+	_, err = stream.Recv()
+	wantCode(t, err, codes.Aborted)
+}
+
+func TestGRPCAllocateWaitsAndJoinsWaitlist(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	config.Server.AllocationMaxWait = 5 * time.Minute
+	registry := dialTestGRPC(t)
+	mustAllocate(t, "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Without asking to wait an exhausted pool fails at once
+	_, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "b"})
+	wantCode(t, err, codes.ResourceExhausted)
+	_, err = registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "b", Wait: "1h"})
+	wantCode(t, err, codes.InvalidArgument)
+
+	// A client on the waitlist learns its position
+	resp, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "b", Waitlist: true})
+	if err != nil || resp.WaitlistPosition != 1 || len(resp.Identifiers) != 0 {
+		t.Fatalf("waitlist response = %v, %v; want position 1", resp, err)
+	}
+
+	// A waiting client is served after it
+	type outcome struct {
+		resp *registrypb.AllocateResponse
+		err  error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		resp, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "c", Wait: "5s"})
+		done <- outcome{resp, err}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); waitlist.length() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("c never joined the waitlist")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := releaseIdentifiers("a", "vm-1", time.Now()); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	waitlist.serve(time.Now())
+	if resp, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "b"}); err != nil || resp.Identifier != "vm-1" {
+		t.Fatalf("b after being served = %v, %v; want vm-1", resp, err)
+	}
+
+	if _, err := releaseIdentifiers("b", "vm-1", time.Now()); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	waitlist.serve(time.Now())
+	got := <-done
+	if got.err != nil || got.resp.Identifier != "vm-1" || got.resp.ExpiresAt == nil {
+		t.Fatalf("c got %v, %v; want vm-1", got.resp, got.err)
+	}
+}
+
+func TestGRPCAllocateHonoursLeaseTTL(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	config.Identifiers.TTL = TTLConfig{Default: 90 * time.Second, Min: 30 * time.Second, Max: time.Hour}
+	registry := dialTestGRPC(t)
+	ctx := context.Background()
+
+	_, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "a", TtlSeconds: 7200})
+	wantCode(t, err, codes.InvalidArgument)
+
+	allocated, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "runner", TtlSeconds: 30})
+	if err != nil {
+		t.Fatalf("allocate runner: %v", err)
+	}
+	if allocated.TtlSeconds != 30 || allocated.HeartbeatInterval != 10 ||
+		!allocated.ExpiresAt.AsTime().Equal(allocated.ServerTime.AsTime().Add(30*time.Second)) {
+		t.Fatalf("allocation expiry = %v", allocated)
+	}
+	beat, err := registry.Heartbeat(ctx, &registrypb.HeartbeatRequest{ClientId: "runner", Identifier: allocated.Identifier})
+	if err != nil || beat.TtlSeconds != 30 || !beat.ExpiresAt.AsTime().Equal(beat.ServerTime.AsTime().Add(30*time.Second)) {
+		t.Fatalf("heartbeat = %v, %v", beat, err)
+	}
+	if _, err := registry.Allocate(ctx, &registrypb.AllocateRequest{ClientId: "default"}); err != nil {
+		t.Fatalf("allocate default: %v", err)
+	}
+
+	// Only the lease that asked for the short TTL goes stale within a minute
+	reaped, err := reapStaleIdentifiers(time.Now().Add(time.Minute), false)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if len(reaped) != 1 || reaped[0].ClientID != "runner" {
+		t.Fatalf("reaped %+v, want the runner's lease", reaped)
+	}
+}
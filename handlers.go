@@ -1,38 +1,122 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type AllocatedMapping struct {
 	Identifier string    `json:"identifier"`
+	Pool       string    `json:"pool"`
 	LockedBy   string    `json:"locked_by"`
 	LastSeen   time.Time `json:"last_seen"`
+	Metadata   Metadata  `json:"metadata,omitempty"`
 }
 
 type AllocateRequest struct {
-	ClientID string `json:"client_id"`
+	ClientID string   `json:"client_id"`
+	Pool     string   `json:"pool,omitempty"`
+	Count    int      `json:"count,omitempty"`
+	Metadata Metadata `json:"metadata,omitempty"`
+	// TTLSeconds asks for a lease TTL within the pool's bounds instead of its default
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+	// Wait is how long to block for identifiers if the pool is exhausted, e.g. "30s". Waitlist
+	// instead queues the client and answers at once with its position.
+	Wait     string `json:"wait,omitempty"`
+	Waitlist bool   `json:"waitlist,omitempty"`
 }
 
+// WaitlistResponse is the place of a client queued for identifiers. Its identifiers are
+// allocated as soon as they come free, and returned by repeating the allocation request.
+type WaitlistResponse struct {
+	Pool     string `json:"pool"`
+	Position int    `json:"position"`
+}
+
+// AllocateResponse lists every identifier the client holds in the pool.
+// Identifier repeats the first entry for clients that only ever ask for one.
 type AllocateResponse struct {
-	Identifier string `json:"identifier"`
+	Identifier  string   `json:"identifier"`
+	Identifiers []string `json:"identifiers"`
+	LeaseExpiry
+}
+
+// heartbeatsPerTTL is how many liveness probes a client is advised to send per lease TTL, so that
+// a lease survives a missed probe or two
+const heartbeatsPerTTL = 3
+
+// LeaseExpiry tells a client when its lease expires without another liveness probe, and how
+// often to send one. ServerTime lets the client correct for clock skew.
+type LeaseExpiry struct {
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds int       `json:"ttl_seconds"`
+	// HeartbeatInterval is the recommended time between liveness probes, in seconds
+	HeartbeatInterval int       `json:"heartbeat_interval"`
+	ServerTime        time.Time `json:"server_time"`
+}
+
+// newLeaseExpiry describes a lease with the given TTL that was renewed at now
+func newLeaseExpiry(ttl time.Duration, now time.Time) LeaseExpiry {
+	return LeaseExpiry{
+		ExpiresAt:         now.Add(ttl),
+		TTLSeconds:        int(ttl / time.Second),
+		HeartbeatInterval: max(int(ttl/heartbeatsPerTTL/time.Second), 1),
+		ServerTime:        now,
+	}
 }
 
 // Identifier represents an identifier's allocation status
 type Identifier struct {
-	Identifier string     `json:"identifier"`
-	LockedBy   *string    `json:"locked_by,omitempty"`
-	LastSeen   *time.Time `json:"last_seen,omitempty"`
-	Allocated  bool       `json:"allocated"`
+	Identifier  string     `json:"identifier"`
+	Pool        string     `json:"pool"`
+	LockedBy    *string    `json:"locked_by,omitempty"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	ReleasedAt  *time.Time `json:"released_at,omitempty"`
+	Allocated   bool       `json:"allocated"`
+	Quarantined bool       `json:"quarantined"`
+	Metadata    Metadata   `json:"metadata,omitempty"`
 }
 
 type LivenessRequest struct {
-	ClientID   string `json:"client_id"`
-	Identifier string `json:"identifier"`
+	ClientID   string   `json:"client_id"`
+	Identifier string   `json:"identifier"`
+	Metadata   Metadata `json:"metadata,omitempty"`
+}
+
+// LivenessResponse acknowledges a liveness probe. Without an identifier the probe renewed every
+// lease the client holds, and the expiry is that of the lease with the shortest TTL.
+type LivenessResponse struct {
+	Status LivenessStatus `json:"status"`
+	LeaseExpiry
+}
+
+// MaxLivenessBatch caps the number of entries accepted by /liveness/batch
+const MaxLivenessBatch = 1000
+
+type LivenessBatchRequest struct {
+	Entries []LivenessRequest `json:"entries"`
+}
+
+type LivenessBatchResult struct {
+	ClientID   string         `json:"client_id"`
+	Identifier string         `json:"identifier"`
+	Status     LivenessStatus `json:"status"`
+	Owner      string         `json:"owner,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	// LeaseExpiry is set for a probe that renewed the lease
+	*LeaseExpiry
+}
+
+type LivenessBatchResponse struct {
+	Results []LivenessBatchResult `json:"results"`
 }
 
 func allocateHandler(w http.ResponseWriter, r *http.Request) {
@@ -47,58 +131,42 @@ func allocateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.ClientID == "" {
-		http.Error(w, "client_id is required", http.StatusBadRequest)
+	wait, err := allocationWait(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Step 1: Check if the client already has an allocated identifier
-	var existingIdentifier string
-	err := db.QueryRow(`
-		SELECT identifier 
-		FROM identifiers 
-		WHERE locked_by = ?`,
-		req.ClientID,
-	).Scan(&existingIdentifier)
-
-	if err == nil {
-		// Client already has an identifier
-		log.Printf("Client %s already allocated identifier %s", req.ClientID, existingIdentifier)
-		json.NewEncoder(w).Encode(AllocateResponse{Identifier: existingIdentifier})
-		return
-	} else if err != sql.ErrNoRows {
-		// Other database error
-		log.Printf("Error checking existing allocation for client %s: %v", req.ClientID, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	if wait > 0 {
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Now().Add(wait + config.Server.WriteTimeout)); err != nil {
+			log.Printf("Error extending write deadline for client %s: %v", req.ClientID, err)
+		}
 	}
 
-	// Step 2: Allocate a new identifier if none exists
-	var newIdentifier string
-	err = db.QueryRow(`
-		UPDATE identifiers 
-		SET locked_by = ?, last_seen = ?
-		WHERE identifier IN (
-			SELECT identifier FROM identifiers WHERE locked_by IS NULL LIMIT 1
-		)
-		RETURNING identifier`,
-		req.ClientID, time.Now(),
-	).Scan(&newIdentifier)
-
-	if err == sql.ErrNoRows {
-		// No available identifiers
-		log.Printf("Allocation failed: No available identifiers for client %s", req.ClientID)
+	identifiers, allocatedAt, position, err := allocateOrWait(r.Context(), req, wait, req.Waitlist, time.Now())
+	pool, _ := config.Identifiers.Pool(req.Pool)
+	var invalid requestError
+	switch {
+	case errors.As(err, &invalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err == errUnknownPool:
+		http.Error(w, "Unknown pool", http.StatusNotFound)
+	case err == sql.ErrNoRows:
 		http.Error(w, "No available identifiers", http.StatusServiceUnavailable)
-		return
-	} else if err != nil {
-		// Other database error
-		log.Printf("Error allocating identifier for client %s: %v", req.ClientID, err)
+	case err != nil:
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	case position > 0:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(WaitlistResponse{Pool: pool.Name, Position: position})
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AllocateResponse{
+			Identifier:  identifiers[0],
+			Identifiers: identifiers,
+			LeaseExpiry: newLeaseExpiry(pool.leaseTTL(req.TTLSeconds), allocatedAt),
+		})
 	}
-
-	log.Printf("New identifier allocated: ClientID=%s, Identifier=%s", req.ClientID, newIdentifier)
-	json.NewEncoder(w).Encode(AllocateResponse{Identifier: newIdentifier})
 }
 
 func allocatedHandler(w http.ResponseWriter, r *http.Request) {
@@ -107,44 +175,40 @@ func allocatedHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query(`
-		SELECT identifier, locked_by, last_seen 
-		FROM identifiers 
-		WHERE locked_by IS NOT NULL
-	`)
+	query, err := parseIdentifierQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.State != "" && query.State != StateAllocated {
+		http.Error(w, "Only allocated identifiers are listed here", http.StatusBadRequest)
+		return
+	}
+	query.State = StateAllocated
+
+	identifiers, total, next, err := listIdentifiers(query, time.Now())
 	if err != nil {
 		log.Printf("Error fetching allocated mappings: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var mappings []AllocatedMapping
-	for rows.Next() {
-		var mapping AllocatedMapping
-		var lastSeen string
-		err := rows.Scan(&mapping.Identifier, &mapping.LockedBy, &lastSeen)
-		if err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-
-		// Parse last_seen into a time.Time object
-		mapping.LastSeen, err = time.Parse(time.RFC3339, lastSeen)
-		if err != nil {
-			log.Printf("Error parsing last_seen: %v", err)
+	mappings := []AllocatedMapping{}
+	for _, id := range identifiers {
+		if id.LastSeen == nil {
+			log.Printf("Error parsing last_seen of %s", id.Identifier)
 			continue
 		}
-
-		mappings = append(mappings, mapping)
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Printf("Rows iteration error: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		mappings = append(mappings, AllocatedMapping{
+			Identifier: id.Identifier,
+			Pool:       id.Pool,
+			LockedBy:   *id.LockedBy,
+			LastSeen:   *id.LastSeen,
+			Metadata:   id.Metadata,
+		})
 	}
 
+	setPageHeaders(w, total, next)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(mappings); err != nil {
 		log.Printf("Error encoding JSON response: %v", err)
@@ -159,28 +223,26 @@ func clientDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var identifier, lastSeen string
-	err := db.QueryRow(`
-		SELECT identifier, last_seen
-		FROM identifiers
-		WHERE locked_by = ?`,
-		clientID,
-	).Scan(&identifier, &lastSeen)
-
-	if err == sql.ErrNoRows {
-		http.Error(w, "Client not found", http.StatusNotFound)
-		return
-	} else if err != nil {
+	held, err := clientLeases(clientID)
+	if err != nil {
 		log.Printf("Error fetching client details: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	if len(held) == 0 {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	// The first identifier is repeated at the top level for single-identifier clients
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"client_id":  clientID,
-		"identifier": identifier,
-		"last_seen":  lastSeen,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"client_id":   clientID,
+		"identifier":  held[0].Identifier,
+		"last_seen":   held[0].LastSeen,
+		"metadata":    held[0].Metadata,
+		"identifiers": held,
 	})
 }
 
@@ -192,13 +254,15 @@ func identifierDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var clientID, lastSeen string
+	// Both are NULL while the identifier is free
+	var clientID, lastSeen sql.NullString
+	var metadata sql.NullString
 	err := db.QueryRow(`
-		SELECT locked_by, last_seen
+		SELECT locked_by, last_seen, metadata
 		FROM identifiers
 		WHERE identifier = ?`,
 		identifier,
-	).Scan(&clientID, &lastSeen)
+	).Scan(&clientID, &lastSeen, &metadata)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Identifier not found", http.StatusNotFound)
@@ -209,12 +273,21 @@ func identifierDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"client_id":  clientID,
+	details := map[string]interface{}{
+		"client_id":  nil,
 		"identifier": identifier,
-		"last_seen":  lastSeen,
-	})
+		"last_seen":  nil,
+		"metadata":   parseMetadata(metadata).orEmpty(),
+	}
+	if clientID.Valid {
+		details["client_id"] = clientID.String
+	}
+	if lastSeen.Valid {
+		details["last_seen"] = lastSeen.String
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
 }
 
 // identifiersHandler handles listing all identifiers and their status
@@ -224,53 +297,20 @@ func identifiersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query(`
-		SELECT identifier, locked_by, last_seen 
-		FROM identifiers
-	`)
+	query, err := parseIdentifierQuery(r.URL.Query())
 	if err != nil {
-		log.Printf("Error fetching all identifiers: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
-
-	var identifiers []Identifier
-	for rows.Next() {
-		var id Identifier
-		var lockedBy sql.NullString
-		var lastSeen sql.NullString
-
-		err := rows.Scan(&id.Identifier, &lockedBy, &lastSeen)
-		if err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-
-		// Handle nullable fields
-		if lockedBy.Valid {
-			id.LockedBy = &lockedBy.String
-			id.Allocated = true
-		} else {
-			id.Allocated = false
-		}
-
-		if lastSeen.Valid {
-			parsedTime, err := time.Parse(time.RFC3339, lastSeen.String)
-			if err == nil {
-				id.LastSeen = &parsedTime
-			}
-		}
-
-		identifiers = append(identifiers, id)
-	}
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Rows iteration error: %v", err)
+	identifiers, total, next, err := listIdentifiers(query, time.Now())
+	if err != nil {
+		log.Printf("Error fetching all identifiers: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	setPageHeaders(w, total, next)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(identifiers); err != nil {
 		log.Printf("Error encoding JSON response: %v", err)
@@ -283,98 +323,110 @@ func livenessHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		ClientID   string `json:"client_id"`
-		Identifier string `json:"identifier"`
-	}
+	var req LivenessRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	if req.ClientID == "" || req.Identifier == "" {
-		http.Error(w, "client_id and identifier are required", http.StatusBadRequest)
-		return
-	}
-
-	var dbClientID string
-	var lastSeen sql.NullTime
-
-	// Step 1: Check if the identifier exists and its current state
-	err := db.QueryRow(`
-		SELECT locked_by, last_seen 
-		FROM identifiers 
-		WHERE identifier = ?`,
-		req.Identifier,
-	).Scan(&dbClientID, &lastSeen)
-
-	if err == sql.ErrNoRows {
-		// Identifier does not exist
-		log.Printf("Liveness probe failed: Identifier %s not found", req.Identifier)
-		http.Error(w, "Identifier not found", http.StatusNotFound)
+	now := time.Now()
+	result, err := heartbeat(req, now)
+	var invalid requestError
+	if errors.As(err, &invalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	} else if err != nil {
-		// Database error
-		log.Printf("Error querying identifier %s: %v", req.Identifier, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Step 2: Handle stale or unallocated identifiers
-	if dbClientID == "" || (lastSeen.Valid && time.Since(lastSeen.Time) > StaleTimeout) {
-		// Identifier is stale or unallocated; reassociate with the client
-		_, err := db.Exec(`
-			UPDATE identifiers 
-			SET locked_by = ?, last_seen = ?
-			WHERE identifier = ?`,
-			req.ClientID, time.Now(), req.Identifier,
-		)
-
-		if err != nil {
-			log.Printf("Error reassociating identifier %s with client %s: %v", req.Identifier, req.ClientID, err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		log.Printf("Reassociated stale identifier %s with client %s", req.Identifier, req.ClientID)
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	// Step 3: Validate client ownership
-	if dbClientID != req.ClientID {
-		// ClientID does not match the current owner
-		log.Printf("Liveness probe mismatch: Identifier %s locked by %s, but %s attempted to claim it",
-			req.Identifier, dbClientID, req.ClientID)
-
+	switch {
+	case result.Status == LivenessNotFound && req.Identifier == "":
+		http.Error(w, "Client not found", http.StatusNotFound)
+	case result.Status == LivenessNotFound:
+		http.Error(w, "Identifier not found", http.StatusNotFound)
+	case result.Status == LivenessConflict:
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(map[string]string{
 			"error":       "Identifier mismatch",
-			"expected_id": dbClientID,
+			"expected_id": result.Owner,
 			"your_id":     req.ClientID,
 			"message":     "Your client_id does not match the current owner of this identifier.",
 		})
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(LivenessResponse{Status: result.Status, LeaseExpiry: newLeaseExpiry(result.TTL, now)})
+	}
+}
+
+// livenessBatchHandler applies many liveness probes in a single transaction and reports
+// the outcome of each one
+func livenessBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Step 4: Update last_seen for valid liveness probe
-	_, err = db.Exec(`
-		UPDATE identifiers 
-		SET last_seen = ?
-		WHERE identifier = ? AND locked_by = ?`,
-		time.Now(), req.Identifier, req.ClientID,
-	)
+	var req LivenessBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
 
-	if err != nil {
-		log.Printf("Error updating liveness for client %s: %v", req.ClientID, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if len(req.Entries) == 0 {
+		http.Error(w, "entries are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Entries) > MaxLivenessBatch {
+		http.Error(w, fmt.Sprintf("at most %d entries are allowed per batch", MaxLivenessBatch), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Liveness updated: Identifier=%s, ClientID=%s", req.Identifier, req.ClientID)
-	w.WriteHeader(http.StatusOK)
+	now := time.Now()
+	results := make([]LivenessBatchResult, len(req.Entries))
+	var probes []LivenessRequest
+	// probed maps each probe back to its entry
+	var probed []int
+	for i, entry := range req.Entries {
+		results[i] = LivenessBatchResult{ClientID: entry.ClientID, Identifier: entry.Identifier}
+
+		if entry.ClientID == "" || entry.Identifier == "" {
+			results[i].Status = LivenessInvalid
+			results[i].Error = "client_id and identifier are required"
+		} else if err := validateMetadata(entry.Metadata); err != nil {
+			results[i].Status = LivenessInvalid
+			results[i].Error = err.Error()
+		} else {
+			probes = append(probes, entry)
+			probed = append(probed, i)
+		}
+	}
+
+	if len(probes) > 0 {
+		outcomes, err := recordLivenessBatch(probes, now)
+		if err != nil {
+			log.Printf("Error applying liveness batch: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for j, outcome := range outcomes {
+			result := &results[probed[j]]
+			result.Status = outcome.Status
+			switch outcome.Status {
+			case LivenessConflict:
+				result.Owner = outcome.Owner
+			case LivenessOK, LivenessReassociated:
+				expiry := newLeaseExpiry(outcome.TTL, now)
+				result.LeaseExpiry = &expiry
+			}
+		}
+	}
+
+	log.Printf("Liveness batch applied: %d entries", len(results))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LivenessBatchResponse{Results: results})
 }
 
 func releaseHandler(w http.ResponseWriter, r *http.Request) {
@@ -393,20 +445,17 @@ func releaseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.Exec(`
-		UPDATE identifiers
-		SET locked_by = NULL, last_seen = NULL
-		WHERE identifier = ? AND locked_by = ?`,
-		req.Identifier, req.ClientID,
-	)
+	if req.ClientID == "" {
+		http.Error(w, "client_id is required", http.StatusBadRequest)
+		return
+	}
 
-	if err != nil {
-		log.Printf("Error releasing identifier: %v", err)
+	if _, err := releaseIdentifiers(req.ClientID, req.Identifier, time.Now()); err != nil {
 		http.Error(w, "Failed to release identifier", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Client %s manually released identifier %s", req.ClientID, req.Identifier)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
 		"status":  "success",
@@ -415,17 +464,91 @@ func releaseHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
-	var total, allocated, stale int
+	var total, allocated, stale, quarantined int
 
 	db.QueryRow(`SELECT COUNT(*) FROM identifiers`).Scan(&total)
 	db.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE locked_by IS NOT NULL`).Scan(&allocated)
-	db.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE last_seen < ?`, time.Now().Add(-config.Server.StaleTimeout)).Scan(&stale)
+	db.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE `+staleLease, staleLeaseArgs(time.Now())...).Scan(&stale)
+	db.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE locked_by IS NULL AND released_at > ?`, cooldownThreshold(time.Now())).Scan(&quarantined)
+
+	stats := map[string]int{
+		"total_identifiers":       total,
+		"allocated_identifiers":   allocated,
+		"available_identifiers":   total - allocated - quarantined,
+		"stale_identifiers":       stale,
+		"quarantined_identifiers": quarantined,
+		"leader":                  0,
+		"reaping_paused":          0,
+		"waiting_clients":         waitlist.length(),
+	}
+	if isLeader() {
+		stats["leader"] = 1
+	}
+	if paused, _ := reapingPaused(); paused {
+		stats["reaping_paused"] = 1
+	}
+	stats["low_pools"], _ = lowPools(time.Now())
+	if leadership != nil {
+		_, stats["leadership_changes"] = leadership.leader()
+	}
+	if cluster != nil {
+		_, stats["leadership_changes"] = cluster.leader()
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]int{
-		"total_identifiers":     total,
-		"allocated_identifiers": allocated,
-		"available_identifiers": total - allocated,
-		"stale_identifiers":     stale,
-	})
+	json.NewEncoder(w).Encode(stats)
+}
+
+// healthHandler reports whether the service can reach its database, and how long it has been running
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, code := "healthy", http.StatusOK
+	if err := db.Ping(); err != nil {
+		log.Printf("Health check failed: %v", err)
+		status, code = "unhealthy", http.StatusServiceUnavailable
+	}
+
+	health := map[string]string{
+		"status": status,
+		"uptime": time.Since(startTime).Round(time.Second).String(),
+		"role":   role(),
+	}
+	if leadership != nil {
+		health["node_id"] = leadership.nodeID
+		health["leader"], _ = leadership.leader()
+	}
+	if cluster != nil {
+		health["node_id"] = strconv.FormatUint(cluster.id, 10)
+		if leader, _ := cluster.leader(); leader != 0 {
+			health["leader"] = strconv.FormatUint(leader, 10)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(health)
+}
+
+// adminHandler serves an admin endpoint to requests that carry server.admin_token as a bearer
+// token. Without a configured token the admin endpoints are disabled.
+func adminHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := config.Server.AdminToken
+		if token == "" {
+			http.Error(w, "Admin API is disabled; set server.admin_token", http.StatusForbidden)
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			log.Printf("Admin request %s %s from %s rejected: bad token", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postLivenessBatch sends entries to /liveness/batch and returns the response
+func postLivenessBatch(t *testing.T, entries []LivenessRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(LivenessBatchRequest{Entries: entries})
+	if err != nil {
+		t.Fatalf("encode batch: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/liveness/batch", strings.NewReader(string(body))))
+	return rec
+}
+
+func TestLivenessBatchReportsEachEntry(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+
+	mustAllocate(t, "a") // vm-1
+	mustAllocate(t, "b") // vm-2
+
+	rec := postLivenessBatch(t, []LivenessRequest{
+		{ClientID: "a", Identifier: "vm-1"},
+		{ClientID: "c", Identifier: "vm-3"},
+		{ClientID: "c", Identifier: "vm-2"},
+		{ClientID: "c", Identifier: "vm-9"},
+		{ClientID: "", Identifier: "vm-1"},
+		{ClientID: "a", Identifier: "vm-1", Metadata: Metadata{"a=b": "c"}},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch = %d %s", rec.Code, rec.Body)
+	}
+
+	var resp LivenessBatchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := []struct {
+		status LivenessStatus
+		owner  string
+	}{
+		{LivenessOK, ""},
+		{LivenessReassociated, ""},
+		{LivenessConflict, "b"},
+		{LivenessNotFound, ""},
+		{LivenessInvalid, ""},
+		{LivenessInvalid, ""},
+	}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(resp.Results), len(want))
+	}
+	for i, w := range want {
+		got := resp.Results[i]
+		if got.Status != w.status || got.Owner != w.owner {
+			t.Errorf("entry %d = %s owner %q, want %s owner %q", i, got.Status, got.Owner, w.status, w.owner)
+		}
+		if renewed := w.status == LivenessOK || w.status == LivenessReassociated; renewed != (got.LeaseExpiry != nil) {
+			t.Errorf("entry %d: lease expiry %+v", i, got.LeaseExpiry)
+		}
+		if w.status == LivenessInvalid && got.Error == "" {
+			t.Errorf("entry %d: invalid without an error", i)
+		}
+	}
+
+	var owner string
+	db.QueryRow(`SELECT locked_by FROM identifiers WHERE identifier = 'vm-3'`).Scan(&owner)
+	if owner != "c" {
+		t.Errorf("vm-3 held by %q after reassociation, want c", owner)
+	}
+}
+
+func TestLivenessBatchRejectsOversizedBatch(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+
+	entries := make([]LivenessRequest, MaxLivenessBatch+1)
+	for i := range entries {
+		entries[i] = LivenessRequest{ClientID: fmt.Sprintf("c-%d", i), Identifier: "vm-1"}
+	}
+	if rec := postLivenessBatch(t, entries); rec.Code != http.StatusBadRequest {
+		t.Fatalf("oversized batch = %d, want 400", rec.Code)
+	}
+	if rec := postLivenessBatch(t, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("empty batch = %d, want 400", rec.Code)
+	}
+}
+
+func TestLivenessBatchRollsBackOnError(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+
+	start := time.Now().Add(-time.Minute)
+	for _, client := range []string{"a", "b"} {
+		if _, err := allocateNextIdentifier(db, DefaultPool, client, 0, nil, start); err != nil {
+			t.Fatalf("allocate for %s: %v", client, err)
+		}
+	}
+
+	// Writes to vm-2 fail, after the probe for vm-1 has been applied in the same transaction
+	_, err := db.Exec(`
+		CREATE TRIGGER fail_vm_2 BEFORE UPDATE ON identifiers WHEN NEW.identifier = 'vm-2'
+		BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+	if err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+
+	rec := postLivenessBatch(t, []LivenessRequest{
+		{ClientID: "a", Identifier: "vm-1"},
+		{ClientID: "b", Identifier: "vm-2"},
+	})
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("failing batch = %d, want 500", rec.Code)
+	}
+	if got := storedLastSeen(t, "vm-1"); !got.Equal(start) {
+		t.Fatalf("vm-1 last_seen moved by %s, want the batch rolled back", got.Sub(start))
+	}
+}
+
+func TestAdminEndpointsRequireToken(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	config.Database.Backup = BackupConfig{Directory: t.TempDir(), Retain: 1}
+	router := newRouter()
+
+	backup := func(token string) int {
+		req := httptest.NewRequest("POST", "/admin/backup", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without a configured token nobody gets in
+	if code := backup("anything"); code != http.StatusForbidden {
+		t.Fatalf("backup with the admin API disabled = %d, want 403", code)
+	}
+
+	config.Server.AdminToken = "secret"
+	for _, token := range []string{"", "wrong", "secretx"} {
+		if code := backup(token); code != http.StatusUnauthorized {
+			t.Errorf("backup with token %q = %d, want 401", token, code)
+		}
+	}
+	if code := backup("secret"); code != http.StatusOK {
+		t.Fatalf("backup with the admin token = %d, want 200", code)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// bufferedLease is a lease the heartbeat buffer can acknowledge probes for without a query
+type bufferedLease struct {
+	clientID string
+	pool     string
+	ttl      time.Duration
+	// latest is the newest probe; flushed is the newest probe written to the database
+	latest  time.Time
+	flushed time.Time
+}
+
+// heartbeatBuffer acknowledges plain liveness probes for leases it has seen recently from
+// memory and writes their last_seen to the database in batches. A crash loses at most the
+// probes of one flush interval.
+type heartbeatBuffer struct {
+	mu     sync.Mutex
+	leases map[string]*bufferedLease
+	// forgets counts dropped leases, so that a lease checked against the database before a
+	// concurrent change is not remembered after it
+	forgets uint64
+
+	// flushMu keeps flushes from overlapping
+	flushMu sync.Mutex
+}
+
+// heartbeats is nil when buffering is disabled, and every probe is written through
+var heartbeats *heartbeatBuffer
+
+func newHeartbeatBuffer() *heartbeatBuffer {
+	b := &heartbeatBuffer{leases: make(map[string]*bufferedLease)}
+	// Any event for an identifier means its owner may have changed
+	events.subscribe(b.forgetEvents)
+	return b
+}
+
+// startHeartbeatBuffer enables the buffer and flushes it every configured interval
+func startHeartbeatBuffer() {
+	interval := config.Server.HeartbeatFlushInterval
+	if interval <= 0 {
+		return
+	}
+	// The leader flushes only its own buffer before reaping, so with local replicas it would reap
+	// leases kept alive in another replica's memory, and a replica would keep acknowledging
+	// probes for up to replicaEventPollInterval after another replica's takeover. With raft
+	// every probe is an entry in the log.
+	if config.LocalReplicas.Enabled || config.Raft.Enabled {
+		log.Printf("Liveness probes are written through with local replicas and raft")
+		return
+	}
+
+	heartbeats = newHeartbeatBuffer()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := heartbeats.flush(); err != nil {
+				log.Printf("Error flushing heartbeats: %v", err)
+			}
+		}
+	}()
+
+	log.Printf("Buffering liveness probes, flushing every %s", interval)
+}
+
+// record acknowledges a probe from memory if the client holds the identifier and is not stale
+func (b *heartbeatBuffer) record(clientID, identifier string, now time.Time) (livenessResult, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lease, ok := b.leases[identifier]
+	if !ok || lease.clientID != clientID || now.Sub(lease.latest) > lease.ttl {
+		return livenessResult{}, false
+	}
+	if now.After(lease.latest) {
+		lease.latest = now
+	}
+	return livenessResult{Status: LivenessOK, Owner: clientID, Pool: lease.pool, TTL: lease.ttl}, true
+}
+
+// generation returns a token for remember, taken before the database is consulted
+func (b *heartbeatBuffer) generation() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.forgets
+}
+
+// remember caches a lease the database just confirmed at now, unless a lease was dropped
+// since generation was taken
+func (b *heartbeatBuffer) remember(clientID, identifier, pool string, ttl time.Duration, now time.Time, generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.forgets != generation {
+		return
+	}
+	b.leases[identifier] = &bufferedLease{clientID: clientID, pool: pool, ttl: ttl, latest: now, flushed: now}
+}
+
+func (b *heartbeatBuffer) forgetEvents(batch []Event) {
+	identifiers := make([]string, len(batch))
+	for i, e := range batch {
+		identifiers[i] = e.Identifier
+	}
+	b.forget(identifiers)
+}
+
+// forget drops the buffered leases of identifiers whose lease changed in the database without
+// an event, such as a renewal with a new TTL
+func (b *heartbeatBuffer) forget(identifiers []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, identifier := range identifiers {
+		delete(b.leases, identifier)
+	}
+	b.forgets++
+}
+
+// dirty reports whether identifier has a probe not yet written to the database
+func (b *heartbeatBuffer) dirty(identifier string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lease, ok := b.leases[identifier]
+	return ok && lease.latest.After(lease.flushed)
+}
+
+// flush writes the newest probe of every lease in a single transaction. A lease whose
+// owner changed in the database is dropped.
+func (b *heartbeatBuffer) flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	type write struct {
+		identifier, clientID string
+		lastSeen             time.Time
+	}
+
+	b.mu.Lock()
+	var writes []write
+	for identifier, lease := range b.leases {
+		if lease.latest.After(lease.flushed) {
+			writes = append(writes, write{identifier, lease.clientID, lease.latest})
+		}
+	}
+	b.mu.Unlock()
+
+	if len(writes) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		UPDATE identifiers
+		SET last_seen = ?
+		WHERE identifier = ? AND locked_by = ? AND last_seen < ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var lost []string
+	for _, w := range writes {
+		result, err := stmt.Exec(w.lastSeen, w.identifier, w.clientID, w.lastSeen)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			// Either last_seen is already newer, or the lease changed hands
+			var owner string
+			if err := tx.QueryRow(`SELECT COALESCE(locked_by, '') FROM identifiers WHERE identifier = ?`, w.identifier).Scan(&owner); err != nil || owner != w.clientID {
+				lost = append(lost, w.identifier)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, w := range writes {
+		if lease, ok := b.leases[w.identifier]; ok && lease.clientID == w.clientID && w.lastSeen.After(lease.flushed) {
+			lease.flushed = w.lastSeen
+		}
+	}
+	for _, identifier := range lost {
+		delete(b.leases, identifier)
+	}
+	if len(lost) > 0 {
+		b.forgets++
+	}
+	return nil
+}
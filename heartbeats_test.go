@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useHeartbeatBuffer(t *testing.T) {
+	t.Helper()
+	heartbeats = newHeartbeatBuffer()
+	t.Cleanup(func() { heartbeats = nil })
+}
+
+func storedLastSeen(t *testing.T, identifier string) time.Time {
+	t.Helper()
+
+	var lastSeen sql.NullTime
+	if err := db.QueryRow(`SELECT last_seen FROM identifiers WHERE identifier = ?`, identifier).Scan(&lastSeen); err != nil {
+		t.Fatalf("read %s: %v", identifier, err)
+	}
+	return lastSeen.Time
+}
+
+func TestBufferedHeartbeatsKeepLeaseFromReaper(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	useHeartbeatBuffer(t)
+
+	start := time.Now().Add(-time.Hour)
+	if _, err := allocateNextIdentifier(db, DefaultPool, "a", 0, nil, start); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	probe := LivenessRequest{ClientID: "a", Identifier: "vm-1"}
+	for _, at := range []time.Duration{10 * time.Second, 30 * time.Second, 60 * time.Second} {
+		if result, err := heartbeat(probe, start.Add(at)); err != nil || result.Status != LivenessOK {
+			t.Fatalf("probe at +%s = %+v, %v", at, result, err)
+		}
+	}
+
+	// Only the first probe reached the database
+	if got := storedLastSeen(t, "vm-1"); !got.Equal(start.Add(10 * time.Second)) {
+		t.Fatalf("stored last_seen +%s, want +10s", got.Sub(start))
+	}
+
+	// The stored probe is stale by now, the buffered one is not
+	reaped, err := reapStaleIdentifiers(start.Add(120*time.Second), false)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if len(reaped) != 0 {
+		t.Fatalf("reaped %+v despite a buffered probe", reaped)
+	}
+	if got := storedLastSeen(t, "vm-1"); !got.Equal(start.Add(60 * time.Second)) {
+		t.Fatalf("stored last_seen +%s after the reaper flushed, want +60s", got.Sub(start))
+	}
+}
+
+func TestBufferedHeartbeatsNotAcknowledgedAfterLoss(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	useHeartbeatBuffer(t)
+
+	now := time.Now()
+	mustAllocate(t, "a")
+	probe := LivenessRequest{ClientID: "a", Identifier: "vm-1"}
+	if _, err := heartbeat(probe, now); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+
+	// The release event drops the buffered lease, so the next probe checks the database
+	if _, err := releaseIdentifiers("a", "", now); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := allocateNextIdentifier(db, DefaultPool, "b", 0, nil, now.Add(time.Second)); err != nil {
+		t.Fatalf("allocate for b: %v", err)
+	}
+	if result, err := heartbeat(probe, now.Add(2*time.Second)); err != nil || result.Status != LivenessConflict || result.Owner != "b" {
+		t.Fatalf("probe after losing vm-1 = %+v, %v; want a conflict with b", result, err)
+	}
+
+	// A lease that changes hands behind the buffer's back is dropped on the next flush
+	probe.ClientID = "b"
+	heartbeat(probe, now.Add(3*time.Second))
+	heartbeat(probe, now.Add(4*time.Second))
+	if _, err := db.Exec(`UPDATE identifiers SET locked_by = 'c' WHERE identifier = 'vm-1'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := heartbeats.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if result, err := heartbeat(probe, now.Add(5*time.Second)); err != nil || result.Status != LivenessConflict {
+		t.Fatalf("probe after a hidden takeover = %+v, %v; want a conflict", result, err)
+	}
+}
+
+func TestResponsesReportLeaseExpiry(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1", "vm-2")
+	config.Identifiers.MaxPerClient = 2
+	config.Identifiers.TTL = TTLConfig{Default: 90 * time.Second, Min: 30 * time.Second, Max: time.Hour}
+
+	post := func(path, body string, out interface{}) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		if rec.Code != 200 {
+			t.Fatalf("POST %s = %d %s", path, rec.Code, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+	}
+
+	var allocated AllocateResponse
+	post("/allocate", `{"client_id":"a","ttl_seconds":30}`, &allocated)
+	if allocated.TTLSeconds != 30 || allocated.HeartbeatInterval != 10 || !allocated.ExpiresAt.Equal(allocated.ServerTime.Add(30*time.Second)) {
+		t.Fatalf("allocation expiry = %+v, want a 30s TTL probed every 10s", allocated.LeaseExpiry)
+	}
+
+	var renewed LivenessResponse
+	post("/liveness", `{"client_id":"a","identifier":"vm-1"}`, &renewed)
+	if renewed.Status != LivenessOK || renewed.TTLSeconds != 30 || !renewed.ExpiresAt.Equal(renewed.ServerTime.Add(30*time.Second)) {
+		t.Fatalf("liveness = %+v, want ok with a 30s TTL", renewed)
+	}
+
+	// Another identifier with the default TTL; the client-wide probe reports the shorter one
+	if _, err := allocateNextIdentifier(db, DefaultPool, "a", 90*time.Second, nil, time.Now()); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	var all LivenessResponse
+	post("/liveness", `{"client_id":"a"}`, &all)
+	if all.Status != LivenessOK || all.TTLSeconds != 30 {
+		t.Fatalf("client-wide liveness = %+v, want the 30s TTL", all)
+	}
+}
+
+func TestBufferedHeartbeatsFollowReallocatedTTL(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	config.Identifiers.TTL = TTLConfig{Default: 90 * time.Second, Min: 30 * time.Second, Max: 5 * time.Minute}
+	useHeartbeatBuffer(t)
+
+	start := time.Now()
+	if _, err := allocate(AllocateRequest{ClientID: "a", TTLSeconds: 60}, start); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	probe := LivenessRequest{ClientID: "a", Identifier: "vm-1"}
+	if result, err := heartbeat(probe, start.Add(10*time.Second)); err != nil || result.TTL != time.Minute {
+		t.Fatalf("probe = %+v, %v; want a 60s lease", result, err)
+	}
+
+	// Allocating again renews the held identifier with a longer TTL
+	if _, err := allocate(AllocateRequest{ClientID: "a", TTLSeconds: 300}, start.Add(20*time.Second)); err != nil {
+		t.Fatalf("allocate again: %v", err)
+	}
+	if result, err := heartbeat(probe, start.Add(30*time.Second)); err != nil || result.TTL != 5*time.Minute {
+		t.Fatalf("probe after reallocation = %+v, %v; want a 300s lease", result, err)
+	}
+
+	// The longer TTL also keeps a probe after more than 60s of silence from being refused
+	if result, err := heartbeat(probe, start.Add(200*time.Second)); err != nil || result.Status != LivenessOK || result.TTL != 5*time.Minute {
+		t.Fatalf("late probe = %+v, %v; want ok with a 300s lease", result, err)
+	}
+}
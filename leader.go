@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles reported by /health
+const (
+	RoleStandalone = "standalone"
+	RoleLeader     = "leader"
+	RoleFollower   = "follower"
+)
+
+// leaderLeaseName is the row of the leader_lease table the replicas compete for
+const leaderLeaseName = "registry"
+
+// leaderElection holds this replica's view of the leader lease. The leader renews the lease
+// every renew interval; any replica takes it over once it has expired.
+type leaderElection struct {
+	nodeID string
+	lease  time.Duration
+
+	mu sync.Mutex
+	// holder is the replica that held the lease at the last campaign, until expiresAt
+	holder    string
+	expiresAt time.Time
+	// changes counts the times this replica gained or lost leadership
+	changes int
+}
+
+// leadership is nil unless local replicas are enabled, in which case this replica may be a follower
+var leadership *leaderElection
+
+// initLeaderLease creates the tables replicas elect a leader and share their events through
+func initLeaderLease() {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS leader_lease (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS replica_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		event TEXT NOT NULL
+	);`)
+	if err != nil {
+		log.Fatalf("Failed to create leader_lease table: %v", err)
+	}
+}
+
+func newLeaderElection(nodeID string, lease time.Duration) *leaderElection {
+	return &leaderElection{nodeID: nodeID, lease: lease}
+}
+
+// startLeaderElection campaigns for the leader lease every renew interval, if local replicas are enabled
+func startLeaderElection() {
+	if !config.LocalReplicas.Enabled {
+		return
+	}
+
+	leadership = newLeaderElection(config.LocalReplicas.NodeID, config.LocalReplicas.LeaseDuration)
+	if err := leadership.campaign(time.Now()); err != nil {
+		log.Printf("Error campaigning for leadership: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.LocalReplicas.RenewInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := leadership.campaign(time.Now()); err != nil {
+				log.Printf("Error campaigning for leadership: %v", err)
+			}
+		}
+	}()
+
+	log.Printf("Local replica %s campaigning for a %s leader lease", config.LocalReplicas.NodeID, config.LocalReplicas.LeaseDuration)
+
+	go followReplicaEvents(leadership)
+}
+
+// replicaEventPollInterval is how often a replica picks up the events of the others
+const replicaEventPollInterval = 250 * time.Millisecond
+
+// replicaEventRetention is how long the leader keeps events in replica_events. A replica that
+// stalls for longer misses the events in between.
+const replicaEventRetention = 5 * time.Minute
+
+// recordReplicaEvents stores the events of a change made by replica nodeID in transaction q,
+// so that the other replicas publish them to their own watchers
+func recordReplicaEvents(q queryer, nodeID string, batch []Event) error {
+	for _, e := range batch {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(`INSERT INTO replica_events (node_id, created_at, event) VALUES (?, ?, ?)`,
+			nodeID, e.Time.UTC(), string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollReplicaEvents publishes the events other replicas recorded after cursor, and returns the
+// cursor to poll from next
+func pollReplicaEvents(nodeID string, cursor int64) (int64, error) {
+	rows, err := db.Query(`SELECT id, node_id, event FROM replica_events WHERE id > ? ORDER BY id`, cursor)
+	if err != nil {
+		return cursor, err
+	}
+	defer rows.Close()
+
+	var batch []Event
+	for rows.Next() {
+		var origin, data string
+		if err := rows.Scan(&cursor, &origin, &data); err != nil {
+			return cursor, err
+		}
+		if origin == nodeID {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			log.Printf("Skipping unreadable event %d from replica %s: %v", cursor, origin, err)
+			continue
+		}
+		// The event gets an ID from this replica's bus
+		e.ID = 0
+		batch = append(batch, e)
+	}
+	if err := rows.Err(); err != nil {
+		return cursor, err
+	}
+	events.publish(batch...)
+	return cursor, nil
+}
+
+// followReplicaEvents publishes the events of the other replicas, so that watchers and lease
+// loss streams on any replica see every allocation, release and reap. The leader also prunes
+// old events.
+func followReplicaEvents(e *leaderElection) {
+	var cursor int64
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM replica_events`).Scan(&cursor); err != nil {
+		log.Printf("Error reading replica events: %v", err)
+	}
+
+	ticker := time.NewTicker(replicaEventPollInterval)
+	defer ticker.Stop()
+
+	var pruned time.Time
+	for now := range ticker.C {
+		var err error
+		if cursor, err = pollReplicaEvents(e.nodeID, cursor); err != nil {
+			log.Printf("Error reading replica events: %v", err)
+		}
+
+		if e.isLeader(now) && now.Sub(pruned) >= time.Minute {
+			if _, err := db.Exec(`DELETE FROM replica_events WHERE created_at < ?`, now.Add(-replicaEventRetention).UTC()); err != nil {
+				log.Printf("Error pruning replica events: %v", err)
+			}
+			pruned = now
+		}
+	}
+}
+
+// campaign takes or renews the lease if it is free, expired or already held by this replica,
+// and records who holds it
+func (e *leaderElection) campaign(now time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO leader_lease (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leader_lease.holder = excluded.holder OR leader_lease.expires_at < ?`,
+		// Replicas may run in different time zones, and timestamps compare as text
+		leaderLeaseName, e.nodeID, now.Add(e.lease).UTC(), now.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	var holder string
+	var expiresAt time.Time
+	err = db.QueryRow(`SELECT holder, expires_at FROM leader_lease WHERE name = ?`, leaderLeaseName).Scan(&holder, &expiresAt)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	wasLeader := e.holder == e.nodeID
+	e.holder, e.expiresAt = holder, expiresAt
+	if isLeader := holder == e.nodeID; isLeader != wasLeader {
+		e.changes++
+		if isLeader {
+			log.Printf("Node %s is now the leader", e.nodeID)
+		} else {
+			log.Printf("Node %s lost leadership to %s", e.nodeID, holder)
+		}
+	}
+	return nil
+}
+
+// isLeader reports whether this replica holds an unexpired lease. A leader that cannot renew
+// steps down when its lease runs out, before another replica can take over.
+func (e *leaderElection) isLeader(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.holder == e.nodeID && now.Before(e.expiresAt)
+}
+
+// leader returns the replica that held the lease at the last campaign, and the number of
+// times this replica has gained or lost leadership
+func (e *leaderElection) leader() (string, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.holder, e.changes
+}
+
+// isLeader reports whether this replica should run the singleton background tasks: the
+// reaper, webhook delivery and scheduled backups. Without local replicas or raft there is only one replica.
+func isLeader() bool {
+	if cluster != nil {
+		return cluster.isLeader()
+	}
+	return leadership == nil || leadership.isLeader(time.Now())
+}
+
+// role reports this replica's role for /health
+func role() string {
+	switch {
+	case cluster != nil && cluster.isLeader():
+		return RoleLeader
+	case cluster != nil:
+		return RoleFollower
+	case leadership == nil:
+		return RoleStandalone
+	case leadership.isLeader(time.Now()):
+		return RoleLeader
+	default:
+		return RoleFollower
+	}
+}
+
+// defaultNodeID names a replica after its host and process, so replicas sharing a host differ
+func defaultNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "registry"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// isMemoryDatasource reports whether a SQLite datasource names an in-memory database
+func isMemoryDatasource(datasource string) bool {
+	path := databasePath(datasource)
+	return path == "" || path == ":memory:" || strings.Contains(datasource, "mode=memory")
+}
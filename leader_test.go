@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLeaderElectionFailover(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+
+	a := newLeaderElection("a", 15*time.Second)
+	b := newLeaderElection("b", 15*time.Second)
+	start := time.Now()
+
+	campaign := func(e *leaderElection, at time.Duration) {
+		t.Helper()
+		if err := e.campaign(start.Add(at)); err != nil {
+			t.Fatalf("%s campaign at +%s: %v", e.nodeID, at, err)
+		}
+	}
+
+	campaign(a, 0)
+	campaign(b, time.Second)
+	if !a.isLeader(start.Add(time.Second)) || b.isLeader(start.Add(time.Second)) {
+		t.Fatal("the first replica to campaign should lead")
+	}
+
+	// Renewing keeps the lease past its original expiry
+	campaign(a, 10*time.Second)
+	campaign(b, 20*time.Second)
+	if !a.isLeader(start.Add(20*time.Second)) || b.isLeader(start.Add(20*time.Second)) {
+		t.Fatal("a renewed its lease and should still lead")
+	}
+
+	// a stops renewing: it steps down when its lease runs out, and b takes over after that
+	if a.isLeader(start.Add(26 * time.Second)) {
+		t.Fatal("a leads past the end of its lease")
+	}
+	campaign(b, 26*time.Second)
+	if !b.isLeader(start.Add(26 * time.Second)) {
+		t.Fatal("b did not take over the expired lease")
+	}
+
+	campaign(a, 27*time.Second)
+	if a.isLeader(start.Add(27*time.Second)) || !b.isLeader(start.Add(27*time.Second)) {
+		t.Fatal("a took the lease back from b")
+	}
+	if leader, changes := a.leader(); leader != "b" || changes != 2 {
+		t.Fatalf("a sees leader %q after %d changes, want b after 2", leader, changes)
+	}
+}
+
+func TestHealthReportsRole(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	t.Cleanup(func() { leadership = nil })
+
+	health := func() map[string]string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		var body map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("health response: %v", err)
+		}
+		return body
+	}
+
+	if got := health()["role"]; got != RoleStandalone {
+		t.Errorf("role without local replicas = %q, want standalone", got)
+	}
+
+	other := newLeaderElection("other", time.Minute)
+	if err := other.campaign(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	leadership = newLeaderElection("me", time.Minute)
+	if err := leadership.campaign(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := health(); got["role"] != RoleFollower || got["leader"] != "other" || got["node_id"] != "me" {
+		t.Errorf("follower health = %v", got)
+	}
+	if isLeader() {
+		t.Error("a follower would run the reaper")
+	}
+}
+
+func TestFollowerWatchersSeeOtherReplicasEvents(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	bus := useEventBus(t, 16)
+	leadership = newLeaderElection("follower", time.Minute)
+	t.Cleanup(func() { leadership = nil })
+	_, _, start, _ := bus.since(0, EventFilter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lost := make(chan Event, 1)
+	go watchLeaseLoss(ctx, "a", start, func(e Event) error {
+		lost <- e
+		return nil
+	})
+
+	// The follower serves an allocation itself, and the leader reaps a's lease
+	if _, err := allocateIdentifiers(DefaultPool, "b", 1, 0, nil, time.Now()); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	reap := Event{Type: EventReap, Time: time.Now(), Pool: DefaultPool, ClientID: "a", Identifier: "vm-2"}
+	if err := recordReplicaEvents(db, "leader", []Event{reap}); err != nil {
+		t.Fatalf("record leader events: %v", err)
+	}
+
+	cursor, err := pollReplicaEvents("follower", 0)
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	select {
+	case e := <-lost:
+		if e.Type != EventReap || e.Identifier != "vm-2" {
+			t.Fatalf("lease loss stream got %+v, want the reap of vm-2", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the follower's lease loss stream missed the leader's reap")
+	}
+
+	resp := decodePoll(t, pollClient(t, "a", start, ""))
+	if len(resp.Events) != 1 || resp.Events[0].Type != EventReap || resp.Events[0].ID <= start {
+		t.Fatalf("follower watch for a = %+v, want the reap", resp)
+	}
+	// The follower's own events are not published twice
+	resp = decodePoll(t, pollClient(t, "b", start, ""))
+	if len(resp.Events) != 1 || resp.Events[0].Type != EventAllocate {
+		t.Fatalf("follower watch for b = %+v, want one allocation", resp)
+	}
+
+	// Polling again publishes nothing new
+	if next, err := pollReplicaEvents("follower", cursor); err != nil || next != cursor {
+		t.Fatalf("second poll = %d, %v; want cursor %d", next, err, cursor)
+	}
+	if _, _, last, _ := bus.since(0, EventFilter{}); last != start+2 {
+		t.Fatalf("bus at %d, want %d after two events", last, start+2)
+	}
+}
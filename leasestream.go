@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// leasePingInterval is how often a streaming lease connection is pinged. A ping that gets no
+// answer within the interval counts as a disconnect.
+const leasePingInterval = 2 * time.Second
+
+// Types of LeaseStreamMessage
+const (
+	LeaseStreamAllocated = "allocated"
+	LeaseStreamLost      = "lost"
+	LeaseStreamReset     = "reset"
+	LeaseStreamError     = "error"
+	LeaseStreamRelease   = "release"
+)
+
+// LeaseStreamMessage is a JSON message sent on a streaming lease connection
+type LeaseStreamMessage struct {
+	Type        string   `json:"type"`
+	Identifiers []string `json:"identifiers,omitempty"`
+	Identifier  string   `json:"identifier,omitempty"`
+	Owner       string   `json:"owner,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// streamConn is one streaming lease connection and the identifiers it was allocated
+type streamConn struct {
+	identifiers []string
+	// timer releases the identifiers once the grace period after a disconnect has passed
+	timer *time.Timer
+}
+
+// streamSession is the streaming lease state of one client, which may hold several connections,
+// for instance one per pool
+type streamSession struct {
+	open    map[*streamConn]struct{}
+	dropped map[*streamConn]struct{}
+}
+
+// holds reports whether an open connection of the session holds identifier
+func (s *streamSession) holds(identifier string) bool {
+	for conn := range s.open {
+		if slices.Contains(conn.identifiers, identifier) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamSessions tracks the clients holding streaming leases. It is kept in memory by the
+// process that serves the connections, so only a reconnect to the same process cancels a
+// pending release; with local replicas or raft a client that reconnects to another node has
+// its identifiers released after the grace period, and is told that it lost them.
+type streamSessions struct {
+	mu      sync.Mutex
+	clients map[string]*streamSession
+	// running counts the connections being served and the releases pending after a disconnect
+	running int
+	idle    *sync.Cond
+}
+
+var streamLeases = newStreamSessions()
+
+func newStreamSessions() *streamSessions {
+	s := &streamSessions{clients: make(map[string]*streamSession)}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// begin counts a connection being served
+func (s *streamSessions) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running++
+}
+
+// end uncounts a connection that has been served
+func (s *streamSessions) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished()
+}
+
+// finished uncounts a connection or a pending release; s.mu must be held
+func (s *streamSessions) finished() {
+	s.running--
+	if s.running == 0 {
+		s.idle.Broadcast()
+	}
+}
+
+// wait blocks until every connection has been served and every pending release has run
+func (s *streamSessions) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.running > 0 {
+		s.idle.Wait()
+	}
+}
+
+// connect registers a connection for the client, cancelling the pending release of any
+// dropped connection whose identifiers it holds again
+func (s *streamSessions) connect(clientID string, identifiers []string) *streamConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.clients[clientID]
+	if !ok {
+		session = &streamSession{open: make(map[*streamConn]struct{}), dropped: make(map[*streamConn]struct{})}
+		s.clients[clientID] = session
+	}
+	conn := &streamConn{identifiers: identifiers}
+	session.open[conn] = struct{}{}
+
+	for dropped := range session.dropped {
+		if slices.ContainsFunc(dropped.identifiers, func(identifier string) bool { return slices.Contains(identifiers, identifier) }) {
+			if dropped.timer.Stop() {
+				s.finished()
+			}
+			delete(session.dropped, dropped)
+			log.Printf("Streaming lease for client %s resumed", clientID)
+		}
+	}
+	return conn
+}
+
+// drop handles a lost connection. Its identifiers are released after the grace period, unless
+// the client reconnects for them first or another of its connections holds them.
+func (s *streamSessions) drop(clientID string, conn *streamConn, grace time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := s.clients[clientID]
+	delete(session.open, conn)
+	session.dropped[conn] = struct{}{}
+	s.running++
+	conn.timer = time.AfterFunc(grace, func() {
+		defer s.end()
+		s.expire(clientID, conn)
+	})
+	log.Printf("Streaming lease for client %s disconnected, releasing in %s unless it reconnects", clientID, grace)
+}
+
+// close handles a connection whose client released its identifiers itself
+func (s *streamSessions) close(clientID string, conn *streamConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := s.clients[clientID]
+	delete(session.open, conn)
+	if len(session.open) == 0 && len(session.dropped) == 0 {
+		delete(s.clients, clientID)
+	}
+}
+
+func (s *streamSessions) expire(clientID string, conn *streamConn) {
+	s.mu.Lock()
+	session, ok := s.clients[clientID]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	if _, ok := session.dropped[conn]; !ok {
+		// The client reconnected in the meantime
+		s.mu.Unlock()
+		return
+	}
+	delete(session.dropped, conn)
+	var identifiers []string
+	for _, identifier := range conn.identifiers {
+		if !session.holds(identifier) {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+	if len(session.open) == 0 && len(session.dropped) == 0 {
+		delete(s.clients, clientID)
+	}
+	s.mu.Unlock()
+
+	reaped, err := reapClientIdentifiers(clientID, identifiers, time.Now())
+	if err != nil {
+		log.Printf("Error releasing streaming lease for client %s: %v", clientID, err)
+		return
+	}
+	log.Printf("Streaming lease for client %s expired, released %d identifier(s)", clientID, len(reaped))
+}
+
+// leaseStreamHandler holds a lease for as long as a WebSocket connection stays open.
+// The client sends an AllocateRequest as its first message and receives an "allocated"
+// message; from then on the connection is the heartbeat. The client may send "release"
+// to give the identifiers back, and receives "lost" if an identifier is taken from it, or
+// "reset" before the connection is closed if a loss may have gone unreported.
+func leaseStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Counted before the connection is hijacked, so that a server shutting down sees it
+	streamLeases.begin()
+	defer streamLeases.end()
+
+	// The connection outlives the server's read and write timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		log.Printf("Error accepting streaming lease: %v", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	grace := config.Server.StreamGracePeriod
+
+	// The handler returns only once the goroutines serving the connection have stopped
+	var serving sync.WaitGroup
+	defer serving.Wait()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var req AllocateRequest
+	readCtx, readCancel := context.WithTimeout(ctx, config.Server.StaleTimeout)
+	err = wsjson.Read(readCtx, conn, &req)
+	readCancel()
+	if err != nil {
+		conn.Close(websocket.StatusPolicyViolation, "expected an allocate request")
+		return
+	}
+
+	// Take the cursor first so that a loss right after allocating is not missed
+	_, _, cursor, _ := events.since(0, EventFilter{})
+
+	now := time.Now()
+	identifiers, err := allocate(req, now)
+	if err != nil {
+		closeLeaseStream(ctx, conn, err)
+		return
+	}
+
+	session := streamLeases.connect(req.ClientID, identifiers)
+	released := false
+	defer func() {
+		if released {
+			streamLeases.close(req.ClientID, session)
+		} else {
+			streamLeases.drop(req.ClientID, session, grace)
+		}
+	}()
+
+	// The connection stands in for liveness probes, which are written at the interval a
+	// polling client is advised to use rather than on every ping
+	pool, _ := config.Identifiers.Pool(req.Pool)
+	touchInterval := time.Duration(newLeaseExpiry(pool.leaseTTL(req.TTLSeconds), now).HeartbeatInterval) * time.Second
+	touched := now
+
+	if err := wsjson.Write(ctx, conn, LeaseStreamMessage{Type: LeaseStreamAllocated, Identifiers: identifiers}); err != nil {
+		return
+	}
+
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		err := watchLeaseLoss(ctx, req.ClientID, cursor, func(e Event) error {
+			return wsjson.Write(ctx, conn, LeaseStreamMessage{Type: LeaseStreamLost, Identifier: e.Identifier, Owner: e.Owner})
+		})
+		if err == errLeaseWatchBehind {
+			// A loss may have gone unreported. The client reconnects within the grace period
+			// and is told which identifiers it holds now.
+			wsjson.Write(ctx, conn, LeaseStreamMessage{Type: LeaseStreamReset, Error: err.Error()})
+			conn.Close(websocket.StatusTryAgainLater, "lease events were missed")
+		}
+	}()
+
+	// Reading also answers pings, so it runs until the connection goes away
+	releaseRequested := make(chan struct{})
+	serving.Add(1)
+	go func() {
+		defer serving.Done()
+		for {
+			var msg LeaseStreamMessage
+			if err := wsjson.Read(ctx, conn, &msg); err != nil {
+				cancel()
+				return
+			}
+			if msg.Type == LeaseStreamRelease {
+				close(releaseRequested)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(leasePingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-releaseRequested:
+			for _, identifier := range identifiers {
+				if _, err := releaseIdentifiers(req.ClientID, identifier, time.Now()); err != nil {
+					conn.Close(websocket.StatusInternalError, "Failed to release identifier")
+					return
+				}
+			}
+			released = true
+			conn.Close(websocket.StatusNormalClosure, "released")
+			return
+
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			pingCtx, pingCancel := context.WithTimeout(ctx, leasePingInterval)
+			err := conn.Ping(pingCtx)
+			pingCancel()
+			if err != nil {
+				return
+			}
+			if now := time.Now(); now.Sub(touched) >= touchInterval {
+				if _, err := touchClientIdentifiers(req.ClientID, identifiers, nil, now); err != nil {
+					log.Printf("Error updating liveness for client %s: %v", req.ClientID, err)
+				} else {
+					touched = now
+				}
+			}
+		}
+	}
+}
+
+// closeLeaseStream reports a failed allocation and closes the connection
+func closeLeaseStream(ctx context.Context, conn *websocket.Conn, err error) {
+	msg := LeaseStreamMessage{Type: LeaseStreamError, Error: "Internal server error"}
+	code := websocket.StatusInternalError
+
+	var invalid requestError
+	switch {
+	case errors.As(err, &invalid):
+		msg.Error, code = err.Error(), websocket.StatusPolicyViolation
+	case err == errUnknownPool:
+		msg.Error, code = "Unknown pool", websocket.StatusPolicyViolation
+	case err == sql.ErrNoRows:
+		msg.Error, code = "No available identifiers", websocket.StatusTryAgainLater
+	}
+
+	wsjson.Write(ctx, conn, msg)
+	conn.Close(code, msg.Error)
+}
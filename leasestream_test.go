@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// newLeaseStreamServer starts a registry server. Once the test is over it waits for every
+// streaming lease handler to return and every pending release to run, so that none of them
+// outlives the test's config and database.
+func newLeaseStreamServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		server.Close()
+		streamLeases.wait()
+	})
+	return server
+}
+
+// openLeaseStream connects to /lease/stream and allocates for clientID
+func openLeaseStream(t *testing.T, ctx context.Context, server *httptest.Server, clientID string) (*websocket.Conn, LeaseStreamMessage) {
+	t.Helper()
+	return openLeaseStreamFor(t, ctx, server, AllocateRequest{ClientID: clientID})
+}
+
+// openLeaseStreamFor connects to /lease/stream and sends req
+func openLeaseStreamFor(t *testing.T, ctx context.Context, server *httptest.Server, req AllocateRequest) (*websocket.Conn, LeaseStreamMessage) {
+	t.Helper()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/lease/stream", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := wsjson.Write(ctx, conn, req); err != nil {
+		t.Fatalf("send allocate request: %v", err)
+	}
+
+	var msg LeaseStreamMessage
+	if err := wsjson.Read(ctx, conn, &msg); err != nil {
+		t.Fatalf("read allocation: %v", err)
+	}
+	return conn, msg
+}
+
+func lockedBy(t *testing.T, identifier string) string {
+	t.Helper()
+
+	var owner *string
+	if err := db.QueryRow(`SELECT locked_by FROM identifiers WHERE identifier = ?`, identifier).Scan(&owner); err != nil {
+		t.Fatalf("read %s: %v", identifier, err)
+	}
+	if owner == nil {
+		return ""
+	}
+	return *owner
+}
+
+func TestLeaseStreamReleasesAfterGracePeriod(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	config.Server.StreamGracePeriod = 200 * time.Millisecond
+
+	server := newLeaseStreamServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, msg := openLeaseStream(t, ctx, server, "a")
+	if msg.Type != LeaseStreamAllocated || len(msg.Identifiers) != 1 || msg.Identifiers[0] != "vm-1" {
+		t.Fatalf("first message = %+v, want allocated vm-1", msg)
+	}
+
+	// A reconnect within the grace period keeps the identifier
+	conn.CloseNow()
+	time.Sleep(50 * time.Millisecond)
+	conn, msg = openLeaseStream(t, ctx, server, "a")
+	if msg.Type != LeaseStreamAllocated || msg.Identifiers[0] != "vm-1" {
+		t.Fatalf("after reconnect = %+v, want allocated vm-1", msg)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if owner := lockedBy(t, "vm-1"); owner != "a" {
+		t.Fatalf("vm-1 held by %q after reconnect, want a", owner)
+	}
+
+	// Without a reconnect the identifier is reaped once the grace period has passed
+	conn.CloseNow()
+	deadline := time.Now().Add(2 * time.Second)
+	for lockedBy(t, "vm-1") != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("vm-1 was not released after the grace period")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLeaseStreamRelease(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+
+	server := newLeaseStreamServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _ := openLeaseStream(t, ctx, server, "a")
+
+	// The pool is exhausted, so a second client is turned away
+	other, msg := openLeaseStream(t, ctx, server, "b")
+	if msg.Type != LeaseStreamError || msg.Error != "No available identifiers" {
+		t.Fatalf("second client got %+v, want an error", msg)
+	}
+	other.CloseNow()
+
+	if err := wsjson.Write(ctx, conn, LeaseStreamMessage{Type: LeaseStreamRelease}); err != nil {
+		t.Fatalf("send release: %v", err)
+	}
+	_, _, err := conn.Read(ctx)
+	if websocket.CloseStatus(err) != websocket.StatusNormalClosure {
+		t.Fatalf("read after release = %v, want a normal closure", err)
+	}
+	if owner := lockedBy(t, "vm-1"); owner != "" {
+		t.Fatalf("vm-1 still held by %q after release", owner)
+	}
+}
+
+func TestLeaseStreamTracksEachConnection(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	config.Identifiers.Pools = []PoolConfig{{Name: "gpu", Patterns: []string{"gpu-1"}, MaxPerClient: 1}}
+	preloadIdentifiers()
+	config.Server.StreamGracePeriod = 100 * time.Millisecond
+
+	server := newLeaseStreamServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// One client streams a lease in each pool
+	conn, msg := openLeaseStream(t, ctx, server, "a")
+	if msg.Type != LeaseStreamAllocated || msg.Identifiers[0] != "vm-1" {
+		t.Fatalf("default pool = %+v, want allocated vm-1", msg)
+	}
+	defer conn.CloseNow()
+	gpu, msg := openLeaseStreamFor(t, ctx, server, AllocateRequest{ClientID: "a", Pool: "gpu"})
+	if msg.Type != LeaseStreamAllocated || msg.Identifiers[0] != "gpu-1" {
+		t.Fatalf("gpu pool = %+v, want allocated gpu-1", msg)
+	}
+
+	// Dropping one connection releases its identifiers, even though the other stays open
+	gpu.CloseNow()
+	deadline := time.Now().Add(2 * time.Second)
+	for lockedBy(t, "gpu-1") != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("gpu-1 was not released after its connection dropped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if owner := lockedBy(t, "vm-1"); owner != "a" {
+		t.Fatalf("vm-1 held by %q, want a to keep it", owner)
+	}
+}
+
+func TestLeaseStreamResetsWhenEventsAreMissed(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	bus := useEventBus(t, 2)
+	server := newLeaseStreamServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _ := openLeaseStream(t, ctx, server, "a")
+	defer conn.CloseNow()
+
+	// More events than the history keeps arrive at once, so the watcher cannot tell whether
+	// one of them was a loss
+	bus.publish(
+		Event{Type: EventAllocate, ClientID: "b", Identifier: "vm-2"},
+		Event{Type: EventRelease, ClientID: "b", Identifier: "vm-2"},
+		Event{Type: EventAllocate, ClientID: "b", Identifier: "vm-2"},
+	)
+
+	var msg LeaseStreamMessage
+	if err := wsjson.Read(ctx, conn, &msg); err != nil || msg.Type != LeaseStreamReset {
+		t.Fatalf("message = %+v, %v; want reset", msg, err)
+	}
+	_, _, err := conn.Read(ctx)
+	if websocket.CloseStatus(err) != websocket.StatusTryAgainLater {
+		t.Fatalf("read after reset = %v, want the connection closed", err)
+	}
+}
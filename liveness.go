@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// LivenessStatus is the outcome of a single liveness probe
+type LivenessStatus string
+
+const (
+	LivenessOK           LivenessStatus = "ok"
+	LivenessReassociated LivenessStatus = "reassociated"
+	LivenessConflict     LivenessStatus = "conflict"
+	LivenessNotFound     LivenessStatus = "not_found"
+	LivenessInvalid      LivenessStatus = "invalid"
+)
+
+// livenessResult is the outcome of recordLiveness. Owner is the client that held the
+// identifier before the probe: the current owner on a conflict, or the previous owner
+// (possibly empty) when the identifier was reassociated. TTL is the lease's TTL after the probe.
+type livenessResult struct {
+	Status LivenessStatus
+	Owner  string
+	Pool   string
+	TTL    time.Duration
+}
+
+// recordLivenessEvents applies one liveness probe in its own transaction and publishes the
+// events it implies
+func recordLivenessEvents(req LivenessRequest, now time.Time) (livenessResult, error) {
+	var result livenessResult
+	_, err := commitEvents(func(tx *sql.Tx) ([]Event, error) {
+		var err error
+		result, err = recordLiveness(tx, req, now)
+		return livenessEvents(req, result), err
+	})
+	return result, err
+}
+
+// recordLiveness applies one liveness probe for a specific identifier
+func recordLiveness(q queryer, req LivenessRequest, now time.Time) (livenessResult, error) {
+	var lockedBy sql.NullString
+	var lastSeen sql.NullTime
+	var storedMetadata sql.NullString
+	var pool string
+	var storedTTL sql.NullInt64
+	var releasedAt sql.NullTime
+	var releasedBy sql.NullString
+
+	// Step 1: Check if the identifier exists and its current state
+	err := q.QueryRow(`
+		SELECT locked_by, last_seen, metadata, pool, ttl, released_at, released_by
+		FROM identifiers 
+		WHERE identifier = ?`,
+		req.Identifier,
+	).Scan(&lockedBy, &lastSeen, &storedMetadata, &pool, &storedTTL, &releasedAt, &releasedBy)
+
+	if err == sql.ErrNoRows {
+		// Identifier does not exist
+		log.Printf("Liveness probe failed: Identifier %s not found", req.Identifier)
+		return livenessResult{Status: LivenessNotFound}, nil
+	} else if err != nil {
+		return livenessResult{}, err
+	}
+
+	dbClientID := lockedBy.String
+	ttl := leaseTTL(storedTTL)
+
+	// Step 2: A quarantined identifier can only be reclaimed by the client that held it, which
+	// lets a partitioned VM recover its identifier without anyone else jumping the cooldown
+	if dbClientID == "" && releasedAt.Valid && releasedAt.Time.After(cooldownThreshold(now)) && releasedBy.String != req.ClientID {
+		log.Printf("Liveness probe rejected: Identifier %s is cooling down after release by %s, but %s attempted to claim it",
+			req.Identifier, releasedBy.String, req.ClientID)
+		return livenessResult{Status: LivenessConflict, Owner: releasedBy.String, Pool: pool, TTL: ttl}, nil
+	}
+
+	// Step 3: Handle stale or unallocated identifiers
+	if dbClientID == "" || (lastSeen.Valid && now.Sub(lastSeen.Time) > ttl) {
+		// Identifier is stale or unallocated; reassociate with the client.
+		// Metadata and the TTL left by a previous owner are discarded.
+		metadata := req.Metadata
+		if dbClientID == req.ClientID {
+			metadata = parseMetadata(storedMetadata).merge(req.Metadata)
+		} else {
+			p, _ := config.Identifiers.Pool(pool)
+			ttl = p.leaseTTL(0)
+		}
+
+		_, err := q.Exec(`
+			UPDATE identifiers 
+			SET locked_by = ?, last_seen = ?, metadata = ?, ttl = ?, released_by = NULL
+			WHERE identifier = ?`,
+			req.ClientID, now, metadata, ttlColumn(ttl), req.Identifier,
+		)
+		if err != nil {
+			return livenessResult{}, err
+		}
+
+		log.Printf("Reassociated stale identifier %s with client %s", req.Identifier, req.ClientID)
+		return livenessResult{Status: LivenessReassociated, Owner: dbClientID, Pool: pool, TTL: ttl}, nil
+	}
+
+	// Step 4: Validate client ownership
+	if dbClientID != req.ClientID {
+		// ClientID does not match the current owner
+		log.Printf("Liveness probe mismatch: Identifier %s locked by %s, but %s attempted to claim it",
+			req.Identifier, dbClientID, req.ClientID)
+		return livenessResult{Status: LivenessConflict, Owner: dbClientID, Pool: pool, TTL: ttl}, nil
+	}
+
+	// Step 5: Update last_seen for valid liveness probe, along with any new metadata
+	if len(req.Metadata) > 0 {
+		_, err = q.Exec(`
+			UPDATE identifiers 
+			SET last_seen = ?, metadata = ?
+			WHERE identifier = ? AND locked_by = ?`,
+			now, parseMetadata(storedMetadata).merge(req.Metadata), req.Identifier, req.ClientID,
+		)
+	} else {
+		_, err = q.Exec(`
+			UPDATE identifiers 
+			SET last_seen = ?
+			WHERE identifier = ? AND locked_by = ?`,
+			now, req.Identifier, req.ClientID,
+		)
+	}
+	if err != nil {
+		return livenessResult{}, err
+	}
+
+	log.Printf("Liveness updated: Identifier=%s, ClientID=%s", req.Identifier, req.ClientID)
+	return livenessResult{Status: LivenessOK, Owner: dbClientID, Pool: pool, TTL: ttl}, nil
+}
@@ -3,49 +3,88 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"time"
 )
 
 var config *Config
 
+// startTime is reported as uptime by /health
+var startTime = time.Now()
+
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	var err error
 	config, err = LoadConfig("config.yaml")
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Initialize Database
-	initDB()
-
+	prepareDatabase()
 	defer db.Close()
 
-	// Preload Identifiers
-	preloadIdentifiers()
-
-	// HTTP Handlers
-	mux := http.NewServeMux()
-	mux.HandleFunc("/allocate", allocateHandler)
-	mux.HandleFunc("/client/{client_id}", clientDetailsHandler)
-	mux.HandleFunc("/identifier/{identifier}", identifierDetailsHandler)
-	mux.HandleFunc("/allocated", allocatedHandler)
-	mux.HandleFunc("/identifiers", identifiersHandler)
-	mux.HandleFunc("/liveness", livenessHandler)
-	mux.HandleFunc("/release", releaseHandler)
-	mux.HandleFunc("/stats", statsHandler)
-
 	// Start HTTP Server
 	server := &http.Server{
 		Addr:         config.Server.Address,
-		Handler:      mux,
+		Handler:      newRouter(),
 		IdleTimeout:  config.Server.IdleTimeout,
 		ReadTimeout:  config.Server.ReadTimeout,
 		WriteTimeout: config.Server.WriteTimeout,
 	}
 
+	startRaft()
+	startLeaderElection()
+	startHeartbeatBuffer()
 	go releaseStaleIdentifiers()
+	startCapacityMonitor()
+	startWebhookDispatcher()
+	startBackupScheduler()
+	startGRPCServer()
 
 	log.Printf("Server started on %s", config.Server.Address)
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Server failed: %s", err)
 	}
 }
+
+// prepareDatabase initializes the database and preloads identifiers. Leases that could not be
+// renewed while the registry was down are extended before any listener starts, so that the
+// first requests do not find them stale.
+func prepareDatabase() {
+	initDB()
+	preloadIdentifiers()
+
+	if err := resumeLeases(time.Now()); err != nil {
+		log.Fatalf("Failed to extend leases after downtime: %v", err)
+	}
+}
+
+// newRouter registers every HTTP handler
+func newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/allocate", allocateHandler)
+	mux.HandleFunc("/client/{client_id}", clientDetailsHandler)
+	mux.HandleFunc("/identifier/{identifier}", identifierDetailsHandler)
+	mux.HandleFunc("/allocated", allocatedHandler)
+	mux.HandleFunc("/identifiers", identifiersHandler)
+	mux.HandleFunc("/liveness", livenessHandler)
+	mux.HandleFunc("/liveness/batch", livenessBatchHandler)
+	mux.HandleFunc("/release", releaseHandler)
+	mux.HandleFunc("/lease/stream", leaseStreamHandler)
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/watch", watchHandler)
+	mux.HandleFunc("/watch/{client_id}", watchClientHandler)
+	mux.HandleFunc("/webhooks", adminHandler(webhooksHandler))
+	mux.HandleFunc("/webhooks/deliveries", adminHandler(webhookDeliveriesHandler))
+	mux.HandleFunc("/webhooks/deliveries/{id}/retry", adminHandler(webhookRetryHandler))
+	mux.HandleFunc("/export", adminHandler(exportHandler))
+	mux.HandleFunc("/admin/backup", adminHandler(backupHandler))
+	mux.HandleFunc("/admin/reap", adminHandler(reapHandler))
+	mux.HandleFunc("/admin/raft", adminHandler(clusterHandler((*raftNode).statusHandler)))
+	mux.HandleFunc("/openapi.json", openapiHandler)
+	return mux
+}
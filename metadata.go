@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Metadata holds the key/value labels a client attaches to its allocation
+type Metadata map[string]string
+
+// Value encodes the labels for storage, storing NULL when there are none
+func (m Metadata) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+// parseMetadata decodes a stored metadata column
+func parseMetadata(column sql.NullString) Metadata {
+	if !column.Valid || column.String == "" {
+		return nil
+	}
+	var m Metadata
+	if err := json.Unmarshal([]byte(column.String), &m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// orEmpty returns m, or an empty map if m is nil, so that it encodes as {} rather than null
+func (m Metadata) orEmpty() Metadata {
+	if m == nil {
+		return Metadata{}
+	}
+	return m
+}
+
+// merge returns a copy of m updated with the keys in update. An empty value removes the key.
+func (m Metadata) merge(update Metadata) Metadata {
+	merged := make(Metadata, len(m)+len(update))
+	for k, v := range m {
+		merged[k] = v
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(merged, k)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// validateMetadata rejects labels with empty keys or keys that cannot be used in a selector
+func validateMetadata(m Metadata) error {
+	for k := range m {
+		if k == "" {
+			return fmt.Errorf("metadata keys must not be empty")
+		}
+		if strings.ContainsAny(k, ",=! ") {
+			return fmt.Errorf("invalid metadata key %q", k)
+		}
+	}
+	return nil
+}
+
+// selectorRequirement is one comma-separated term of a label selector
+type selectorRequirement struct {
+	key      string
+	value    string
+	operator string // "=", "!=", "exists" or "!exists"
+}
+
+// Selector filters allocations by their metadata, e.g. "az=us-east-1a,asg!=canary,build"
+type Selector []selectorRequirement
+
+// parseSelector parses a comma-separated list of key=value, key!=value, key and !key terms
+func parseSelector(raw string) (Selector, error) {
+	var selector Selector
+	for _, term := range strings.Split(raw, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var req selectorRequirement
+		switch {
+		case strings.Contains(term, "!="):
+			parts := strings.SplitN(term, "!=", 2)
+			req = selectorRequirement{key: parts[0], value: parts[1], operator: "!="}
+		case strings.Contains(term, "=="):
+			parts := strings.SplitN(term, "==", 2)
+			req = selectorRequirement{key: parts[0], value: parts[1], operator: "="}
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(term, "=", 2)
+			req = selectorRequirement{key: parts[0], value: parts[1], operator: "="}
+		case strings.HasPrefix(term, "!"):
+			req = selectorRequirement{key: term[1:], operator: "!exists"}
+		default:
+			req = selectorRequirement{key: term, operator: "exists"}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if req.key == "" {
+			return nil, fmt.Errorf("invalid selector term %q", term)
+		}
+		selector = append(selector, req)
+	}
+	return selector, nil
+}
+
+// where returns SQL conditions on the metadata column that hold when it satisfies every
+// requirement of the selector
+func (s Selector) where() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	for _, req := range s {
+		switch req.operator {
+		case "=":
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(metadata) WHERE key = ? AND value = ?)")
+			args = append(args, req.key, req.value)
+		case "!=":
+			conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM json_each(metadata) WHERE key = ? AND value = ?)")
+			args = append(args, req.key, req.value)
+		case "exists":
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(metadata) WHERE key = ?)")
+			args = append(args, req.key)
+		case "!exists":
+			conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM json_each(metadata) WHERE key = ?)")
+			args = append(args, req.key)
+		}
+	}
+	return conditions, args
+}
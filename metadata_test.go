@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectorWhere(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1", "vm-2")
+	labels := Metadata{"az": "us-east-1a", "asg": "build", "version": "1.4.2"}
+	if _, err := allocateNextIdentifier(db, DefaultPool, "a", 0, labels, time.Now()); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"az=us-east-1a", true},
+		{"az==us-east-1a", true},
+		{"az=us-east-1b", false},
+		{"az=us-east-1a,asg=build", true},
+		{"az=us-east-1a,asg=canary", false},
+		{"asg!=canary", true},
+		{"asg!=build", false},
+		{"version", true},
+		{"instance_id", false},
+		{"!instance_id", true},
+		{"!az", false},
+	}
+
+	for _, tt := range tests {
+		selector, err := parseSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("parseSelector(%q): %v", tt.selector, err)
+		}
+		matched, _, _, err := listIdentifiers(identifierQuery{Selector: selector, State: StateAllocated, Sort: "identifier"}, time.Now())
+		if err != nil {
+			t.Fatalf("list %q: %v", tt.selector, err)
+		}
+		if got := len(matched) == 1; got != tt.want {
+			t.Errorf("%q matches = %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+
+	if _, err := parseSelector("=value"); err == nil {
+		t.Error("expected error for selector term without a key")
+	}
+}
+
+func TestMetadataMerge(t *testing.T) {
+	merged := Metadata{"az": "us-east-1a", "ip": "10.0.0.1"}.merge(Metadata{"ip": "10.0.0.2", "az": ""})
+
+	if len(merged) != 1 || merged["ip"] != "10.0.0.2" {
+		t.Fatalf("merged = %v, want only ip=10.0.0.2", merged)
+	}
+}
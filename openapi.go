@@ -0,0 +1,21 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openapiSpec is the OpenAPI 3 description of the HTTP API, validated against the handlers in openapi_test.go
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+func openapiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapiSpec)
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// apiSpec is the subset of an OpenAPI document the tests validate against
+type apiSpec struct {
+	Paths      map[string]map[string]apiOperation `json:"paths"`
+	Components struct {
+		Schemas    map[string]map[string]interface{} `json:"schemas"`
+		Responses  map[string]apiResponse            `json:"responses"`
+		Parameters map[string]interface{}            `json:"parameters"`
+		Headers    map[string]apiHeader              `json:"headers"`
+	} `json:"components"`
+}
+
+type apiOperation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema map[string]interface{} `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]apiResponse `json:"responses"`
+}
+
+type apiResponse struct {
+	Ref     string               `json:"$ref"`
+	Headers map[string]apiHeader `json:"headers"`
+	Content map[string]struct {
+		Schema map[string]interface{} `json:"schema"`
+	} `json:"content"`
+}
+
+type apiHeader struct {
+	Ref      string `json:"$ref"`
+	Required bool   `json:"required"`
+}
+
+func loadSpec(t *testing.T) *apiSpec {
+	t.Helper()
+
+	var spec apiSpec
+	if err := json.Unmarshal(openapiSpec, &spec); err != nil {
+		t.Fatalf("parse openapi.json: %v", err)
+	}
+	return &spec
+}
+
+// resolve follows a local "#/components/schemas/..." reference
+func (spec *apiSpec) resolve(schema map[string]interface{}) map[string]interface{} {
+	for {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema
+		}
+		schema = spec.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")]
+	}
+}
+
+// validate checks value against a JSON schema, supporting the keywords openapi.json uses
+func (spec *apiSpec) validate(schema map[string]interface{}, value interface{}, path string) []string {
+	schema = spec.resolve(schema)
+	if schema == nil {
+		return []string{path + ": unresolvable schema"}
+	}
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable {
+			return nil
+		}
+		return []string{path + ": null is not allowed"}
+	}
+
+	var errs []string
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected object, got %T", path, value))
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := object[name.(string)]; !ok {
+					errs = append(errs, fmt.Sprintf("%s: missing required property %q", path, name))
+				}
+			}
+		}
+		for name, v := range object {
+			if property, ok := properties[name].(map[string]interface{}); ok {
+				errs = append(errs, spec.validate(property, v, path+"."+name)...)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					errs = append(errs, fmt.Sprintf("%s: undocumented property %q", path, name))
+				}
+			case map[string]interface{}:
+				errs = append(errs, spec.validate(additional, v, path+"."+name)...)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected array, got %T", path, value))
+		}
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(array)) > max {
+			errs = append(errs, fmt.Sprintf("%s: more than %v items", path, max))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, v := range array {
+				errs = append(errs, spec.validate(items, v, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected string, got %T", path, value))
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a date-time", path, s))
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected number, got %T", path, value))
+		}
+		if schema["type"] == "integer" && n != math.Trunc(n) {
+			errs = append(errs, fmt.Sprintf("%s: %v is not an integer", path, n))
+		}
+		if min, ok := schema["minimum"].(float64); ok && n < min {
+			errs = append(errs, fmt.Sprintf("%s: %v is below the minimum %v", path, n, min))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected boolean, got %T", path, value))
+		}
+	}
+	return errs
+}
+
+// apiCase is one request against the real router and the status it should get
+type apiCase struct {
+	method string
+	// route is the path template in openapi.json that path matches
+	route  string
+	path   string
+	body   string
+	status int
+	// malformed skips validating the request body, for cases that send invalid requests on purpose
+	malformed bool
+	// stream cuts the request off after a moment, for endpoints that never finish on their own
+	stream bool
+	// websocket dials the path as a WebSocket client over a real connection
+	websocket bool
+	// admin sends server.admin_token
+	admin bool
+}
+
+func (spec *apiSpec) check(t *testing.T, router http.Handler, c apiCase) {
+	t.Helper()
+	name := fmt.Sprintf("%s %s", c.method, c.path)
+
+	op, ok := spec.Paths[c.route][strings.ToLower(c.method)]
+	if !ok && c.status != http.StatusMethodNotAllowed {
+		t.Errorf("%s: %s %s is not in the spec", name, c.method, c.route)
+		return
+	}
+
+	if c.body != "" && !c.malformed {
+		if op.RequestBody == nil {
+			t.Errorf("%s: the spec documents no request body", name)
+		} else {
+			var body interface{}
+			if err := json.Unmarshal([]byte(c.body), &body); err != nil {
+				t.Fatalf("%s: test body is not JSON: %v", name, err)
+			}
+			for _, e := range spec.validate(op.RequestBody.Content["application/json"].Schema, body, "request") {
+				t.Errorf("%s: %s", name, e)
+			}
+		}
+	}
+
+	if c.websocket {
+		server := httptest.NewServer(router)
+		defer streamLeases.wait()
+		defer server.Close()
+
+		conn, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http")+c.path, nil)
+		if err != nil {
+			t.Errorf("%s: dial: %v", name, err)
+			return
+		}
+		conn.CloseNow()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status %d, want %d", name, resp.StatusCode, c.status)
+		} else if _, ok := op.Responses[fmt.Sprint(resp.StatusCode)]; !ok {
+			t.Errorf("%s: status %d is not documented", name, resp.StatusCode)
+		}
+		return
+	}
+
+	req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+	if c.admin {
+		req.Header.Set("Authorization", "Bearer "+config.Server.AdminToken)
+	}
+	if c.stream {
+		ctx, cancel := context.WithTimeout(req.Context(), 50*time.Millisecond)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != c.status {
+		t.Errorf("%s: status %d, want %d (%s)", name, rec.Code, c.status, strings.TrimSpace(rec.Body.String()))
+		return
+	}
+	if !ok {
+		return
+	}
+
+	resp, ok := op.Responses[fmt.Sprint(rec.Code)]
+	if !ok {
+		t.Errorf("%s: status %d is not documented", name, rec.Code)
+		return
+	}
+	if resp.Ref != "" {
+		resp = spec.Components.Responses[strings.TrimPrefix(resp.Ref, "#/components/responses/")]
+	}
+
+	for header, h := range resp.Headers {
+		if h.Ref != "" {
+			h = spec.Components.Headers[strings.TrimPrefix(h.Ref, "#/components/headers/")]
+		}
+		if h.Required && rec.Header().Get(header) == "" {
+			t.Errorf("%s: missing required header %s", name, header)
+		}
+	}
+
+	if len(resp.Content) == 0 {
+		if rec.Body.Len() > 0 {
+			t.Errorf("%s: undocumented response body %q", name, rec.Body.String())
+		}
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	content, ok := resp.Content[mediaType]
+	if !ok {
+		t.Errorf("%s: undocumented content type %q", name, mediaType)
+		return
+	}
+	if mediaType == "application/x-ndjson" {
+		// Each line is a document of the schema
+		for i, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+			var body interface{}
+			if err := json.Unmarshal([]byte(line), &body); err != nil {
+				t.Errorf("%s: line %d is not JSON: %v", name, i+1, err)
+				continue
+			}
+			for _, e := range spec.validate(content.Schema, body, fmt.Sprintf("response line %d", i+1)) {
+				t.Errorf("%s: %s", name, e)
+			}
+		}
+		return
+	}
+	if mediaType != "application/json" {
+		return
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Errorf("%s: response is not JSON: %v", name, err)
+		return
+	}
+	for _, e := range spec.validate(content.Schema, body, "response") {
+		t.Errorf("%s: %s", name, e)
+	}
+}
+
+func TestHandlersMatchOpenAPISpec(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-5]")
+	config.Identifiers.MaxPerClient = 2
+	config.Server.AllocationMaxWait = time.Minute
+	config.Webhooks = []WebhookConfig{{Name: "ops", URL: "http://127.0.0.1:1", Timeout: time.Second, MaxAttempts: 1}}
+	config.Database.Backup = BackupConfig{Directory: t.TempDir(), Retain: 1}
+	config.Server.AdminToken = "admin-token"
+
+	spec := loadSpec(t)
+	router := newRouter()
+
+	// Covered records every documented operation that returned a success
+	covered := make(map[string]bool)
+	run := func(cases ...apiCase) {
+		t.Helper()
+		for _, c := range cases {
+			spec.check(t, router, c)
+			if c.status < 300 {
+				covered[strings.ToLower(c.method)+" "+c.route] = true
+			}
+		}
+	}
+
+	run(
+		apiCase{method: "GET", route: "/identifiers", path: "/identifiers", status: 200},
+		apiCase{method: "GET", route: "/allocated", path: "/allocated", status: 200},
+		apiCase{method: "GET", route: "/identifier/{identifier}", path: "/identifier/vm-1", status: 200},
+
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "a", "metadata": {"az": "us-east-1a"}}`, status: 200},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "b", "count": 2}`, status: 200},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "c", "pool": "missing"}`, status: 404},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "c", "count": 3}`, status: 400},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "c"`, status: 400, malformed: true},
+		apiCase{method: "GET", route: "/allocate", path: "/allocate", status: 405},
+
+		apiCase{method: "GET", route: "/allocated", path: "/allocated?selector=az=us-east-1a", status: 200},
+		apiCase{method: "GET", route: "/allocated", path: "/allocated?selector==x", status: 400},
+		apiCase{method: "GET", route: "/identifiers", path: "/identifiers?selector=!az", status: 200},
+		apiCase{method: "GET", route: "/identifiers", path: "/identifiers?state=free&pool=default&sort=-identifier&limit=2", status: 200},
+		apiCase{method: "GET", route: "/identifiers", path: "/identifiers?state=busy", status: 400},
+		apiCase{method: "GET", route: "/identifiers", path: "/identifiers?limit=0", status: 400},
+		apiCase{method: "GET", route: "/allocated", path: "/allocated?client_prefix=a&stale=false&sort=last_seen", status: 200},
+		apiCase{method: "GET", route: "/allocated", path: "/allocated?state=free", status: 400},
+		apiCase{method: "GET", route: "/allocated", path: "/allocated?last_seen_after=yesterday", status: 400},
+		apiCase{method: "GET", route: "/client/{client_id}", path: "/client/a", status: 200},
+		apiCase{method: "GET", route: "/client/{client_id}", path: "/client/b", status: 200},
+		apiCase{method: "GET", route: "/client/{client_id}", path: "/client/nobody", status: 404},
+		apiCase{method: "GET", route: "/identifier/{identifier}", path: "/identifier/vm-1", status: 200},
+		apiCase{method: "GET", route: "/identifier/{identifier}", path: "/identifier/missing", status: 404},
+
+		apiCase{method: "POST", route: "/liveness", path: "/liveness", body: `{"client_id": "a", "identifier": "vm-1"}`, status: 200},
+		apiCase{method: "POST", route: "/liveness", path: "/liveness", body: `{"client_id": "b"}`, status: 200},
+		apiCase{method: "POST", route: "/liveness", path: "/liveness", body: `{"client_id": "nobody"}`, status: 404},
+		apiCase{method: "POST", route: "/liveness", path: "/liveness", body: `{"client_id": "b", "identifier": "vm-1"}`, status: 409},
+		apiCase{method: "POST", route: "/liveness", path: "/liveness", body: `{"client_id": "a", "identifier": "missing"}`, status: 404},
+		apiCase{method: "POST", route: "/liveness", path: "/liveness", body: `{"identifier": "vm-1"}`, status: 400, malformed: true},
+		apiCase{method: "GET", route: "/liveness", path: "/liveness", status: 405},
+		apiCase{method: "POST", route: "/liveness/batch", path: "/liveness/batch", body: `{"entries": [
+			{"client_id": "a", "identifier": "vm-1"},
+			{"client_id": "a", "identifier": "vm-2"},
+			{"client_id": "a", "identifier": "missing"},
+			{"client_id": "", "identifier": "vm-3"}
+		]}`, status: 200},
+		apiCase{method: "POST", route: "/liveness/batch", path: "/liveness/batch", body: `{"entries": []}`, status: 400},
+
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "d"}`, status: 200},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "e"}`, status: 200},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "f"}`, status: 503},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "f", "waitlist": true}`, status: 202},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "g", "wait": "10ms"}`, status: 503},
+		apiCase{method: "POST", route: "/allocate", path: "/allocate", body: `{"client_id": "g", "wait": "forever"}`, status: 400},
+		apiCase{method: "GET", route: "/stats", path: "/stats", status: 200},
+		apiCase{method: "GET", route: "/lease/stream", path: "/lease/stream", status: 101, websocket: true},
+		apiCase{method: "GET", route: "/lease/stream", path: "/lease/stream", status: 426},
+		apiCase{method: "POST", route: "/lease/stream", path: "/lease/stream", status: 405},
+		apiCase{method: "GET", route: "/health", path: "/health", status: 200},
+		apiCase{method: "POST", route: "/health", path: "/health", status: 405},
+
+		apiCase{method: "POST", route: "/release", path: "/release", body: `{"client_id": "a", "identifier": "vm-1"}`, status: 200},
+		apiCase{method: "POST", route: "/release", path: "/release", body: `{"client_id": "b"}`, status: 200},
+		apiCase{method: "POST", route: "/release", path: "/release", body: `{"identifier": "vm-1"}`, status: 400, malformed: true},
+		apiCase{method: "GET", route: "/identifiers", path: "/identifiers", status: 200},
+		apiCase{method: "GET", route: "/identifier/{identifier}", path: "/identifier/vm-1", status: 200},
+
+		apiCase{method: "GET", route: "/watch", path: "/watch?pool=default&types=allocate,release", status: 200, stream: true},
+		apiCase{method: "GET", route: "/watch", path: "/watch?cursor=abc", status: 400},
+		apiCase{method: "GET", route: "/watch", path: "/watch?cursor=1", status: 410},
+		apiCase{method: "GET", route: "/watch/{client_id}", path: "/watch/a?timeout=10ms", status: 200},
+		apiCase{method: "GET", route: "/watch/{client_id}", path: "/watch/a?timeout=forever", status: 400},
+		apiCase{method: "GET", route: "/watch/{client_id}", path: "/watch/a?cursor=1", status: 410},
+
+		apiCase{method: "GET", route: "/export", path: "/export", status: 200, admin: true},
+		apiCase{method: "GET", route: "/export", path: "/export?format=csv", status: 200, admin: true},
+		apiCase{method: "GET", route: "/export", path: "/export?format=xml", status: 400, admin: true},
+		apiCase{method: "GET", route: "/export", path: "/export", status: 401},
+		apiCase{method: "POST", route: "/export", path: "/export", status: 405, admin: true},
+		apiCase{method: "POST", route: "/admin/backup", path: "/admin/backup", status: 200, admin: true},
+		apiCase{method: "POST", route: "/admin/backup", path: "/admin/backup", status: 401},
+		apiCase{method: "GET", route: "/admin/backup", path: "/admin/backup", status: 405, admin: true},
+		apiCase{method: "POST", route: "/admin/reap", path: "/admin/reap", status: 200, admin: true},
+		apiCase{method: "POST", route: "/admin/reap", path: "/admin/reap", status: 401},
+		apiCase{method: "GET", route: "/admin/reap", path: "/admin/reap", status: 405, admin: true},
+		apiCase{method: "GET", route: "/admin/raft", path: "/admin/raft", status: 404, admin: true},
+		apiCase{method: "GET", route: "/admin/raft", path: "/admin/raft", status: 401},
+		apiCase{method: "GET", route: "/openapi.json", path: "/openapi.json", status: 200},
+	)
+
+	// A delivery that gave up can be retried
+	enqueueWebhookEvents(db, []Event{{ID: 1, Type: EventAllocate, Time: time.Now(), ClientID: "a", Identifier: "vm-1"}}, 0)
+	if err := deliverPendingWebhooks(time.Now()); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	var deliveryID int64
+	if err := db.QueryRow(`SELECT id FROM webhook_outbox WHERE status = ?`, DeliveryFailed).Scan(&deliveryID); err != nil {
+		t.Fatalf("find failed delivery: %v", err)
+	}
+	retry := fmt.Sprintf("/webhooks/deliveries/%d/retry", deliveryID)
+
+	run(
+		apiCase{method: "GET", route: "/webhooks", path: "/webhooks", status: 200, admin: true},
+		apiCase{method: "GET", route: "/webhooks", path: "/webhooks", status: 401},
+		apiCase{method: "GET", route: "/webhooks/deliveries", path: "/webhooks/deliveries?status=failed", status: 200, admin: true},
+		apiCase{method: "GET", route: "/webhooks/deliveries", path: "/webhooks/deliveries?limit=0", status: 400, admin: true},
+		apiCase{method: "GET", route: "/webhooks/deliveries", path: "/webhooks/deliveries", status: 401},
+		apiCase{method: "POST", route: "/webhooks/deliveries/{id}/retry", path: retry, status: 401},
+		apiCase{method: "POST", route: "/webhooks/deliveries/{id}/retry", path: retry, status: 200, admin: true},
+		apiCase{method: "POST", route: "/webhooks/deliveries/{id}/retry", path: retry, status: 404, admin: true},
+		apiCase{method: "POST", route: "/webhooks/deliveries/{id}/retry", path: "/webhooks/deliveries/abc/retry", status: 400, admin: true},
+		apiCase{method: "GET", route: "/webhooks/deliveries", path: "/webhooks/deliveries", status: 200, admin: true},
+	)
+
+	// The status of a single-node cluster
+	raftConfig := RaftConfig{Enabled: true, NodeID: 1, Peers: []RaftPeer{{ID: 1, URL: "http://127.0.0.1:1"}}, TickInterval: 10 * time.Millisecond}
+	raftConfig.applyDefaults()
+	node, err := newRaftNode(db, raftConfig, nil)
+	if err != nil {
+		t.Fatalf("start raft: %v", err)
+	}
+	cluster = node
+	defer func() {
+		cluster = nil
+		node.close()
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !node.isLeader() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	run(
+		apiCase{method: "GET", route: "/admin/raft", path: "/admin/raft", status: 200, admin: true},
+		apiCase{method: "POST", route: "/admin/raft", path: "/admin/raft", status: 405, admin: true},
+		apiCase{method: "GET", route: "/health", path: "/health", status: 200},
+		apiCase{method: "GET", route: "/stats", path: "/stats", status: 200},
+	)
+
+	var missing []string
+	for route, ops := range spec.Paths {
+		for method := range ops {
+			if !covered[method+" "+route] {
+				missing = append(missing, strings.ToUpper(method)+" "+route)
+			}
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Errorf("operations never exercised: %v", missing)
+	}
+}
+
+func TestOpenAPISpecRefsResolve(t *testing.T) {
+	spec := loadSpec(t)
+
+	var walk func(v interface{}, path string)
+	walk = func(v interface{}, path string) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				name := ref[strings.LastIndex(ref, "/")+1:]
+				var found bool
+				switch {
+				case strings.HasPrefix(ref, "#/components/schemas/"):
+					_, found = spec.Components.Schemas[name]
+				case strings.HasPrefix(ref, "#/components/responses/"):
+					_, found = spec.Components.Responses[name]
+				case strings.HasPrefix(ref, "#/components/parameters/"):
+					_, found = spec.Components.Parameters[name]
+				case strings.HasPrefix(ref, "#/components/headers/"):
+					_, found = spec.Components.Headers[name]
+				}
+				if !found {
+					t.Errorf("%s: unresolved $ref %q", path, ref)
+				}
+			}
+			for k, child := range v {
+				walk(child, path+"/"+k)
+			}
+		case []interface{}:
+			for i, child := range v {
+				walk(child, fmt.Sprintf("%s/%d", path, i))
+			}
+		}
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(openapiSpec, &doc); err != nil {
+		t.Fatalf("parse openapi.json: %v", err)
+	}
+	walk(doc, "#")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// requestError is a problem with the request itself. Its message is returned to the caller.
+type requestError string
+
+func (e requestError) Error() string { return string(e) }
+
+var errUnknownPool = fmt.Errorf("unknown pool")
+
+// HeldIdentifier is one identifier held by a client
+type HeldIdentifier struct {
+	Identifier string   `json:"identifier"`
+	Pool       string   `json:"pool"`
+	LastSeen   string   `json:"last_seen"`
+	Metadata   Metadata `json:"metadata"`
+}
+
+// validateAllocation checks an allocation request and returns its pool, the number of
+// identifiers asked for and their lease TTL. It returns a requestError or errUnknownPool.
+func validateAllocation(req AllocateRequest) (PoolConfig, int, time.Duration, error) {
+	if req.ClientID == "" {
+		return PoolConfig{}, 0, 0, requestError("client_id is required")
+	}
+
+	if err := validateMetadata(req.Metadata); err != nil {
+		return PoolConfig{}, 0, 0, requestError(err.Error())
+	}
+
+	pool, ok := config.Identifiers.Pool(req.Pool)
+	if !ok {
+		return PoolConfig{}, 0, 0, errUnknownPool
+	}
+
+	count := req.Count
+	if count == 0 {
+		count = 1
+	}
+	if count < 0 || count > pool.MaxPerClient {
+		return PoolConfig{}, 0, 0, requestError(fmt.Sprintf("count must be between 1 and %d", pool.MaxPerClient))
+	}
+
+	ttl := pool.leaseTTL(req.TTLSeconds)
+	if req.TTLSeconds != 0 {
+		if req.TTLSeconds < 0 || ttl < pool.TTL.Min || ttl > pool.TTL.Max {
+			return PoolConfig{}, 0, 0, requestError(fmt.Sprintf("ttl_seconds must be between %d and %d",
+				int(pool.TTL.Min.Seconds()), int(pool.TTL.Max.Seconds())))
+		}
+	}
+	return pool, count, ttl, nil
+}
+
+// allocationWait returns how long an allocation request may block for identifiers. It returns a
+// requestError if the request asks to wait while waiting is disabled, or for too long.
+func allocationWait(req AllocateRequest) (time.Duration, error) {
+	if req.Wait == "" && !req.Waitlist {
+		return 0, nil
+	}
+	maxWait := config.Server.AllocationMaxWait
+	if maxWait < 0 {
+		return 0, requestError("Waiting for identifiers is disabled")
+	}
+	if req.Wait == "" {
+		return 0, nil
+	}
+	if req.Waitlist {
+		return 0, requestError("wait and waitlist are alternatives")
+	}
+
+	wait, err := time.ParseDuration(req.Wait)
+	if err != nil || wait <= 0 || wait > maxWait {
+		return 0, requestError(fmt.Sprintf("wait must be a duration up to %s", maxWait))
+	}
+	return wait, nil
+}
+
+// allocate validates an allocation request and allocates for it. It returns a requestError,
+// errUnknownPool, or sql.ErrNoRows when the pool cannot satisfy the request.
+func allocate(req AllocateRequest, now time.Time) ([]string, error) {
+	pool, count, ttl, err := validateAllocation(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients on the waitlist come first, unless this one already holds what it asks for
+	if waitlist.ahead(pool.Name, req.ClientID) {
+		var held int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE locked_by = ? AND pool = ?`, req.ClientID, pool.Name).Scan(&held); err != nil {
+			log.Printf("Error allocating identifiers for client %s: %v", req.ClientID, err)
+			return nil, err
+		}
+		if held < count {
+			log.Printf("Allocation failed: Clients are waiting for pool %s ahead of client %s", pool.Name, req.ClientID)
+			return nil, sql.ErrNoRows
+		}
+	}
+
+	// Keep the client's existing identifiers and allocate any shortfall, all or nothing,
+	// in the order chosen by the allocation strategy
+	identifiers, err := allocateIdentifiers(pool.Name, req.ClientID, count, ttl, req.Metadata, now)
+
+	if err == sql.ErrNoRows {
+		// Not enough available identifiers
+		log.Printf("Allocation failed: Not enough available identifiers in pool %s for client %s (requested %d)", pool.Name, req.ClientID, count)
+		return nil, err
+	} else if err != nil {
+		// Other database error
+		log.Printf("Error allocating identifiers for client %s: %v", req.ClientID, err)
+		return nil, err
+	}
+
+	log.Printf("Identifiers allocated: ClientID=%s, Pool=%s, Identifiers=%v", req.ClientID, pool.Name, identifiers)
+	return identifiers, nil
+}
+
+// heartbeat validates and records a liveness probe, publishing the events it implies.
+// Without an identifier the probe covers every identifier the client holds, and reports
+// LivenessNotFound if there are none.
+func heartbeat(req LivenessRequest, now time.Time) (livenessResult, error) {
+	if req.ClientID == "" {
+		return livenessResult{Status: LivenessInvalid}, requestError("client_id is required")
+	}
+
+	if err := validateMetadata(req.Metadata); err != nil {
+		return livenessResult{Status: LivenessInvalid}, requestError(err.Error())
+	}
+
+	if req.Identifier == "" {
+		touched, err := touchClientIdentifiers(req.ClientID, nil, req.Metadata, now)
+		if err != nil {
+			log.Printf("Error updating liveness for client %s: %v", req.ClientID, err)
+			return livenessResult{}, err
+		}
+		if touched == 0 {
+			log.Printf("Liveness probe failed: Client %s holds no identifiers", req.ClientID)
+			return livenessResult{Status: LivenessNotFound}, nil
+		}
+
+		// The client is told to renew in time for its shortest lease
+		var ttl int64
+		if err := db.QueryRow(`SELECT MIN(COALESCE(ttl, ?)) FROM identifiers WHERE locked_by = ?`,
+			int64(config.Server.StaleTimeout/time.Second), req.ClientID).Scan(&ttl); err != nil {
+			log.Printf("Error updating liveness for client %s: %v", req.ClientID, err)
+			return livenessResult{}, err
+		}
+
+		log.Printf("Liveness updated: ClientID=%s, Identifiers=%d", req.ClientID, touched)
+		return livenessResult{Status: LivenessOK, TTL: time.Duration(ttl) * time.Second}, nil
+	}
+
+	// Every node records the probe when it applies it, and publishes its events
+	if cluster != nil {
+		result, err := cluster.recordLiveness(req, now)
+		if err != nil {
+			log.Printf("Error updating liveness for client %s: %v", req.ClientID, err)
+		}
+		return result, err
+	}
+
+	if heartbeats == nil {
+		result, err := recordLivenessEvents(req, now)
+		if err != nil {
+			log.Printf("Error updating liveness for client %s: %v", req.ClientID, err)
+		}
+		return result, err
+	}
+
+	// A plain probe for a lease the buffer knows is acknowledged from memory
+	if len(req.Metadata) == 0 {
+		if result, ok := heartbeats.record(req.ClientID, req.Identifier, now); ok {
+			return result, nil
+		}
+	}
+
+	// The database must see the buffered probes before it decides whether the lease is stale
+	if heartbeats.dirty(req.Identifier) {
+		if err := heartbeats.flush(); err != nil {
+			log.Printf("Error flushing heartbeats: %v", err)
+			return livenessResult{}, err
+		}
+	}
+
+	generation := heartbeats.generation()
+	result, err := recordLivenessEvents(req, now)
+	if err != nil {
+		log.Printf("Error updating liveness for client %s: %v", req.ClientID, err)
+		return result, err
+	}
+
+	if result.Status == LivenessOK || result.Status == LivenessReassociated {
+		heartbeats.remember(req.ClientID, req.Identifier, result.Pool, result.TTL, now, generation)
+	}
+	return result, nil
+}
+
+// recordLivenessBatch applies many liveness probes in one transaction, so that either all of
+// them are recorded or none are, and publishes the events they imply
+func recordLivenessBatch(entries []LivenessRequest, now time.Time) ([]livenessResult, error) {
+	if cluster != nil {
+		// Every node applies the whole batch and publishes its events
+		return cluster.recordLivenessBatch(entries, now)
+	}
+
+	var results []livenessResult
+	_, err := commitEvents(func(tx *sql.Tx) ([]Event, error) {
+		var batch []Event
+		var err error
+		results, batch, err = recordLivenessBatchTx(tx, entries, now)
+		return batch, err
+	})
+	return results, err
+}
+
+// recordLivenessBatchTx applies the probes in order, and returns their outcomes and the events
+// to publish once the transaction commits
+func recordLivenessBatchTx(q queryer, entries []LivenessRequest, now time.Time) ([]livenessResult, []Event, error) {
+	results := make([]livenessResult, 0, len(entries))
+	var batch []Event
+	for _, entry := range entries {
+		result, err := recordLiveness(q, entry, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		results = append(results, result)
+		batch = append(batch, livenessEvents(entry, result)...)
+	}
+	return results, batch, nil
+}
+
+// releaseIdentifiers frees one identifier held by the client, or all of them when identifier
+// is empty, and returns the release events it published
+func releaseIdentifiers(clientID, identifier string, now time.Time) ([]Event, error) {
+	var released []Event
+	var err error
+	if cluster != nil {
+		// Every node publishes the release events when it applies the release
+		released, err = cluster.releaseIdentifiers(clientID, identifier, now)
+	} else {
+		released, err = commitEvents(func(tx *sql.Tx) ([]Event, error) {
+			return releaseIdentifiersTx(tx, clientID, identifier, now)
+		})
+	}
+	if err != nil {
+		log.Printf("Error releasing identifier: %v", err)
+		return nil, err
+	}
+
+	if identifier == "" {
+		log.Printf("Client %s manually released all %d identifier(s)", clientID, len(released))
+	} else {
+		log.Printf("Client %s manually released identifier %s", clientID, identifier)
+	}
+	return released, nil
+}
+
+// releaseIdentifiersTx frees the client's identifiers and returns the release events to publish
+func releaseIdentifiersTx(q queryer, clientID, identifier string, now time.Time) ([]Event, error) {
+	query := `
+		UPDATE identifiers
+		SET released_by = locked_by, locked_by = NULL, last_seen = NULL, released_at = ?, metadata = NULL, ttl = NULL
+		WHERE locked_by = ?`
+	args := []interface{}{now, clientID}
+	if identifier != "" {
+		query += ` AND identifier = ?`
+		args = append(args, identifier)
+	}
+	query += ` RETURNING identifier, pool`
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var released []Event
+	for rows.Next() {
+		e := Event{Type: EventRelease, ClientID: clientID}
+		if err := rows.Scan(&e.Identifier, &e.Pool); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			continue
+		}
+		released = append(released, e)
+	}
+	rows.Close()
+	return released, rows.Err()
+}
+
+// clientLeases returns the identifiers held by a client in natural order
+func clientLeases(clientID string) ([]HeldIdentifier, error) {
+	rows, err := db.Query(`
+		SELECT identifier, pool, last_seen, metadata
+		FROM identifiers
+		WHERE locked_by = ?
+		ORDER BY sort_key`,
+		clientID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var held []HeldIdentifier
+	for rows.Next() {
+		var h HeldIdentifier
+		var metadata sql.NullString
+		if err := rows.Scan(&h.Identifier, &h.Pool, &h.LastSeen, &metadata); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			continue
+		}
+		h.Metadata = parseMetadata(metadata).orEmpty()
+		held = append(held, h)
+	}
+	return held, rows.Err()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of /identifiers, /allocated and the gRPC List call
+const (
+	DefaultPageSize = 1000
+	MaxPageSize     = 10000
+)
+
+// Allocation states accepted by the state filter
+const (
+	StateAllocated   = "allocated"
+	StateFree        = "free"
+	StateQuarantined = "quarantined"
+)
+
+// identifierSorts maps each sort order to the column expression it orders by. Ties, and the
+// "identifier" order itself, are broken by the natural sort key.
+var identifierSorts = map[string]string{
+	"identifier":  "''",
+	"pool":        "pool",
+	"client":      "COALESCE(locked_by, '')",
+	"last_seen":   "COALESCE(last_seen, '')",
+	"released_at": "COALESCE(released_at, '')",
+}
+
+// identifierQuery filters, sorts and pages a listing of identifiers
+type identifierQuery struct {
+	Selector       Selector
+	State          string
+	Stale          *bool
+	Pool           string
+	ClientPrefix   string
+	LastSeenAfter  time.Time
+	LastSeenBefore time.Time
+
+	Sort       string
+	Descending bool
+	// Limit is the page size, DefaultPageSize if zero and at most MaxPageSize
+	Limit  int
+	Cursor *pageCursor
+}
+
+// pageCursor is the position after the last identifier of a page
+type pageCursor struct {
+	Value   string `json:"v,omitempty"`
+	SortKey int64  `json:"k"`
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageCursor(raw string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// parseIdentifierQuery reads the filter, sort and paging parameters of a listing request
+func parseIdentifierQuery(values url.Values) (identifierQuery, error) {
+	var q identifierQuery
+	var err error
+
+	if q.Selector, err = parseSelector(values.Get("selector")); err != nil {
+		return q, err
+	}
+
+	switch q.State = values.Get("state"); q.State {
+	case "", StateAllocated, StateFree, StateQuarantined:
+	default:
+		return q, fmt.Errorf("state must be %s, %s or %s", StateAllocated, StateFree, StateQuarantined)
+	}
+
+	if raw := values.Get("stale"); raw != "" {
+		stale, err := strconv.ParseBool(raw)
+		if err != nil {
+			return q, fmt.Errorf("stale must be true or false")
+		}
+		q.Stale = &stale
+	}
+
+	q.Pool = values.Get("pool")
+	q.ClientPrefix = values.Get("client_prefix")
+
+	for name, t := range map[string]*time.Time{"last_seen_after": &q.LastSeenAfter, "last_seen_before": &q.LastSeenBefore} {
+		if raw := values.Get(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			// Timestamps are stored in local time and compared as text
+			*t = parsed.Local()
+		}
+	}
+
+	q.Sort = "identifier"
+	if raw := values.Get("sort"); raw != "" {
+		q.Descending = strings.HasPrefix(raw, "-")
+		q.Sort = strings.TrimPrefix(raw, "-")
+		if _, ok := identifierSorts[q.Sort]; !ok {
+			return q, fmt.Errorf("unknown sort %q", q.Sort)
+		}
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		q.Limit, err = strconv.Atoi(raw)
+		if err != nil || q.Limit < 1 || q.Limit > MaxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+		}
+	}
+
+	if raw := values.Get("cursor"); raw != "" {
+		if q.Cursor, err = decodePageCursor(raw); err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	return q, nil
+}
+
+// where returns the SQL condition selecting the identifiers that match the filters
+func (q identifierQuery) where(now time.Time) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	switch q.State {
+	case StateAllocated:
+		conditions = append(conditions, "locked_by IS NOT NULL")
+	case StateFree:
+		conditions = append(conditions, "locked_by IS NULL AND (released_at IS NULL OR released_at <= ?)")
+		args = append(args, cooldownThreshold(now))
+	case StateQuarantined:
+		conditions = append(conditions, "locked_by IS NULL AND released_at > ?")
+		args = append(args, cooldownThreshold(now))
+	}
+
+	if q.Stale != nil {
+		stale := staleLease
+		if !*q.Stale {
+			stale = "NOT (" + stale + ")"
+		}
+		conditions = append(conditions, stale)
+		args = append(args, staleLeaseArgs(now)...)
+	}
+
+	if q.Pool != "" {
+		conditions = append(conditions, "pool = ?")
+		args = append(args, q.Pool)
+	}
+	if q.ClientPrefix != "" {
+		conditions = append(conditions, `locked_by LIKE ? ESCAPE '\'`)
+		args = append(args, likePrefix(q.ClientPrefix))
+	}
+	if !q.LastSeenAfter.IsZero() {
+		conditions = append(conditions, "last_seen >= ?")
+		args = append(args, q.LastSeenAfter)
+	}
+	if !q.LastSeenBefore.IsZero() {
+		conditions = append(conditions, "last_seen < ?")
+		args = append(args, q.LastSeenBefore)
+	}
+
+	selector, selectorArgs := q.Selector.where()
+	conditions = append(conditions, selector...)
+	args = append(args, selectorArgs...)
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// likePrefix returns a LIKE pattern matching strings that start with prefix, escaped with a backslash
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// setPageHeaders reports the total number of matches and, if there are more, the cursor of the next page
+func setPageHeaders(w http.ResponseWriter, total int, next string) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+}
+
+// listIdentifiers returns one page of the identifiers matching q, the number of matches
+// across all pages, and the cursor of the next page if there is one
+func listIdentifiers(q identifierQuery, now time.Time) ([]Identifier, int, string, error) {
+	where, args := q.where(now)
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM identifiers WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, "", err
+	}
+
+	sortExpr := identifierSorts[q.Sort]
+	direction, after := "ASC", ">"
+	if q.Descending {
+		direction, after = "DESC", "<"
+	}
+
+	query := `
+		SELECT identifier, pool, locked_by, last_seen, released_at, metadata, sort_key, ` + sortExpr + `
+		FROM identifiers
+		WHERE ` + where
+	if q.Cursor != nil {
+		query += fmt.Sprintf(` AND (%[1]s %[2]s ? OR (%[1]s = ? AND sort_key %[2]s ?))`, sortExpr, after)
+		args = append(args, q.Cursor.Value, q.Cursor.Value, q.Cursor.SortKey)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+	// One extra row tells whether there is another page
+	query += fmt.Sprintf(` ORDER BY %s %s, sort_key %s LIMIT ?`, sortExpr, direction, direction)
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer rows.Close()
+
+	threshold := cooldownThreshold(now)
+
+	identifiers := []Identifier{}
+	var last pageCursor
+	var next string
+	for rows.Next() {
+		if len(identifiers) == limit {
+			next = last.encode()
+			break
+		}
+
+		var id Identifier
+		var lockedBy sql.NullString
+		var lastSeen sql.NullString
+		var releasedAt sql.NullTime
+		var metadata sql.NullString
+
+		err := rows.Scan(&id.Identifier, &id.Pool, &lockedBy, &lastSeen, &releasedAt, &metadata, &last.SortKey, &last.Value)
+		if err != nil {
+			log.Printf("Error scanning row: %v", err)
+			continue
+		}
+
+		id.Metadata = parseMetadata(metadata)
+
+		// Handle nullable fields
+		if lockedBy.Valid {
+			id.LockedBy = &lockedBy.String
+			id.Allocated = true
+		} else {
+			id.Allocated = false
+		}
+
+		if lastSeen.Valid {
+			parsedTime, err := time.Parse(time.RFC3339, lastSeen.String)
+			if err == nil {
+				id.LastSeen = &parsedTime
+			}
+		}
+
+		// Released identifiers stay quarantined until the reuse cooldown has elapsed
+		if releasedAt.Valid {
+			id.ReleasedAt = &releasedAt.Time
+			id.Quarantined = !id.Allocated && releasedAt.Time.After(threshold)
+		}
+
+		identifiers = append(identifiers, id)
+	}
+
+	return identifiers, total, next, rows.Err()
+}
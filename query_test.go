@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// listAll pages through a listing and returns the identifiers in order
+func listAll(t *testing.T, raw string, now time.Time) ([]string, int) {
+	t.Helper()
+
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		t.Fatalf("parse %q: %v", raw, err)
+	}
+	query, err := parseIdentifierQuery(values)
+	if err != nil {
+		t.Fatalf("parseIdentifierQuery(%q): %v", raw, err)
+	}
+
+	var names []string
+	var total int
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatalf("%q: too many pages", raw)
+		}
+		page, count, next, err := listIdentifiers(query, now)
+		if err != nil {
+			t.Fatalf("listIdentifiers(%q): %v", raw, err)
+		}
+		if query.Limit > 0 && len(page) > query.Limit {
+			t.Fatalf("%q: page of %d exceeds the limit", raw, len(page))
+		}
+		total = count
+		for _, id := range page {
+			names = append(names, id.Identifier)
+		}
+		if next == "" {
+			return names, total
+		}
+		if query.Cursor, err = decodePageCursor(next); err != nil {
+			t.Fatalf("decode cursor: %v", err)
+		}
+	}
+}
+
+func TestListIdentifiersPagination(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-12]")
+
+	names, total := listAll(t, "limit=5", time.Now())
+	want := []string{"vm-1", "vm-2", "vm-3", "vm-4", "vm-5", "vm-6", "vm-7", "vm-8", "vm-9", "vm-10", "vm-11", "vm-12"}
+	if !reflect.DeepEqual(names, want) || total != 12 {
+		t.Fatalf("limit=5 = %v (total %d), want %v (total 12)", names, total, want)
+	}
+
+	names, _ = listAll(t, "limit=4&sort=-identifier", time.Now())
+	if names[0] != "vm-12" || names[11] != "vm-1" || len(names) != 12 {
+		t.Fatalf("descending = %v", names)
+	}
+}
+
+func TestListIdentifiersFilters(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-6]")
+	config.Identifiers.MaxPerClient = 2
+
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	if _, err := allocateIdentifiers(DefaultPool, "ci-b", 2, 0, nil, old); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if _, err := allocateIdentifiers(DefaultPool, "ci-a", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if _, err := allocateIdentifiers(DefaultPool, "dev", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"state=allocated", []string{"vm-1", "vm-2", "vm-3", "vm-4"}},
+		{"state=free", []string{"vm-5", "vm-6"}},
+		{"client_prefix=ci-", []string{"vm-1", "vm-2", "vm-3"}},
+		{"stale=true", []string{"vm-1", "vm-2"}},
+		{"stale=false&state=allocated", []string{"vm-3", "vm-4"}},
+		{"last_seen_before=" + url.QueryEscape(now.Add(-time.Minute).Format(time.RFC3339)), []string{"vm-1", "vm-2"}},
+		{"last_seen_after=" + url.QueryEscape(now.Add(-time.Minute).Format(time.RFC3339)), []string{"vm-3", "vm-4"}},
+		{"state=allocated&sort=client&limit=1", []string{"vm-3", "vm-1", "vm-2", "vm-4"}},
+		{"state=allocated&sort=-client&limit=3", []string{"vm-4", "vm-2", "vm-1", "vm-3"}},
+		{"pool=other", nil},
+	}
+	for _, tt := range tests {
+		names, total := listAll(t, tt.query, now)
+		if !reflect.DeepEqual(names, tt.want) || total != len(tt.want) {
+			t.Errorf("%s = %v (total %d), want %v", tt.query, names, total, tt.want)
+		}
+	}
+}
+
+func TestListIdentifiersDefaultsToAPage(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, fmt.Sprintf("vm-[1-%d]", DefaultPageSize+5))
+
+	page, total, next, err := listIdentifiers(identifierQuery{Sort: "identifier"}, time.Now())
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(page) != DefaultPageSize || total != DefaultPageSize+5 || next == "" {
+		t.Fatalf("unlimited listing = %d identifiers (total %d, next %q), want a page of %d", len(page), total, next, DefaultPageSize)
+	}
+}
+
+func TestListIdentifiersClientPrefixIsLiteral(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-4]")
+	for _, client := range []string{"ci_1", "cix1", "ci%2", "café-1"} {
+		if _, err := allocateNextIdentifier(db, DefaultPool, client, 0, nil, time.Now()); err != nil {
+			t.Fatalf("allocate for %s: %v", client, err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"ci_", []string{"vm-1"}},
+		{"ci%", []string{"vm-3"}},
+		{"ci", []string{"vm-1", "vm-2", "vm-3"}},
+		{"café", []string{"vm-4"}},
+		{"café-1", []string{"vm-4"}},
+	}
+	for _, tt := range tests {
+		names, _ := listAll(t, "client_prefix="+url.QueryEscape(tt.prefix), time.Now())
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("client_prefix=%s = %v, want %v", tt.prefix, names, tt.want)
+		}
+	}
+}
+
+func TestParseIdentifierQueryRejectsInvalidParameters(t *testing.T) {
+	for _, raw := range []string{"state=busy", "stale=maybe", "sort=size", "limit=0", "limit=10001", "cursor=bm90LWpzb24", "last_seen_after=today"} {
+		values, _ := url.ParseQuery(raw)
+		if _, err := parseIdentifierQuery(values); err == nil {
+			t.Errorf("parseIdentifierQuery(%q) succeeded, want an error", raw)
+		}
+	}
+}
@@ -0,0 +1,1420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.etcd.io/raft/v3"
+	"go.etcd.io/raft/v3/raftpb"
+)
+
+// Operations replicated through the Raft log
+const (
+	raftAllocate  = "allocate"
+	raftHeartbeat = "heartbeat"
+	// raftHeartbeatBatch applies the probes of a /liveness/batch request in one transaction
+	raftHeartbeatBatch = "heartbeat_batch"
+	raftRelease        = "release"
+	raftReap           = "reap"
+	raftGrow           = "grow"
+	raftShrink         = "shrink"
+	// raftAlert publishes events that change no identifier, such as pool alerts
+	raftAlert = "alert"
+	// raftDeliveries records the outcomes of webhook deliveries
+	raftDeliveries = "deliveries"
+	// raftResume extends leases over an outage of the whole cluster, proposed by every new leader
+	raftResume = "resume"
+)
+
+// raftCatchUpEntries are kept in the log after a snapshot, so that a follower that is only a
+// little behind catches up from the log instead of being sent the snapshot
+const raftCatchUpEntries = 100
+
+var errRaftTimeout = errors.New("raft: timed out waiting for the entry to be applied")
+
+// raftCommand is a write replicated through the Raft log. Every node applies it to its own
+// database in log order, so it carries the time it was made rather than each node using its own.
+type raftCommand struct {
+	// ID lets the node that proposed the command pick out its result
+	ID   string    `json:"id"`
+	Op   string    `json:"op"`
+	Time time.Time `json:"time"`
+
+	Pool        string        `json:"pool,omitempty"`
+	ClientID    string        `json:"client_id,omitempty"`
+	Identifier  string        `json:"identifier,omitempty"`
+	Identifiers []string      `json:"identifiers,omitempty"`
+	Count       int           `json:"count,omitempty"`
+	TTL         time.Duration `json:"ttl,omitempty"`
+	Metadata    Metadata      `json:"metadata,omitempty"`
+	Force       bool          `json:"force,omitempty"`
+	// Entries are the probes of a heartbeat batch
+	Entries []LivenessRequest `json:"entries,omitempty"`
+	// Events are the events of an alert
+	Events []Event `json:"events,omitempty"`
+	// Deliveries are the webhook delivery outcomes to record
+	Deliveries []deliveryMark `json:"deliveries,omitempty"`
+}
+
+// raftResult is the outcome of applying a command, handed to the proposer
+type raftResult struct {
+	identifiers []string
+	touched     int
+	liveness    livenessResult
+	batch       []livenessResult
+	events      []Event
+	err         error
+}
+
+// raftMemberContext travels in a membership change
+type raftMemberContext struct {
+	ID  string `json:"id,omitempty"`
+	URL string `json:"url,omitempty"`
+}
+
+// raftSnapshotData is the replicated state captured in a snapshot. Identifiers are in natural order.
+type raftSnapshotData struct {
+	Members     map[uint64]string `json:"members"`
+	Identifiers []ExportRecord    `json:"identifiers"`
+	// LastReap and ReapPausedSince carry the reaper's state, which reaps depend on
+	LastReap        *time.Time `json:"last_reap,omitempty"`
+	ReapPausedSince *time.Time `json:"reap_paused_since,omitempty"`
+	// Growth lists the blocks the pools have grown by
+	Growth []PoolGrowth `json:"growth,omitempty"`
+	// Cursors maps every pool to the last identifier round_robin handed out in it
+	Cursors map[string]string `json:"cursors,omitempty"`
+	// Outbox is the webhook outbox, so that a node restored from the snapshot can deliver
+	// what is pending when it leads
+	Outbox []outboxRecord `json:"outbox,omitempty"`
+}
+
+// RaftMember is a member of the cluster
+type RaftMember struct {
+	ID      uint64 `json:"id"`
+	URL     string `json:"url"`
+	Learner bool   `json:"learner"`
+}
+
+// RaftMemberRequest adds a member, or promotes a learner, through /admin/raft/members
+type RaftMemberRequest struct {
+	ID      uint64 `json:"id"`
+	URL     string `json:"url"`
+	Learner bool   `json:"learner"`
+}
+
+// RaftStatus is a node's view of the cluster
+type RaftStatus struct {
+	NodeID        uint64       `json:"node_id"`
+	Leader        uint64       `json:"leader"`
+	Role          string       `json:"role"`
+	Term          uint64       `json:"term"`
+	CommitIndex   uint64       `json:"commit_index"`
+	AppliedIndex  uint64       `json:"applied_index"`
+	SnapshotIndex uint64       `json:"snapshot_index"`
+	Members       []RaftMember `json:"members"`
+}
+
+// raftNode is this registry's member of a Raft cluster. Its database holds the replicated
+// identifier table together with the Raft log, hard state and latest snapshot.
+type raftNode struct {
+	id      uint64
+	db      *sql.DB
+	node    raft.Node
+	storage *raft.MemoryStorage
+	client  *http.Client
+	// secret signs the messages sent to other members and checks the ones received
+	secret []byte
+	// events receives the events of every entry this node applies
+	events *eventBus
+
+	tickInterval    time.Duration
+	snapshotEntries uint64
+	catchUpEntries  uint64
+	proposalTimeout time.Duration
+
+	mu sync.Mutex
+	// members maps member IDs to the base URLs their messages are posted to
+	members       map[uint64]string
+	confState     raftpb.ConfState
+	applied       uint64
+	snapshotIndex uint64
+	lead          uint64
+	// changes counts the times this node gained or lost leadership
+	changes int
+	waiters map[string]chan raftResult
+	queues  map[uint64]chan raftpb.Message
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// cluster is nil unless raft is enabled, in which case every write goes through its log
+var cluster *raftNode
+
+// initRaftTables creates the tables a node keeps its Raft state in
+func initRaftTables(conn *sql.DB) error {
+	_, err := conn.Exec(`
+	CREATE TABLE IF NOT EXISTS raft_entries (
+		idx INTEGER PRIMARY KEY,
+		entry BLOB NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS raft_members (
+		id INTEGER PRIMARY KEY,
+		url TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS raft_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		hard_state BLOB,
+		conf_state BLOB,
+		snapshot BLOB,
+		applied INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT OR IGNORE INTO raft_state (id) VALUES (1);`)
+	return err
+}
+
+// startRaft joins this node to its Raft cluster, if raft is enabled
+func startRaft() {
+	if !config.Raft.Enabled {
+		return
+	}
+
+	n, err := newRaftNode(db, config.Raft, events)
+	if err != nil {
+		log.Fatalf("Failed to start raft: %v", err)
+	}
+	cluster = n
+
+	// Members exchange messages, and take membership changes, on their own listener away
+	// from the API's clients
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/message", n.messageHandler)
+	mux.HandleFunc("/admin/raft/members", n.membersHandler)
+	mux.HandleFunc("/admin/raft/members/{id}", n.memberHandler)
+	server := &http.Server{
+		Addr:         config.Raft.ListenAddress,
+		Handler:      mux,
+		ReadTimeout:  config.Server.ReadTimeout,
+		WriteTimeout: config.Server.WriteTimeout,
+		IdleTimeout:  config.Server.IdleTimeout,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatalf("Raft transport failed: %v", err)
+		}
+	}()
+
+	log.Printf("Raft node %d started on %s, applied up to index %d", n.id, config.Raft.ListenAddress, n.status().AppliedIndex)
+}
+
+// newRaftNode starts a Raft node on conn. A node with saved state restarts from it; otherwise
+// it bootstraps a cluster of the configured peers, or waits to be added if it is joining.
+func newRaftNode(conn *sql.DB, c RaftConfig, bus *eventBus) (*raftNode, error) {
+	if err := initRaftTables(conn); err != nil {
+		return nil, err
+	}
+
+	n := &raftNode{
+		id:              c.NodeID,
+		db:              conn,
+		storage:         raft.NewMemoryStorage(),
+		client:          &http.Client{Timeout: 5 * time.Second},
+		secret:          []byte(c.Secret),
+		events:          bus,
+		tickInterval:    c.TickInterval,
+		snapshotEntries: c.SnapshotEntries,
+		catchUpEntries:  raftCatchUpEntries,
+		proposalTimeout: c.ProposalTimeout,
+		members:         make(map[uint64]string),
+		waiters:         make(map[string]chan raftResult),
+		queues:          make(map[uint64]chan raftpb.Message),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	restart, err := n.load()
+	if err != nil {
+		return nil, err
+	}
+	// A new node needs the addresses of the others before it has applied any membership
+	if len(n.members) == 0 {
+		for _, peer := range c.Peers {
+			n.members[peer.ID] = peer.URL
+		}
+	}
+
+	rc := &raft.Config{
+		ID:              c.NodeID,
+		ElectionTick:    c.ElectionTicks,
+		HeartbeatTick:   c.HeartbeatTicks,
+		Storage:         n.storage,
+		Applied:         n.applied,
+		MaxSizePerMsg:   1 << 20,
+		MaxInflightMsgs: 256,
+		CheckQuorum:     true,
+		PreVote:         true,
+		Logger:          &raft.DefaultLogger{Logger: log.New(os.Stderr, "raft: ", log.LstdFlags)},
+	}
+
+	if restart || c.Join {
+		n.node = raft.RestartNode(rc)
+	} else {
+		peers := make([]raft.Peer, len(c.Peers))
+		for i, peer := range c.Peers {
+			member, err := json.Marshal(raftMemberContext{URL: peer.URL})
+			if err != nil {
+				return nil, err
+			}
+			peers[i] = raft.Peer{ID: peer.ID, Context: member}
+		}
+		n.node = raft.StartNode(rc, peers)
+	}
+
+	go n.run()
+	return n, nil
+}
+
+// load reads the saved Raft state into memory, and reports whether there was any
+func (n *raftNode) load() (bool, error) {
+	var hardStateData, confStateData, snapshotData []byte
+	err := n.db.QueryRow(`SELECT hard_state, conf_state, snapshot, applied FROM raft_state`).
+		Scan(&hardStateData, &confStateData, &snapshotData, &n.applied)
+	if err != nil {
+		return false, err
+	}
+
+	var hardState raftpb.HardState
+	if err := hardState.Unmarshal(hardStateData); err != nil {
+		return false, err
+	}
+	if err := n.confState.Unmarshal(confStateData); err != nil {
+		return false, err
+	}
+
+	var snapshot raftpb.Snapshot
+	if err := snapshot.Unmarshal(snapshotData); err != nil {
+		return false, err
+	}
+	if !raft.IsEmptySnap(snapshot) {
+		if err := n.storage.ApplySnapshot(snapshot); err != nil {
+			return false, err
+		}
+		n.snapshotIndex = snapshot.Metadata.Index
+		// The node stopped after saving a snapshot it received, before restoring from it
+		if n.applied < snapshot.Metadata.Index {
+			if err := n.restoreSnapshot(snapshot); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	rows, err := n.db.Query(`SELECT entry FROM raft_entries ORDER BY idx`)
+	if err != nil {
+		return false, err
+	}
+	var entries []raftpb.Entry
+	for rows.Next() {
+		var data []byte
+		var entry raftpb.Entry
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if err := entry.Unmarshal(data); err != nil {
+			rows.Close()
+			return false, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if err := n.storage.Append(entries); err != nil {
+		return false, err
+	}
+	if !raft.IsEmptyHardState(hardState) {
+		if err := n.storage.SetHardState(hardState); err != nil {
+			return false, err
+		}
+	}
+
+	rows, err = n.db.Query(`SELECT id, url FROM raft_members`)
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var id uint64
+		var url string
+		if err := rows.Scan(&id, &url); err != nil {
+			rows.Close()
+			return false, err
+		}
+		n.members[id] = url
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	// Raft learns the membership from the latest snapshot and the entries it hands out to be
+	// applied, and it does not hand out applied entries again. A snapshot at the applied
+	// index carries the membership those entries changed.
+	if n.applied > n.snapshotIndex {
+		if err := n.takeSnapshot(); err != nil {
+			return false, err
+		}
+	}
+
+	return !raft.IsEmptyHardState(hardState) || !raft.IsEmptySnap(snapshot), nil
+}
+
+// run drives the Raft node: it ticks the clock, and saves, sends and applies whatever the
+// node has ready, in that order
+func (n *raftNode) run() {
+	defer close(n.done)
+
+	ticker := time.NewTicker(n.tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.node.Tick()
+
+		case rd := <-n.node.Ready():
+			if rd.SoftState != nil {
+				n.setLeader(rd.SoftState.Lead)
+			}
+			if err := n.persist(rd); err != nil {
+				log.Fatalf("Raft: failed to save state: %v", err)
+			}
+			n.send(rd.Messages)
+			if !raft.IsEmptySnap(rd.Snapshot) {
+				if err := n.restoreSnapshot(rd.Snapshot); err != nil {
+					log.Fatalf("Raft: failed to restore snapshot: %v", err)
+				}
+			}
+			membershipChanged := false
+			for _, entry := range rd.CommittedEntries {
+				if err := n.apply(entry); err != nil {
+					log.Fatalf("Raft: failed to apply entry %d: %v", entry.Index, err)
+				}
+				membershipChanged = membershipChanged || entry.Type == raftpb.EntryConfChange
+			}
+			// A member ignores a snapshot from before it was added, so the snapshot sent to a
+			// new member must be taken after its addition
+			if membershipChanged || n.shouldSnapshot() {
+				if err := n.takeSnapshot(); err != nil {
+					log.Printf("Raft: failed to take snapshot: %v", err)
+				}
+			}
+			n.node.Advance()
+
+		case <-n.stop:
+			n.node.Stop()
+			return
+		}
+	}
+}
+
+// close stops the node. Its state stays in the database, to restart from.
+func (n *raftNode) close() {
+	close(n.stop)
+	<-n.done
+}
+
+// persist saves new entries, the hard state and a received snapshot before anything is sent
+// or applied
+func (n *raftNode) persist(rd raft.Ready) error {
+	if raft.IsEmptyHardState(rd.HardState) && raft.IsEmptySnap(rd.Snapshot) && len(rd.Entries) == 0 {
+		return nil
+	}
+
+	tx, err := n.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if !raft.IsEmptySnap(rd.Snapshot) {
+		data, err := rd.Snapshot.Marshal()
+		if err != nil {
+			return err
+		}
+		// A snapshot replaces the whole log
+		if _, err := tx.Exec(`DELETE FROM raft_entries`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE raft_state SET snapshot = ?`, data); err != nil {
+			return err
+		}
+	}
+
+	if len(rd.Entries) > 0 {
+		// New entries replace any from an older term at the same indexes
+		if _, err := tx.Exec(`DELETE FROM raft_entries WHERE idx >= ?`, rd.Entries[0].Index); err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(`INSERT INTO raft_entries (idx, entry) VALUES (?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, entry := range rd.Entries {
+			data, err := entry.Marshal()
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.Exec(entry.Index, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !raft.IsEmptyHardState(rd.HardState) {
+		data, err := rd.HardState.Marshal()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE raft_state SET hard_state = ?`, data); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if !raft.IsEmptySnap(rd.Snapshot) {
+		if err := n.storage.ApplySnapshot(rd.Snapshot); err != nil {
+			return err
+		}
+	}
+	if !raft.IsEmptyHardState(rd.HardState) {
+		if err := n.storage.SetHardState(rd.HardState); err != nil {
+			return err
+		}
+	}
+	return n.storage.Append(rd.Entries)
+}
+
+// apply applies one committed entry to the database
+func (n *raftNode) apply(entry raftpb.Entry) error {
+	switch entry.Type {
+	case raftpb.EntryNormal:
+		if len(entry.Data) == 0 {
+			// A new leader commits an empty entry
+			return n.setApplied(entry.Index)
+		}
+		return n.applyCommand(entry)
+
+	case raftpb.EntryConfChange:
+		var cc raftpb.ConfChange
+		if err := cc.Unmarshal(entry.Data); err != nil {
+			return err
+		}
+		return n.applyConfChange(entry.Index, cc)
+	}
+	return n.setApplied(entry.Index)
+}
+
+// applyCommand runs a command in a transaction that also records it as applied. A command
+// that every node rejects changes nothing, but is applied all the same; any other failure is
+// this node's own, and the entry is left unapplied.
+func (n *raftNode) applyCommand(entry raftpb.Entry) error {
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return err
+	}
+
+	tx, err := n.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result := n.execute(tx, cmd)
+	if result.err != nil {
+		if !rejectsCommand(result.err) {
+			return result.err
+		}
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		if err := n.setApplied(entry.Index); err != nil {
+			return err
+		}
+		n.respond(cmd.ID, result)
+		return nil
+	}
+
+	if n.events != nil {
+		result.events = n.events.stamp(result.events)
+		defer n.events.discard(result.events)
+	}
+	// The webhook deliveries are part of the applied entry, and every node queues them under
+	// the same IDs. Only the leader delivers them, and replicates the outcome.
+	if err := enqueueWebhookEvents(tx, result.events, entry.Index); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE raft_state SET applied = ?`, entry.Index); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.applied = entry.Index
+	n.mu.Unlock()
+
+	if n.events != nil {
+		n.events.publish(result.events...)
+	}
+	n.respond(cmd.ID, result)
+	return nil
+}
+
+// rejectsCommand reports whether err is an outcome every node reaches for the same command
+// against the same state, rather than a failure of this node's database
+func rejectsCommand(err error) bool {
+	var invalid requestError
+	return errors.As(err, &invalid) || err == errUnknownPool || err == sql.ErrNoRows
+}
+
+// execute runs a command against the identifier table
+func (n *raftNode) execute(q queryer, cmd raftCommand) raftResult {
+	// Timestamps are stored in local time so that they compare correctly as text
+	now := cmd.Time.Local()
+
+	var r raftResult
+	switch cmd.Op {
+	case raftAllocate:
+		r.identifiers, r.events, r.err = allocateIdentifiersTx(q, cmd.Pool, cmd.ClientID, cmd.Count, cmd.TTL, cmd.Metadata, now)
+
+	case raftHeartbeat:
+		if cmd.Identifier == "" {
+			r.touched, r.err = touchClientIdentifiersTx(q, cmd.ClientID, cmd.Identifiers, cmd.Metadata, now)
+			break
+		}
+		req := LivenessRequest{ClientID: cmd.ClientID, Identifier: cmd.Identifier, Metadata: cmd.Metadata}
+		r.liveness, r.err = recordLiveness(q, req, now)
+		r.events = livenessEvents(req, r.liveness)
+
+	case raftHeartbeatBatch:
+		r.batch, r.events, r.err = recordLivenessBatchTx(q, cmd.Entries, now)
+
+	case raftRelease:
+		r.events, r.err = releaseIdentifiersTx(q, cmd.ClientID, cmd.Identifier, now)
+
+	case raftReap:
+		if cmd.ClientID == "" {
+			r.events, r.err = reapStaleIdentifiersTx(q, now, cmd.Force)
+		} else {
+			r.events, r.err = reapClientIdentifiersTx(q, cmd.ClientID, cmd.Identifiers, now)
+		}
+
+	case raftGrow, raftShrink:
+		// Count is the block number
+		r.events, r.err = resizePoolTx(q, cmd.Op == raftGrow, cmd.Pool, cmd.Count, cmd.Identifiers, now)
+
+	case raftAlert:
+		r.events = cmd.Events
+
+	case raftResume:
+		r.err = extendLeasesAfterDowntime(q, now)
+
+	case raftDeliveries:
+		r.touched, r.err = markDeliveries(q, cmd.Deliveries, now)
+
+	default:
+		r.err = fmt.Errorf("unknown raft operation %q", cmd.Op)
+	}
+	return r
+}
+
+// applyConfChange adds, promotes or removes a member
+func (n *raftNode) applyConfChange(index uint64, cc raftpb.ConfChange) error {
+	var member raftMemberContext
+	if len(cc.Context) > 0 {
+		if err := json.Unmarshal(cc.Context, &member); err != nil {
+			return err
+		}
+	}
+
+	confState := n.node.ApplyConfChange(cc)
+	confStateData, err := confState.Marshal()
+	if err != nil {
+		return err
+	}
+
+	tx, err := n.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch cc.Type {
+	case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+		if member.URL != "" {
+			_, err = tx.Exec(`
+				INSERT INTO raft_members (id, url) VALUES (?, ?)
+				ON CONFLICT (id) DO UPDATE SET url = excluded.url`,
+				cc.NodeID, member.URL,
+			)
+		}
+	case raftpb.ConfChangeRemoveNode:
+		_, err = tx.Exec(`DELETE FROM raft_members WHERE id = ?`, cc.NodeID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE raft_state SET conf_state = ?, applied = ?`, confStateData, index); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.confState = *confState
+	n.applied = index
+	switch {
+	case cc.Type == raftpb.ConfChangeRemoveNode:
+		delete(n.members, cc.NodeID)
+	case member.URL != "":
+		n.members[cc.NodeID] = member.URL
+	}
+	n.mu.Unlock()
+
+	if cc.Type == raftpb.ConfChangeRemoveNode && cc.NodeID == n.id {
+		log.Printf("Raft node %d was removed from the cluster", n.id)
+	} else {
+		log.Printf("Raft membership change applied: %s %d", cc.Type, cc.NodeID)
+	}
+	n.respond(member.ID, raftResult{})
+	return nil
+}
+
+func (n *raftNode) setApplied(index uint64) error {
+	if _, err := n.db.Exec(`UPDATE raft_state SET applied = ?`, index); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.applied = index
+	n.mu.Unlock()
+	return nil
+}
+
+// shouldSnapshot reports whether enough entries were applied since the last snapshot
+func (n *raftNode) shouldSnapshot() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.applied-n.snapshotIndex >= n.snapshotEntries
+}
+
+// takeSnapshot captures the state at the applied index and compacts the log before it,
+// keeping the last catchUpEntries entries
+func (n *raftNode) takeSnapshot() error {
+	n.mu.Lock()
+	applied, confState := n.applied, n.confState
+	n.mu.Unlock()
+
+	data, err := n.snapshotData()
+	if err != nil {
+		return err
+	}
+	snapshot, err := n.storage.CreateSnapshot(applied, &confState, data)
+	if err == raft.ErrSnapOutOfDate {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	snapshotData, err := snapshot.Marshal()
+	if err != nil {
+		return err
+	}
+
+	var compactIndex uint64
+	if applied > n.catchUpEntries {
+		compactIndex = applied - n.catchUpEntries
+	}
+
+	tx, err := n.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE raft_state SET snapshot = ?`, snapshotData); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM raft_entries WHERE idx <= ?`, compactIndex); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if compactIndex > 0 {
+		if err := n.storage.Compact(compactIndex); err != nil && err != raft.ErrCompacted {
+			return err
+		}
+	}
+
+	n.mu.Lock()
+	n.snapshotIndex = applied
+	n.mu.Unlock()
+	return nil
+}
+
+// snapshotData encodes the identifier table and the member addresses
+func (n *raftNode) snapshotData() ([]byte, error) {
+	records, err := loadExportRecords(n.db)
+	if err != nil {
+		return nil, err
+	}
+
+	data := raftSnapshotData{Identifiers: records}
+	var lastReap, pausedSince sql.NullTime
+	if err := n.db.QueryRow(`SELECT last_tick, paused_since FROM reaper_state`).Scan(&lastReap, &pausedSince); err != nil {
+		return nil, err
+	}
+	if lastReap.Valid {
+		data.LastReap = &lastReap.Time
+	}
+	if pausedSince.Valid {
+		data.ReapPausedSince = &pausedSince.Time
+	}
+
+	growth, err := poolGrowth(n.db)
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range growth {
+		data.Growth = append(data.Growth, pool...)
+	}
+
+	if data.Cursors, err = loadAllocationCursors(n.db); err != nil {
+		return nil, err
+	}
+
+	if data.Outbox, err = loadOutbox(n.db); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	data.Members = make(map[uint64]string, len(n.members))
+	for id, url := range n.members {
+		data.Members[id] = url
+	}
+	n.mu.Unlock()
+
+	return json.Marshal(data)
+}
+
+// restoreSnapshot replaces the identifier table and the members with a snapshot's. No events
+// are published for the changes it makes.
+func (n *raftNode) restoreSnapshot(snapshot raftpb.Snapshot) error {
+	var data raftSnapshotData
+	if err := json.Unmarshal(snapshot.Data, &data); err != nil {
+		return err
+	}
+	confStateData, err := snapshot.Metadata.ConfState.Marshal()
+	if err != nil {
+		return err
+	}
+
+	tx, err := n.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM identifiers`); err != nil {
+		return err
+	}
+	insert, err := tx.Prepare(`
+		INSERT INTO identifiers (identifier, pool, sort_key, locked_by, last_seen, released_at, metadata, ttl, released_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for i, r := range data.Identifiers {
+		var lockedBy, lastSeen, releasedAt, releasedBy interface{}
+		if r.LockedBy != "" {
+			lockedBy = r.LockedBy
+		}
+		if r.ReleasedBy != "" {
+			releasedBy = r.ReleasedBy
+		}
+		if r.LastSeen != nil {
+			lastSeen = r.LastSeen.Local()
+		}
+		if r.ReleasedAt != nil {
+			releasedAt = r.ReleasedAt.Local()
+		}
+		// The snapshot lists identifiers in natural order, which is all sort keys encode
+		ttl := ttlColumn(time.Duration(r.TTLSeconds) * time.Second)
+		if _, err := insert.Exec(r.Identifier, r.Pool, i+1, lockedBy, lastSeen, releasedAt, r.Metadata, ttl, releasedBy); err != nil {
+			return err
+		}
+	}
+
+	var lastReap, pausedSince interface{}
+	if data.LastReap != nil {
+		lastReap = data.LastReap.Local()
+	}
+	if data.ReapPausedSince != nil {
+		pausedSince = data.ReapPausedSince.Local()
+	}
+	if _, err := tx.Exec(`UPDATE reaper_state SET last_tick = ?, paused_since = ?`, lastReap, pausedSince); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM pool_growth`); err != nil {
+		return err
+	}
+	for _, g := range data.Growth {
+		_, err := tx.Exec(`INSERT INTO pool_growth (pool, block, size, added_at) VALUES (?, ?, ?, ?)`,
+			g.Pool, g.Block, g.Size, g.AddedAt.Local())
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM allocation_cursors`); err != nil {
+		return err
+	}
+	for pool, identifier := range data.Cursors {
+		if _, err := tx.Exec(`INSERT INTO allocation_cursors (pool, identifier) VALUES (?, ?)`, pool, identifier); err != nil {
+			return err
+		}
+	}
+
+	if err := replaceOutbox(tx, data.Outbox); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM raft_members`); err != nil {
+		return err
+	}
+	for id, url := range data.Members {
+		if _, err := tx.Exec(`INSERT INTO raft_members (id, url) VALUES (?, ?)`, id, url); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE raft_state SET conf_state = ?, applied = ?`, confStateData, snapshot.Metadata.Index); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.members = make(map[uint64]string, len(data.Members))
+	for id, url := range data.Members {
+		n.members[id] = url
+	}
+	n.confState = snapshot.Metadata.ConfState
+	n.applied = snapshot.Metadata.Index
+	n.snapshotIndex = snapshot.Metadata.Index
+	n.mu.Unlock()
+
+	log.Printf("Raft node %d restored %d identifiers from a snapshot at index %d", n.id, len(data.Identifiers), snapshot.Metadata.Index)
+	return nil
+}
+
+// send queues messages for delivery to their members. Raft retries anything that is lost.
+func (n *raftNode) send(messages []raftpb.Message) {
+	for _, m := range messages {
+		select {
+		case n.queue(m.To) <- m:
+		default:
+			n.reportFailure(m)
+		}
+	}
+}
+
+// queue returns the outgoing queue of a member, starting its delivery the first time
+func (n *raftNode) queue(to uint64) chan raftpb.Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	queue, ok := n.queues[to]
+	if !ok {
+		queue = make(chan raftpb.Message, 256)
+		n.queues[to] = queue
+		go n.deliver(queue)
+	}
+	return queue
+}
+
+// deliver posts the messages of one member's queue in order until the node stops
+func (n *raftNode) deliver(queue chan raftpb.Message) {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case m := <-queue:
+			if err := n.post(m); err != nil {
+				n.reportFailure(m)
+			} else if m.Type == raftpb.MsgSnap {
+				n.node.ReportSnapshot(m.To, raft.SnapshotFinish)
+			}
+		}
+	}
+}
+
+func (n *raftNode) reportFailure(m raftpb.Message) {
+	n.node.ReportUnreachable(m.To)
+	if m.Type == raftpb.MsgSnap {
+		n.node.ReportSnapshot(m.To, raft.SnapshotFailure)
+	}
+}
+
+// post sends a message to its member's /raft/message endpoint
+func (n *raftNode) post(m raftpb.Message) error {
+	n.mu.Lock()
+	url, ok := n.members[m.To]
+	n.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no address for member %d", m.To)
+	}
+
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url+"/raft/message", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Raft-Signature", "sha256="+n.sign(data))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("member %d: %s", m.To, resp.Status)
+	}
+	return nil
+}
+
+func (n *raftNode) setLeader(lead uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	wasLeader := n.lead == n.id
+	n.lead = lead
+	if isLeader := lead == n.id; isLeader != wasLeader {
+		n.changes++
+		if isLeader {
+			log.Printf("Raft node %d is now the leader", n.id)
+			go n.resumeLeases(time.Now())
+		} else {
+			log.Printf("Raft node %d lost leadership to %d", n.id, lead)
+		}
+	}
+}
+
+// isLeader reports whether this node is the Raft leader
+func (n *raftNode) isLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.lead == n.id
+}
+
+// leader returns the current leader, or 0 if there is none, and the number of times this
+// node has gained or lost leadership
+func (n *raftNode) leader() (uint64, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.lead, n.changes
+}
+
+// status reports this node's view of the cluster
+func (n *raftNode) status() RaftStatus {
+	st := n.node.Status()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	s := RaftStatus{
+		NodeID:        n.id,
+		Leader:        n.lead,
+		Role:          RoleFollower,
+		Term:          st.Term,
+		CommitIndex:   st.Commit,
+		AppliedIndex:  n.applied,
+		SnapshotIndex: n.snapshotIndex,
+		Members:       []RaftMember{},
+	}
+	if n.lead == n.id {
+		s.Role = RoleLeader
+	}
+
+	learners := make(map[uint64]bool)
+	for _, id := range n.confState.Learners {
+		learners[id] = true
+	}
+	for id, url := range n.members {
+		s.Members = append(s.Members, RaftMember{ID: id, URL: url, Learner: learners[id]})
+	}
+	sort.Slice(s.Members, func(i, j int) bool { return s.Members[i].ID < s.Members[j].ID })
+	return s
+}
+
+// await registers for the result of the entry tagged id, proposes it, and waits until this
+// node has applied it
+func (n *raftNode) await(id string, propose func(context.Context) error) (raftResult, error) {
+	result := make(chan raftResult, 1)
+	n.mu.Lock()
+	n.waiters[id] = result
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.waiters, id)
+		n.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.proposalTimeout)
+	defer cancel()
+
+	if err := propose(ctx); err != nil {
+		return raftResult{}, fmt.Errorf("raft: %v", err)
+	}
+	select {
+	case r := <-result:
+		return r, nil
+	case <-ctx.Done():
+		return raftResult{}, errRaftTimeout
+	}
+}
+
+// respond hands the result of an applied entry to the proposer waiting for it, if it is here
+func (n *raftNode) respond(id string, result raftResult) {
+	n.mu.Lock()
+	waiter, ok := n.waiters[id]
+	n.mu.Unlock()
+
+	if ok {
+		waiter <- result
+	}
+}
+
+// propose replicates a command and returns its result. A follower forwards the proposal to
+// the leader, and returns once it has applied the entry itself.
+func (n *raftNode) propose(cmd raftCommand) (raftResult, error) {
+	cmd.ID = uuid.NewString()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return raftResult{}, err
+	}
+	return n.await(cmd.ID, func(ctx context.Context) error {
+		return n.node.Propose(ctx, data)
+	})
+}
+
+// changeMembership proposes a membership change and waits until this node has applied it
+func (n *raftNode) changeMembership(cc raftpb.ConfChange, url string) error {
+	id := uuid.NewString()
+	member, err := json.Marshal(raftMemberContext{ID: id, URL: url})
+	if err != nil {
+		return err
+	}
+	cc.Context = member
+
+	_, err = n.await(id, func(ctx context.Context) error {
+		return n.node.ProposeConfChange(ctx, cc)
+	})
+	return err
+}
+
+// allocateIdentifiers replicates allocateIdentifiers
+func (n *raftNode) allocateIdentifiers(pool, clientID string, count int, ttl time.Duration, metadata Metadata, now time.Time) ([]string, error) {
+	r, err := n.propose(raftCommand{Op: raftAllocate, Time: now, Pool: pool, ClientID: clientID, Count: count, TTL: ttl, Metadata: metadata})
+	if err != nil {
+		return nil, err
+	}
+	return r.identifiers, r.err
+}
+
+// touchClientIdentifiers replicates touchClientIdentifiers
+func (n *raftNode) touchClientIdentifiers(clientID string, identifiers []string, metadata Metadata, now time.Time) (int, error) {
+	r, err := n.propose(raftCommand{Op: raftHeartbeat, Time: now, ClientID: clientID, Identifiers: identifiers, Metadata: metadata})
+	if err != nil {
+		return 0, err
+	}
+	return r.touched, r.err
+}
+
+// recordLiveness replicates recordLiveness
+func (n *raftNode) recordLiveness(req LivenessRequest, now time.Time) (livenessResult, error) {
+	r, err := n.propose(raftCommand{Op: raftHeartbeat, Time: now, ClientID: req.ClientID, Identifier: req.Identifier, Metadata: req.Metadata})
+	if err != nil {
+		return livenessResult{}, err
+	}
+	return r.liveness, r.err
+}
+
+// recordLivenessBatch replicates recordLivenessBatch
+func (n *raftNode) recordLivenessBatch(entries []LivenessRequest, now time.Time) ([]livenessResult, error) {
+	r, err := n.propose(raftCommand{Op: raftHeartbeatBatch, Time: now, Entries: entries})
+	if err != nil {
+		return nil, err
+	}
+	return r.batch, r.err
+}
+
+// releaseIdentifiers replicates releaseIdentifiersTx
+func (n *raftNode) releaseIdentifiers(clientID, identifier string, now time.Time) ([]Event, error) {
+	r, err := n.propose(raftCommand{Op: raftRelease, Time: now, ClientID: clientID, Identifier: identifier})
+	if err != nil {
+		return nil, err
+	}
+	return r.events, r.err
+}
+
+// reapStaleIdentifiers replicates reapStaleIdentifiers
+func (n *raftNode) reapStaleIdentifiers(now time.Time, force bool) ([]Event, error) {
+	r, err := n.propose(raftCommand{Op: raftReap, Time: now, Force: force})
+	if err != nil {
+		return nil, err
+	}
+	return r.events, r.err
+}
+
+// resumeLeases replicates extendLeasesAfterDowntime. A new leader proposes it before the reaper
+// first runs, so that leases are extended at once if the whole cluster was down.
+func (n *raftNode) resumeLeases(now time.Time) {
+	r, err := n.propose(raftCommand{Op: raftResume, Time: now})
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		log.Printf("Error extending leases after downtime: %v", err)
+	}
+}
+
+// reapClientIdentifiers replicates reapClientIdentifiers
+func (n *raftNode) reapClientIdentifiers(clientID string, identifiers []string, now time.Time) ([]Event, error) {
+	r, err := n.propose(raftCommand{Op: raftReap, Time: now, ClientID: clientID, Identifiers: identifiers})
+	if err != nil {
+		return nil, err
+	}
+	return r.events, r.err
+}
+
+// resizePool replicates resizePool
+func (n *raftNode) resizePool(grow bool, pool string, block int, identifiers []string, now time.Time) error {
+	op := raftShrink
+	if grow {
+		op = raftGrow
+	}
+	r, err := n.propose(raftCommand{Op: op, Time: now, Pool: pool, Count: block, Identifiers: identifiers})
+	if err != nil {
+		return err
+	}
+	return r.err
+}
+
+// alert replicates events that change no identifier, so that every node publishes them and
+// queues their webhook deliveries
+func (n *raftNode) alert(batch []Event, now time.Time) error {
+	r, err := n.propose(raftCommand{Op: raftAlert, Time: now, Events: batch})
+	if err != nil {
+		return err
+	}
+	return r.err
+}
+
+// markDeliveries replicates markDeliveries
+func (n *raftNode) markDeliveries(marks []deliveryMark, now time.Time) (int, error) {
+	r, err := n.propose(raftCommand{Op: raftDeliveries, Time: now, Deliveries: marks})
+	if err != nil {
+		return 0, err
+	}
+	return r.touched, r.err
+}
+
+// clusterHandler serves a Raft endpoint of this node, or 404 when raft is not enabled
+func clusterHandler(h func(*raftNode, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cluster == nil {
+			http.Error(w, "Raft is not enabled", http.StatusNotFound)
+			return
+		}
+		h(cluster, w, r)
+	}
+}
+
+// sign returns the hex HMAC-SHA256 of a message with the cluster secret
+func (n *raftNode) sign(data []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// messageHandler receives a Raft message from another member. Messages not signed with the
+// cluster secret are rejected.
+func (n *raftNode) messageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	signature := strings.TrimPrefix(r.Header.Get("X-Raft-Signature"), "sha256=")
+	if !hmac.Equal([]byte(signature), []byte(n.sign(body))) {
+		log.Printf("Raft message from %s rejected: bad signature", r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var m raftpb.Message
+	if err := m.Unmarshal(body); err != nil {
+		http.Error(w, "Invalid raft message", http.StatusBadRequest)
+		return
+	}
+
+	if err := n.node.Step(r.Context(), m); err != nil {
+		http.Error(w, "Raft node unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized reports whether a membership request carries the cluster secret as a bearer
+// token, and rejects it if not
+func (n *raftNode) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !hmac.Equal([]byte(token), n.secret) {
+		log.Printf("Raft membership request from %s rejected: bad secret", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// statusHandler reports this node's view of the cluster
+func (n *raftNode) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.status())
+}
+
+// membersHandler adds a member, or promotes a learner to a voting member
+func (n *raftNode) membersHandler(w http.ResponseWriter, r *http.Request) {
+	if !n.authorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RaftMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ID == 0 || req.URL == "" {
+		http.Error(w, "id and url are required", http.StatusBadRequest)
+		return
+	}
+
+	cc := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: req.ID}
+	if req.Learner {
+		cc.Type = raftpb.ConfChangeAddLearnerNode
+	}
+	if err := n.changeMembership(cc, req.URL); err != nil {
+		log.Printf("Error adding raft member %d: %v", req.ID, err)
+		http.Error(w, "Cluster unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Raft member %d added at %s (learner: %t)", req.ID, req.URL, req.Learner)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.status())
+}
+
+// memberHandler removes a member
+func (n *raftNode) memberHandler(w http.ResponseWriter, r *http.Request) {
+	if !n.authorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid member id", http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	_, ok := n.members[id]
+	voters := n.confState.Voters
+	n.mu.Unlock()
+	if !ok {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	// The leader stops replicating to a removed member, which may never learn of its removal
+	if id == n.id {
+		http.Error(w, "A member cannot remove itself; send the request to another member", http.StatusBadRequest)
+		return
+	}
+	if len(voters) == 1 && voters[0] == id {
+		http.Error(w, "Cannot remove the last voting member", http.StatusBadRequest)
+		return
+	}
+
+	if err := n.changeMembership(raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: id}, ""); err != nil {
+		log.Printf("Error removing raft member %d: %v", id, err)
+		http.Error(w, "Cluster unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Raft member %d removed", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n.status())
+}
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/raft/v3/raftpb"
+)
+
+// testRaftMember is a node of an in-process cluster. Its HTTP server outlives the node, so
+// that the node can be stopped and restarted on the same address.
+type testRaftMember struct {
+	id     uint64
+	db     *sql.DB
+	server *httptest.Server
+
+	mu   sync.Mutex
+	node *raftNode
+}
+
+func (m *testRaftMember) current() *raftNode {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.node
+}
+
+// handle serves a Raft endpoint of the running node, and 503 while it is stopped
+func (m *testRaftMember) handle(h func(*raftNode, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := m.current()
+		if n == nil {
+			http.Error(w, "Raft node unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h(n, w, r)
+	}
+}
+
+// testRaftSecret signs the messages of the test clusters
+const testRaftSecret = "raft-test-secret"
+
+// testRaftCluster is a cluster of nodes in this process, talking over loopback HTTP. Each
+// node has its own copy of the test database.
+type testRaftCluster struct {
+	t               *testing.T
+	snapshotEntries uint64
+	members         map[uint64]*testRaftMember
+}
+
+// newTestRaftCluster starts a cluster of size nodes, numbered from 1
+func newTestRaftCluster(t *testing.T, size int, snapshotEntries uint64) *testRaftCluster {
+	t.Helper()
+
+	c := &testRaftCluster{t: t, snapshotEntries: snapshotEntries, members: make(map[uint64]*testRaftMember)}
+	for id := uint64(1); id <= uint64(size); id++ {
+		c.add(id)
+	}
+	for id := range c.members {
+		c.start(id, false)
+	}
+	return c
+}
+
+// add creates a member that is not running yet, with its own database and address
+func (c *testRaftCluster) add(id uint64) *testRaftMember {
+	c.t.Helper()
+
+	path := filepath.Join(c.t.TempDir(), fmt.Sprintf("node-%d.db", id))
+	if err := backupDatabase(path); err != nil {
+		c.t.Fatalf("copy database for node %d: %v", id, err)
+	}
+	settings := DatabaseConfig{Driver: "sqlite3", Datasource: path}
+	settings.applyDefaults()
+	conn, err := openDatabase(settings)
+	if err != nil {
+		c.t.Fatalf("open database for node %d: %v", id, err)
+	}
+
+	m := &testRaftMember{id: id, db: conn}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/message", m.handle((*raftNode).messageHandler))
+	mux.HandleFunc("/admin/raft", m.handle((*raftNode).statusHandler))
+	mux.HandleFunc("/admin/raft/members", m.handle((*raftNode).membersHandler))
+	mux.HandleFunc("/admin/raft/members/{id}", m.handle((*raftNode).memberHandler))
+	m.server = httptest.NewServer(mux)
+
+	c.t.Cleanup(func() {
+		c.stop(id)
+		m.server.Close()
+		conn.Close()
+	})
+	c.members[id] = m
+	return m
+}
+
+// peers lists the members added so far
+func (c *testRaftCluster) peers() []RaftPeer {
+	var peers []RaftPeer
+	for id, m := range c.members {
+		peers = append(peers, RaftPeer{ID: id, URL: m.server.URL})
+	}
+	return peers
+}
+
+// start runs the node of a member, from its saved state if it has any
+func (c *testRaftCluster) start(id uint64, join bool) *raftNode {
+	c.t.Helper()
+
+	m := c.members[id]
+	rc := RaftConfig{
+		Enabled:         true,
+		NodeID:          id,
+		ListenAddress:   m.server.Listener.Addr().String(),
+		Secret:          testRaftSecret,
+		Peers:           c.peers(),
+		Join:            join,
+		TickInterval:    10 * time.Millisecond,
+		SnapshotEntries: c.snapshotEntries,
+	}
+	if err := rc.applyDefaults(); err != nil {
+		c.t.Fatalf("node %d config: %v", id, err)
+	}
+
+	n, err := newRaftNode(m.db, rc, nil)
+	if err != nil {
+		c.t.Fatalf("start node %d: %v", id, err)
+	}
+	m.mu.Lock()
+	m.node = n
+	m.mu.Unlock()
+	return n
+}
+
+// stop stops the node of a member, if it is running
+func (c *testRaftCluster) stop(id uint64) {
+	m := c.members[id]
+	m.mu.Lock()
+	n := m.node
+	m.node = nil
+	m.mu.Unlock()
+
+	if n != nil {
+		n.close()
+	}
+}
+
+// leader waits for the running nodes to agree on a leader, and returns it
+func (c *testRaftCluster) leader() *raftNode {
+	c.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []uint64
+		var running []*raftNode
+		for _, m := range c.members {
+			if n := m.current(); n != nil {
+				running = append(running, n)
+				lead, _ := n.leader()
+				leaders = append(leaders, lead)
+			}
+		}
+		agreed := leaders[0] != 0
+		for _, lead := range leaders {
+			agreed = agreed && lead == leaders[0]
+		}
+		if agreed {
+			for _, n := range running {
+				if n.id == leaders[0] {
+					return n
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("the cluster did not elect a leader")
+	return nil
+}
+
+// follower returns a running node that is not the leader
+func (c *testRaftCluster) follower() *raftNode {
+	c.t.Helper()
+
+	leader := c.leader()
+	for _, m := range c.members {
+		if n := m.current(); n != nil && n != leader {
+			return n
+		}
+	}
+	c.t.Fatal("the cluster has no follower")
+	return nil
+}
+
+// converge waits until every running node holds the same identifier table, and returns it
+func (c *testRaftCluster) converge() []ExportRecord {
+	c.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var tables [][]ExportRecord
+		for _, m := range c.members {
+			if m.current() == nil {
+				continue
+			}
+			records, err := loadExportRecords(m.db)
+			if err != nil {
+				c.t.Fatalf("node %d: %v", m.id, err)
+			}
+			tables = append(tables, records)
+		}
+
+		same := true
+		for _, table := range tables[1:] {
+			same = same && len(table) == len(tables[0])
+			for i := 0; same && i < len(table); i++ {
+				same = table[i].equal(tables[0][i])
+			}
+		}
+		if same {
+			return tables[0]
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("the nodes did not converge: %v", tables)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// holders maps every held identifier to its client
+func holders(records []ExportRecord) map[string]string {
+	held := make(map[string]string)
+	for _, r := range records {
+		if r.LockedBy != "" {
+			held[r.Identifier] = r.LockedBy
+		}
+	}
+	return held
+}
+
+func TestRaftClusterReplicatesWrites(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-5]")
+	c := newTestRaftCluster(t, 3, 1000)
+	leader, follower := c.leader(), c.follower()
+	now := time.Now()
+
+	// A follower forwards its proposals to the leader, and answers once it has applied them
+	identifiers, err := follower.allocateIdentifiers(DefaultPool, "a", 2, 0, Metadata{"az": "us-east-1a"}, now)
+	if err != nil || !reflect.DeepEqual(identifiers, []string{"vm-1", "vm-2"}) {
+		t.Fatalf("allocate through a follower: %v, %v", identifiers, err)
+	}
+	if identifiers, err := leader.allocateIdentifiers(DefaultPool, "b", 1, 0, nil, now); err != nil || !reflect.DeepEqual(identifiers, []string{"vm-3"}) {
+		t.Fatalf("allocate through the leader: %v, %v", identifiers, err)
+	}
+	if _, err := leader.allocateIdentifiers(DefaultPool, "c", 3, 0, nil, now); err != sql.ErrNoRows {
+		t.Fatalf("allocating more than is free: %v, want sql.ErrNoRows", err)
+	}
+
+	result, err := follower.recordLiveness(LivenessRequest{ClientID: "b", Identifier: "vm-1"}, now.Add(time.Second))
+	if err != nil || result.Status != LivenessConflict || result.Owner != "a" {
+		t.Fatalf("conflicting probe: %+v, %v", result, err)
+	}
+	if touched, err := follower.touchClientIdentifiers("a", nil, nil, now.Add(time.Minute)); err != nil || touched != 2 {
+		t.Fatalf("probe for all of a's identifiers: %d, %v", touched, err)
+	}
+	if released, err := follower.releaseIdentifiers("a", "vm-2", now.Add(time.Minute)); err != nil || len(released) != 1 {
+		t.Fatalf("release: %v, %v", released, err)
+	}
+
+	if got, want := holders(c.converge()), map[string]string{"vm-1": "a", "vm-3": "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("held %v, want %v", got, want)
+	}
+
+	// b stopped probing a minute before a did
+	reaped, err := leader.reapStaleIdentifiers(now.Add(time.Minute+config.Server.StaleTimeout), false)
+	if err != nil || len(reaped) != 1 || reaped[0].Identifier != "vm-3" {
+		t.Fatalf("reap: %v, %v", reaped, err)
+	}
+	if got, want := holders(c.converge()), map[string]string{"vm-1": "a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("held %v after the reap, want %v", got, want)
+	}
+
+	// Pool growth is replicated too
+	if err := follower.resizePool(true, DefaultPool, 1, []string{"vm-6", "vm-7"}, now); err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+	if records := c.converge(); len(records) != 7 {
+		t.Fatalf("%d identifiers after growing, want 7", len(records))
+	}
+}
+
+func TestRaftLivenessBatchReachesEveryNode(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-5]")
+	c := newTestRaftCluster(t, 3, 1000)
+	follower := c.follower()
+	now := time.Now()
+
+	if _, err := follower.allocateIdentifiers(DefaultPool, "a", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+
+	// The batch endpoint of a follower goes through the log like any other write
+	cluster = follower
+	t.Cleanup(func() { cluster = nil })
+	body := `{"entries":[{"client_id":"a","identifier":"vm-1"},{"client_id":"c","identifier":"vm-4"},{"client_id":"c","identifier":"vm-9"}]}`
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/liveness/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch = %d %s", rec.Code, rec.Body)
+	}
+	var resp LivenessBatchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	var statuses []LivenessStatus
+	for _, r := range resp.Results {
+		statuses = append(statuses, r.Status)
+	}
+	if want := []LivenessStatus{LivenessOK, LivenessReassociated, LivenessNotFound}; !reflect.DeepEqual(statuses, want) {
+		t.Fatalf("statuses %v, want %v", statuses, want)
+	}
+
+	records := c.converge()
+	if got, want := holders(records), map[string]string{"vm-1": "a", "vm-4": "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("held %v, want %v", got, want)
+	}
+	for _, r := range records {
+		if r.Identifier == "vm-1" && (r.LastSeen == nil || !r.LastSeen.After(now)) {
+			t.Fatalf("vm-1 last seen %v on every node, want the batch's probe", r.LastSeen)
+		}
+	}
+}
+
+func TestRaftRejectsUnsignedMessages(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	c := newTestRaftCluster(t, 1, 1000)
+	leader := c.leader()
+
+	// A forged vote for a later term would depose the leader if it were stepped
+	forged := raftpb.Message{Type: raftpb.MsgVote, From: 2, To: leader.id, Term: 100}
+	data, err := forged.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := c.members[leader.id].server.URL + "/raft/message"
+
+	for name, signature := range map[string]string{
+		"unsigned":          "",
+		"wrong secret":      "sha256=" + (&raftNode{secret: []byte("guess")}).sign(data),
+		"signature of body": "sha256=" + leader.sign([]byte("other")),
+	} {
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+		if signature != "" {
+			req.Header.Set("X-Raft-Signature", signature)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s message = %d, want 401", name, resp.StatusCode)
+		}
+	}
+
+	if status := leader.status(); status.Term >= 100 || status.Role != RoleLeader {
+		t.Fatalf("forged messages reached the node: %+v", status)
+	}
+}
+
+func TestRaftMembershipRequiresSecret(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	c := newTestRaftCluster(t, 1, 1000)
+	leader := c.leader()
+	url := c.members[leader.id].server.URL
+
+	body := `{"id": 2, "url": "http://127.0.0.1:2"}`
+	for name, auth := range map[string]string{
+		"unsigned":     "",
+		"wrong secret": "Bearer guess",
+		"not bearer":   testRaftSecret,
+	} {
+		for _, req := range []*http.Request{
+			httptest.NewRequest("POST", url+"/admin/raft/members", strings.NewReader(body)),
+			httptest.NewRequest("DELETE", url+"/admin/raft/members/1", nil),
+		} {
+			req.RequestURI = ""
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%s %s %s = %d, want 401", name, req.Method, req.URL.Path, resp.StatusCode)
+			}
+		}
+	}
+	if members := leader.status().Members; len(members) != 1 {
+		t.Fatalf("members changed to %+v", members)
+	}
+
+	// The API port does not serve membership changes at all
+	cluster = leader
+	t.Cleanup(func() { cluster = nil })
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("POST", "/admin/raft/members", strings.NewReader(body)))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("membership change on the API port = %d, want 404", rec.Code)
+	}
+}
+
+func TestRaftLeaderFailover(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-5]")
+	c := newTestRaftCluster(t, 3, 1000)
+	now := time.Now()
+
+	if _, err := c.leader().allocateIdentifiers(DefaultPool, "a", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	c.converge()
+
+	old := c.leader()
+	c.stop(old.id)
+
+	// The other two elect a leader between them and carry on
+	leader := c.leader()
+	if leader.id == old.id {
+		t.Fatal("the stopped node is still the leader")
+	}
+	if identifiers, err := leader.allocateIdentifiers(DefaultPool, "b", 1, 0, nil, now); err != nil || !reflect.DeepEqual(identifiers, []string{"vm-2"}) {
+		t.Fatalf("allocate after failover: %v, %v", identifiers, err)
+	}
+
+	// The old leader restarts from its database and catches up
+	c.start(old.id, false)
+	if got, want := holders(c.converge()), map[string]string{"vm-1": "a", "vm-2": "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("held %v after the old leader rejoined, want %v", got, want)
+	}
+}
+
+func TestRaftAppliesOnlyRejectedCommandsThatFail(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	if err := initRaftTables(db); err != nil {
+		t.Fatal(err)
+	}
+	n := &raftNode{db: db}
+
+	entry := func(index uint64, cmd raftCommand) raftpb.Entry {
+		t.Helper()
+		cmd.Time = time.Now()
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raftpb.Entry{Index: index, Type: raftpb.EntryNormal, Data: data}
+	}
+	applied := func() uint64 {
+		t.Helper()
+		var index uint64
+		if err := db.QueryRow(`SELECT applied FROM raft_state`).Scan(&index); err != nil {
+			t.Fatal(err)
+		}
+		return index
+	}
+
+	// Every node rejects an allocation from an unknown pool, so it is applied as a no-op
+	if err := n.applyCommand(entry(1, raftCommand{Op: raftAllocate, Pool: "gpu", ClientID: "a", Count: 1})); err != nil {
+		t.Fatalf("apply a rejected command: %v", err)
+	}
+	if got := applied(); got != 1 {
+		t.Fatalf("applied index %d after a rejected command, want 1", got)
+	}
+
+	// A failure of this node's database is not recorded as applied
+	if _, err := db.Exec(`ALTER TABLE identifiers RENAME TO moved`); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.applyCommand(entry(2, raftCommand{Op: raftAllocate, Pool: DefaultPool, ClientID: "a", Count: 1})); err == nil {
+		t.Fatal("an entry the database failed to apply was applied")
+	}
+	if got := applied(); got != 1 {
+		t.Fatalf("applied index %d after a local failure, want 1", got)
+	}
+	if _, err := db.Exec(`ALTER TABLE moved RENAME TO identifiers`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaftSnapshotCarriesRoundRobinCursor(t *testing.T) {
+	setupTestDB(t, StrategyRoundRobin, "vm-[1-5]")
+	c := newTestRaftCluster(t, 3, 20)
+	now := time.Now()
+
+	if _, err := c.leader().allocateIdentifiers(DefaultPool, "a", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	c.converge()
+
+	// The cursor moves on while one node is down
+	lagging := c.follower()
+	c.stop(lagging.id)
+	leader := c.leader()
+	if _, err := leader.allocateIdentifiers(DefaultPool, "b", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if _, err := leader.releaseIdentifiers("b", "vm-2", now); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	// Enough probes that the node has to catch up from a snapshot taken after the move
+	for i := 0; i < raftCatchUpEntries+2*20; i++ {
+		if _, err := leader.touchClientIdentifiers("a", nil, nil, now.Add(time.Duration(i)*time.Millisecond)); err != nil {
+			t.Fatalf("probe %d: %v", i, err)
+		}
+	}
+	restarted := c.start(lagging.id, false)
+	c.converge()
+	if restarted.status().SnapshotIndex == 0 {
+		t.Fatal("the node caught up without a snapshot")
+	}
+
+	// The restored cursor makes it pick the same identifier as the others
+	if _, err := restarted.allocateIdentifiers(DefaultPool, "c", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate after the snapshot: %v", err)
+	}
+	if got, want := holders(c.converge()), map[string]string{"vm-1": "a", "vm-3": "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("held %v, want %v", got, want)
+	}
+}
+
+// outboxStatuses maps the IDs of a node's webhook deliveries to their status
+func outboxStatuses(t *testing.T, m *testRaftMember) map[int64]string {
+	t.Helper()
+
+	records, err := loadOutbox(m.db)
+	if err != nil {
+		t.Fatalf("node %d outbox: %v", m.id, err)
+	}
+	statuses := make(map[int64]string)
+	for _, r := range records {
+		statuses[r.ID] = r.Status
+	}
+	return statuses
+}
+
+// awaitOutbox waits until every running node's outbox is want
+func (c *testRaftCluster) awaitOutbox(want map[int64]string) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		same := true
+		for _, m := range c.members {
+			if m.current() != nil && !reflect.DeepEqual(outboxStatuses(c.t, m), want) {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+		if time.Now().After(deadline) {
+			for _, m := range c.members {
+				c.t.Logf("node %d outbox: %v", m.id, outboxStatuses(c.t, m))
+			}
+			c.t.Fatalf("the outboxes did not reach %v", want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftWebhookDeliveriesSurviveFailover(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-5]")
+	rec := &webhookReceiver{status: http.StatusOK}
+	receiver := httptest.NewServer(rec)
+	defer receiver.Close()
+	config.Webhooks = []WebhookConfig{{Name: "ops", URL: receiver.URL, Timeout: time.Second, MaxAttempts: 3}}
+
+	c := newTestRaftCluster(t, 3, 1000)
+	now := time.Now()
+
+	old := c.leader()
+	for _, client := range []string{"a", "b"} {
+		if _, err := old.allocateIdentifiers(DefaultPool, client, 1, 0, nil, now); err != nil {
+			t.Fatalf("allocate for %s: %v", client, err)
+		}
+	}
+
+	// Every node queues each delivery once, under the same ID
+	queued := outboxStatuses(t, c.members[old.id])
+	if len(queued) != 2 {
+		t.Fatalf("leader queued %v, want 2 deliveries", queued)
+	}
+	c.awaitOutbox(queued)
+
+	if err := deliverWebhooks(old.db, time.Now(), old.markDeliveries); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	delivered := make(map[int64]string)
+	for id := range queued {
+		delivered[id] = DeliveryDelivered
+	}
+	c.awaitOutbox(delivered)
+
+	// The new leader only delivers what was queued since
+	c.stop(old.id)
+	leader := c.leader()
+	if _, err := leader.allocateIdentifiers(DefaultPool, "c", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate after failover: %v", err)
+	}
+	if err := deliverWebhooks(leader.db, time.Now(), leader.markDeliveries); err != nil {
+		t.Fatalf("deliver after failover: %v", err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, req := range rec.requests {
+		id := req.Header.Get("X-Registry-Delivery")
+		if seen[id] {
+			t.Errorf("delivery %s was sent twice", id)
+		}
+		seen[id] = true
+	}
+	if len(rec.requests) != 3 {
+		t.Fatalf("receiver got %d requests, want one per allocation", len(rec.requests))
+	}
+}
+
+func TestRaftMembershipChangesAndSnapshots(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-5]")
+	c := newTestRaftCluster(t, 3, 20)
+	now := time.Now()
+
+	follower := c.follower()
+	if _, err := follower.allocateIdentifiers(DefaultPool, "a", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	// Enough probes that the log is compacted past where a new member would start from
+	for i := 0; i < raftCatchUpEntries+2*20; i++ {
+		if _, err := follower.touchClientIdentifiers("a", nil, nil, now.Add(time.Duration(i)*time.Millisecond)); err != nil {
+			t.Fatalf("probe %d: %v", i, err)
+		}
+	}
+	if first, _ := c.leader().storage.FirstIndex(); first <= 1 {
+		t.Fatalf("the leader's log starts at %d, want it compacted", first)
+	}
+
+	admin := func(method, url, body string, want int) RaftStatus {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testRaftSecret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: status %d, want %d", method, url, resp.StatusCode, want)
+		}
+		var status RaftStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		return status
+	}
+	followerURL := c.members[follower.id].server.URL
+
+	// A new node joins as a learner and is sent a snapshot
+	joining := c.add(4)
+	status := admin("POST", followerURL+"/admin/raft/members", fmt.Sprintf(`{"id": 4, "url": %q, "learner": true}`, joining.server.URL), http.StatusOK)
+	if len(status.Members) != 4 || !status.Members[3].Learner {
+		t.Fatalf("members after adding a learner: %+v", status.Members)
+	}
+	newcomer := c.start(4, true)
+	if got, want := holders(c.converge()), map[string]string{"vm-1": "a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("held %v, want %v", got, want)
+	}
+	if newcomer.status().SnapshotIndex == 0 {
+		t.Fatal("the new node caught up without a snapshot")
+	}
+
+	// It is promoted to a voter, and one of the original members leaves
+	status = admin("POST", followerURL+"/admin/raft/members", fmt.Sprintf(`{"id": 4, "url": %q}`, joining.server.URL), http.StatusOK)
+	if status.Members[3].Learner {
+		t.Fatalf("node 4 is still a learner: %+v", status.Members)
+	}
+	remove := fmt.Sprintf("/admin/raft/members/%d", follower.id)
+	admin("DELETE", followerURL+remove, "", http.StatusBadRequest)
+	admin("DELETE", joining.server.URL+remove, "", http.StatusOK)
+	admin("DELETE", joining.server.URL+remove, "", http.StatusNotFound)
+	c.stop(follower.id)
+
+	if _, err := newcomer.allocateIdentifiers(DefaultPool, "b", 1, 0, nil, now); err != nil {
+		t.Fatalf("allocate after the membership changes: %v", err)
+	}
+	if got, want := holders(c.converge()), map[string]string{"vm-1": "a", "vm-2": "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("held %v, want %v", got, want)
+	}
+	if status := newcomer.status(); len(status.Members) != 3 {
+		t.Fatalf("members after the removal: %+v", status.Members)
+	}
+}
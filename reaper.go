@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// reapInterval is how often the leader looks for stale leases
+const reapInterval = 1 * time.Minute
+
+// ReapResult is the outcome of a manual reap
+type ReapResult struct {
+	Reaped int `json:"reaped"`
+}
+
+// initReaperState creates the table the reaper records its runs in, so that after a restart it
+// can tell how long the registry was down
+func initReaperState() {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS reaper_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		last_tick TIMESTAMP,
+		paused_since TIMESTAMP
+	);
+	INSERT OR IGNORE INTO reaper_state (id) VALUES (1);`)
+	if err != nil {
+		log.Fatalf("Failed to create reaper_state table: %v", err)
+	}
+}
+
+// resumeLeases extends leases over an outage of the registry. It runs at startup, before any
+// request is served, so that no client sees its lease as stale for want of a chance to renew it.
+// Under raft the local database must only change through the log, so the new leader proposes
+// the extension instead.
+func resumeLeases(now time.Time) error {
+	if config.Raft.Enabled {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := extendLeasesAfterDowntime(tx, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// extendLeasesAfterDowntime records this run of the reaper. If the previous run was more than an
+// interval late the registry was down in between, and no client could renew its lease, so every
+// lease last seen before the previous run is extended by the length of the outage. Leases that
+// were already stale at the previous run are left for the reaper.
+func extendLeasesAfterDowntime(q queryer, now time.Time) error {
+	var lastTick sql.NullTime
+	if err := q.QueryRow(`SELECT last_tick FROM reaper_state`).Scan(&lastTick); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`UPDATE reaper_state SET last_tick = ?`, now); err != nil {
+		return err
+	}
+
+	if !lastTick.Valid {
+		return nil
+	}
+	outage := now.Sub(lastTick.Time) - reapInterval
+	if outage < reapInterval {
+		return nil
+	}
+
+	// Leases renewed since the registry came back are up to date
+	rows, err := q.Query(`
+		SELECT identifier, last_seen
+		FROM identifiers
+		WHERE locked_by IS NOT NULL AND last_seen <= ? AND NOT (`+staleLease+`)`,
+		append([]interface{}{lastTick.Time}, staleLeaseArgs(lastTick.Time)...)...,
+	)
+	if err != nil {
+		return err
+	}
+
+	lastSeen := make(map[string]time.Time)
+	for rows.Next() {
+		var identifier string
+		var seen time.Time
+		if err := rows.Scan(&identifier, &seen); err != nil {
+			rows.Close()
+			return err
+		}
+		lastSeen[identifier] = seen
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for identifier, seen := range lastSeen {
+		// Timestamps are stored in local time so that they compare correctly as text
+		if _, err := q.Exec(`UPDATE identifiers SET last_seen = ? WHERE identifier = ?`, seen.Add(outage).Local(), identifier); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Reaper did not run for %s; extended %d lease(s) by the outage", outage.Round(time.Second), len(lastSeen))
+	return nil
+}
+
+// guardReap reports whether the reaper must hold back stale leases, because more than the maximum
+// reap fraction of the held leases are stale. The first run it pauses returns a reap_paused alert.
+// force lets the stale leases through.
+func guardReap(q queryer, stale, held int, force bool, now time.Time) (bool, []Event, error) {
+	var pausedSince sql.NullTime
+	if err := q.QueryRow(`SELECT paused_since FROM reaper_state`).Scan(&pausedSince); err != nil {
+		return false, nil, err
+	}
+
+	limit := config.Server.MaxReapFraction
+	if force || limit == 0 || stale <= config.Server.ReapGuardMinimum || float64(stale) <= limit*float64(held) {
+		if pausedSince.Valid {
+			if _, err := q.Exec(`UPDATE reaper_state SET paused_since = NULL`); err != nil {
+				return false, nil, err
+			}
+			log.Printf("Reaping resumed after a pause since %s", pausedSince.Time.Format(time.RFC3339))
+		}
+		return false, nil, nil
+	}
+
+	log.Printf("Reaping paused: %d of %d held lease(s) are stale, more than the maximum reap fraction %g", stale, held, limit)
+	if pausedSince.Valid {
+		return true, nil, nil
+	}
+	if _, err := q.Exec(`UPDATE reaper_state SET paused_since = ?`, now); err != nil {
+		return false, nil, err
+	}
+	return true, []Event{{Type: EventReapPaused, Time: now, Count: stale}}, nil
+}
+
+// reapingPaused reports whether the reaper is holding back stale leases
+func reapingPaused() (bool, error) {
+	var paused bool
+	err := db.QueryRow(`SELECT paused_since IS NOT NULL FROM reaper_state`).Scan(&paused)
+	return paused, err
+}
+
+// reapHandler reaps stale leases now, even if that exceeds the maximum reap fraction
+func reapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reaped, err := reapStaleIdentifiers(time.Now(), true)
+	if err != nil {
+		log.Printf("Error releasing stale identifiers: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Manually expired %d stale lease(s)", len(reaped))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReapResult{Reaped: len(reaped)})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReaperExtendsLeasesAfterDowntime(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1", "vm-2")
+
+	start := time.Now().Add(-2 * time.Hour)
+	for _, client := range []string{"a", "b"} {
+		if _, err := allocateNextIdentifier(db, DefaultPool, client, 0, nil, start); err != nil {
+			t.Fatalf("allocate for %s: %v", client, err)
+		}
+	}
+	if _, err := reapStaleIdentifiers(start.Add(30*time.Second), false); err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+
+	// The registry is down for most of an hour; b renews its lease once it is back
+	if _, err := recordLiveness(db, LivenessRequest{ClientID: "b", Identifier: "vm-2"}, start.Add(time.Hour-30*time.Second)); err != nil {
+		t.Fatalf("liveness: %v", err)
+	}
+	restarted := start.Add(time.Hour)
+	reaped, err := reapStaleIdentifiers(restarted, false)
+	if err != nil {
+		t.Fatalf("reap after downtime: %v", err)
+	}
+	if len(reaped) != 0 {
+		t.Fatalf("reaped %+v right after downtime", reaped)
+	}
+
+	outage := restarted.Sub(start.Add(30*time.Second)) - reapInterval
+	if got := storedLastSeen(t, "vm-1"); !got.Equal(start.Add(outage)) {
+		t.Fatalf("vm-1 last_seen +%s, want +%s", got.Sub(start), outage)
+	}
+	if got := storedLastSeen(t, "vm-2"); !got.Equal(start.Add(time.Hour - 30*time.Second)) {
+		t.Fatalf("vm-2 last_seen +%s, want its renewal", got.Sub(start))
+	}
+
+	// Without further probes a goes stale after the extension
+	if _, err := recordLiveness(db, LivenessRequest{ClientID: "b", Identifier: "vm-2"}, restarted.Add(30*time.Second)); err != nil {
+		t.Fatalf("liveness: %v", err)
+	}
+	reaped, err = reapStaleIdentifiers(restarted.Add(reapInterval+30*time.Second), false)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if len(reaped) != 1 || reaped[0].ClientID != "a" {
+		t.Fatalf("reaped %+v, want a's lease", reaped)
+	}
+}
+
+func TestReaperDoesNotReviveStaleLeasesAfterDowntime(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1", "vm-2")
+
+	start := time.Now().Add(-2 * time.Hour)
+	if _, err := allocateNextIdentifier(db, DefaultPool, "a", 0, nil, start); err != nil {
+		t.Fatalf("allocate for a: %v", err)
+	}
+	if _, err := allocateNextIdentifier(db, DefaultPool, "b", 0, nil, start.Add(100*time.Second)); err != nil {
+		t.Fatalf("allocate for b: %v", err)
+	}
+
+	// The reaper last ran when a was already stale but had not been reaped yet
+	if _, err := db.Exec(`UPDATE reaper_state SET last_tick = ?`, start.Add(2*time.Minute)); err != nil {
+		t.Fatalf("set last tick: %v", err)
+	}
+
+	restarted := start.Add(time.Hour)
+	if err := extendLeasesAfterDowntime(db, restarted); err != nil {
+		t.Fatalf("extend: %v", err)
+	}
+	if got := storedLastSeen(t, "vm-1"); !got.Equal(start) {
+		t.Fatalf("stale vm-1 last_seen moved by %s", got.Sub(start))
+	}
+	outage := restarted.Sub(start.Add(2*time.Minute)) - reapInterval
+	if got := storedLastSeen(t, "vm-2"); !got.Equal(start.Add(100 * time.Second).Add(outage)) {
+		t.Fatalf("vm-2 last_seen +%s, want +%s", got.Sub(start), 100*time.Second+outage)
+	}
+}
+
+func TestLeasesExtendedBeforeServing(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+
+	// The registry last ran two hours ago, with a's lease fresh
+	start := time.Now().Add(-2 * time.Hour)
+	if _, err := allocateNextIdentifier(db, DefaultPool, "a", 0, nil, start); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if _, err := reapStaleIdentifiers(start, false); err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	db.Close()
+
+	// Restarting extends the lease before the first request, not on the first reaper run
+	prepareDatabase()
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	var stats map[string]int
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	if stats["allocated_identifiers"] != 1 || stats["stale_identifiers"] != 0 {
+		t.Fatalf("stats after restart = %v, want a's lease held and not stale", stats)
+	}
+	if got := storedLastSeen(t, "vm-1"); time.Since(got) > reapInterval+time.Minute {
+		t.Fatalf("vm-1 last seen %s ago, want the lease extended over the outage", time.Since(got).Round(time.Second))
+	}
+}
+
+func TestReaperPausesMassExpiry(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-4]")
+	config.Server.MaxReapFraction = 0.5
+
+	start := time.Now().Add(-time.Hour)
+	for _, client := range []string{"a", "b", "c", "d"} {
+		if _, err := allocateNextIdentifier(db, DefaultPool, client, 0, nil, start); err != nil {
+			t.Fatalf("allocate for %s: %v", client, err)
+		}
+	}
+	if _, err := recordLiveness(db, LivenessRequest{ClientID: "d", Identifier: "vm-4"}, start.Add(5*time.Minute)); err != nil {
+		t.Fatalf("liveness: %v", err)
+	}
+
+	// Three of the four leases are stale
+	at := start.Add(5*time.Minute + 30*time.Second)
+	alerts, err := reapStaleIdentifiers(at, false)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if len(alerts) != 1 || alerts[0].Type != EventReapPaused || alerts[0].Count != 3 {
+		t.Fatalf("reap returned %+v, want one reap_paused alert for 3 leases", alerts)
+	}
+	if paused, err := reapingPaused(); err != nil || !paused {
+		t.Fatalf("reapingPaused = %v, %v", paused, err)
+	}
+
+	// The alert is raised once per pause
+	if alerts, err := reapStaleIdentifiers(at.Add(15*time.Second), false); err != nil || len(alerts) != 0 {
+		t.Fatalf("second reap returned %+v, %v", alerts, err)
+	}
+
+	reaped, err := reapStaleIdentifiers(at.Add(30*time.Second), true)
+	if err != nil {
+		t.Fatalf("forced reap: %v", err)
+	}
+	if len(reaped) != 3 {
+		t.Fatalf("forced reap expired %+v, want 3 leases", reaped)
+	}
+	if paused, err := reapingPaused(); err != nil || paused {
+		t.Fatalf("reapingPaused after forced reap = %v, %v", paused, err)
+	}
+}
+
+func TestReaperHonoursLeaseTTL(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-3]")
+	config.Identifiers.MaxPerClient = 1
+	config.Identifiers.TTL = TTLConfig{Default: 90 * time.Second, Min: 30 * time.Second, Max: time.Hour}
+
+	if _, err := allocate(AllocateRequest{ClientID: "a", TTLSeconds: 7200}, time.Now()); err == nil {
+		t.Fatalf("allocated with a TTL above the maximum")
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for _, req := range []AllocateRequest{
+		{ClientID: "runner", TTLSeconds: 30},
+		{ClientID: "builder", TTLSeconds: 3600},
+		{ClientID: "default"},
+	} {
+		if _, err := allocate(req, start); err != nil {
+			t.Fatalf("allocate for %s: %v", req.ClientID, err)
+		}
+	}
+
+	// The runner's lease goes stale long before the stale timeout
+	reaped, err := reapStaleIdentifiers(start.Add(time.Minute), false)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if len(reaped) != 1 || reaped[0].ClientID != "runner" {
+		t.Fatalf("reaped %+v, want the runner's lease", reaped)
+	}
+
+	// The builder's lease outlives the default one
+	result, err := recordLiveness(db, LivenessRequest{ClientID: "builder", Identifier: "vm-2"}, start.Add(30*time.Minute))
+	if err != nil || result.Status != LivenessOK || result.TTL != time.Hour {
+		t.Fatalf("builder liveness = %+v, %v; want ok with a one hour TTL", result, err)
+	}
+	var stale []string
+	rows, err := db.Query(`SELECT locked_by FROM identifiers WHERE `+staleLease, staleLeaseArgs(start.Add(31*time.Minute))...)
+	if err != nil {
+		t.Fatalf("query stale leases: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var clientID string
+		if err := rows.Scan(&clientID); err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		stale = append(stale, clientID)
+	}
+	if len(stale) != 1 || stale[0] != "default" {
+		t.Fatalf("stale leases held by %v, want only the default lease", stale)
+	}
+}
@@ -0,0 +1,4 @@
+// Package registrypb holds the protobuf messages and gRPC service definition of the registry.
+package registrypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative registry.proto
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// watchKeepalive is how often an idle event stream sends a comment to keep proxies from closing it
+	watchKeepalive = 15 * time.Second
+	// defaultPollTimeout and maxPollTimeout bound how long /watch/{client_id} blocks
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+)
+
+type WatchPollResponse struct {
+	Events []Event `json:"events"`
+	Cursor uint64  `json:"cursor"`
+}
+
+// parseCursor reads the resume cursor from the cursor query parameter or the Last-Event-ID header
+func parseCursor(r *http.Request) (uint64, error) {
+	raw := r.URL.Query().Get("cursor")
+	if raw == "" {
+		raw = r.Header.Get("Last-Event-ID")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(raw, 10, 64)
+}
+
+// watchHandler streams lease events as Server-Sent Events. It accepts pool, client_id and
+// types filters, and resumes after the given cursor.
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cursor, err := parseCursor(r)
+	if err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := EventFilter{
+		Pool:     query.Get("pool"),
+		ClientID: query.Get("client_id"),
+		Types:    parseEventTypes(query.Get("types")),
+	}
+
+	if _, _, _, ok := events.since(cursor, filter); !ok {
+		http.Error(w, "Cursor expired", http.StatusGone)
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Error clearing write deadline for watcher: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	keepalive := time.NewTicker(watchKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		matched, changed, next, ok := events.since(cursor, filter)
+		if !ok {
+			// The watcher fell further behind than the event history; it has to resync
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+			rc.Flush()
+			return
+		}
+
+		for _, e := range matched {
+			payload, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, payload)
+		}
+		cursor = next
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+	}
+}
+
+// watchClientHandler long-polls for events concerning a single client, such as the reap or
+// heartbeat loss of its lease. It returns as soon as a matching event exists after the cursor,
+// or with no events once the timeout elapses.
+func watchClientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.PathValue("client_id")
+	if clientID == "" {
+		http.Error(w, "Client ID is required", http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := parseCursor(r)
+	if err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		timeout, err = time.ParseDuration(raw)
+		if err != nil || timeout <= 0 || timeout > maxPollTimeout {
+			http.Error(w, fmt.Sprintf("timeout must be a duration up to %s", maxPollTimeout), http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter := EventFilter{
+		ClientID: clientID,
+		Types:    parseEventTypes(r.URL.Query().Get("types")),
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(timeout + config.Server.WriteTimeout)); err != nil {
+		log.Printf("Error extending write deadline for client %s: %v", clientID, err)
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		matched, changed, next, ok := events.since(cursor, filter)
+		if !ok {
+			http.Error(w, "Cursor expired", http.StatusGone)
+			return
+		}
+		if len(matched) > 0 {
+			writePollResponse(w, matched, next)
+			return
+		}
+		// Nothing after next concerns this client; keep the cursor inside the history
+		cursor = next
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline.C:
+			writePollResponse(w, []Event{}, next)
+			return
+		case <-changed:
+		}
+	}
+}
+
+func writePollResponse(w http.ResponseWriter, matched []Event, cursor uint64) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(WatchPollResponse{Events: matched, Cursor: cursor}); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
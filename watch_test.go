@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useEventBus replaces the global event bus with one retaining size events for the test
+func useEventBus(t *testing.T, size int) *eventBus {
+	t.Helper()
+
+	previous := events
+	events = newEventBus(size)
+	t.Cleanup(func() { events = previous })
+	return events
+}
+
+// pollClient long-polls /watch/{client_id} with the given cursor and query
+func pollClient(t *testing.T, clientID string, cursor uint64, query string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	target := fmt.Sprintf("/watch/%s?cursor=%d&timeout=2s%s", clientID, cursor, query)
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	return rec
+}
+
+func decodePoll(t *testing.T, rec *httptest.ResponseRecorder) WatchPollResponse {
+	t.Helper()
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("poll = %d %s", rec.Code, rec.Body)
+	}
+	var resp WatchPollResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return resp
+}
+
+func TestWatchClientFiltersEvents(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	bus := useEventBus(t, 16)
+	_, _, start, _ := bus.since(0, EventFilter{})
+
+	bus.publish(
+		Event{Type: EventAllocate, Pool: DefaultPool, ClientID: "a", Identifier: "vm-1"},
+		Event{Type: EventAllocate, Pool: DefaultPool, ClientID: "b", Identifier: "vm-2"},
+		Event{Type: EventReap, Pool: DefaultPool, ClientID: "b", Identifier: "vm-2"},
+	)
+
+	resp := decodePoll(t, pollClient(t, "b", start, ""))
+	if len(resp.Events) != 2 || resp.Events[0].ClientID != "b" || resp.Events[1].ClientID != "b" || resp.Cursor != start+3 {
+		t.Fatalf("poll for b = %+v", resp)
+	}
+
+	resp = decodePoll(t, pollClient(t, "b", start, "&types=reap"))
+	if len(resp.Events) != 1 || resp.Events[0].Type != EventReap {
+		t.Fatalf("poll for b reaps = %+v", resp)
+	}
+}
+
+func TestWatchClientRejectsExpiredCursor(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	bus := useEventBus(t, 2)
+	_, _, start, _ := bus.since(0, EventFilter{})
+
+	for i := 1; i <= 3; i++ {
+		bus.publish(Event{Type: EventAllocate, ClientID: "a", Identifier: fmt.Sprintf("vm-%d", i)})
+	}
+
+	if rec := pollClient(t, "a", start, ""); rec.Code != http.StatusGone {
+		t.Fatalf("poll with expired cursor = %d, want 410", rec.Code)
+	}
+}
+
+func TestWatchClientAdvancesPastUnrelatedEvents(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-1")
+	bus := useEventBus(t, 2)
+	_, _, start, _ := bus.since(0, EventFilter{})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- pollClient(t, "b", start, "") }()
+
+	// Other clients' events roll the history past the original cursor while b is waiting
+	for i := 1; i <= 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		bus.publish(Event{Type: EventAllocate, ClientID: "a", Identifier: fmt.Sprintf("vm-%d", i)})
+	}
+	time.Sleep(50 * time.Millisecond)
+	bus.publish(Event{Type: EventReap, ClientID: "b", Identifier: "vm-9"})
+
+	resp := decodePoll(t, <-done)
+	if len(resp.Events) != 1 || resp.Events[0].Identifier != "vm-9" {
+		t.Fatalf("poll for b = %+v", resp)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Delivery states of a webhook outbox entry
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	webhookPollInterval = 1 * time.Second
+	webhookBatchSize    = 100
+	webhookBaseBackoff  = 1 * time.Second
+	webhookMaxBackoff   = 5 * time.Minute
+	// webhookPruneInterval is how often deliveries past server.webhook_retention are deleted
+	webhookPruneInterval = 10 * time.Minute
+)
+
+// WebhookDelivery is one event queued for one webhook
+type WebhookDelivery struct {
+	ID        int64     `json:"id"`
+	Webhook   string    `json:"webhook"`
+	EventID   uint64    `json:"event_id"`
+	EventType EventType `json:"event_type"`
+	Status    string    `json:"status"`
+	// Attempts is the number of attempts made so far; zero keeps the stored count
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// outboxRecord is a whole outbox row, as carried in a Raft snapshot
+type outboxRecord struct {
+	WebhookDelivery
+	Payload string `json:"payload"`
+}
+
+// webhookWake nudges the dispatcher when new deliveries are queued
+var webhookWake = make(chan struct{}, 1)
+
+var webhookClient = &http.Client{}
+
+// initWebhookOutbox creates the table that persists pending deliveries across restarts
+func initWebhookOutbox() {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS webhook_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook TEXT NOT NULL,
+		event_id INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP,
+		last_error TEXT,
+		created_at TIMESTAMP NOT NULL,
+		delivered_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS webhook_outbox_pending ON webhook_outbox (status, next_attempt_at);`)
+	if err != nil {
+		log.Fatalf("Failed to create webhook outbox: %v", err)
+	}
+}
+
+// startWebhookDispatcher delivers the outbox in the background. Deliveries are queued by the
+// transactions that cause the events, and published events wake the dispatcher.
+func startWebhookDispatcher() {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+
+	events.subscribe(func([]Event) { wakeWebhookDispatcher() })
+	go func() {
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		prune := time.NewTicker(webhookPruneInterval)
+		defer prune.Stop()
+
+		for {
+			// Every replica queues its events in the shared outbox; the leader delivers them
+			if isLeader() {
+				if err := deliverPendingWebhooks(time.Now()); err != nil {
+					log.Printf("Error delivering webhooks: %v", err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-webhookWake:
+			case <-prune.C:
+				// Under raft every node has its own outbox to prune
+				if cluster == nil && !isLeader() {
+					continue
+				}
+				if n, err := pruneWebhookOutbox(time.Now()); err != nil {
+					log.Printf("Error pruning webhook deliveries: %v", err)
+				} else if n > 0 {
+					log.Printf("Pruned %d finished webhook deliveries", n)
+				}
+			}
+		}
+	}()
+
+	log.Printf("Webhook dispatcher started for %d webhook(s)", len(config.Webhooks))
+}
+
+// wantsEvent reports whether the webhook subscribes to the event type. No list means all events.
+func (hook WebhookConfig) wantsEvent(t EventType) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, name := range hook.Events {
+		if EventType(name) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// raftDeliveryBits is how many low bits of the ID of a delivery queued by a Raft log entry
+// number the deliveries of that entry; the high bits are the entry's index
+const raftDeliveryBits = 20
+
+// enqueueWebhookEvents writes one outbox row per event and subscribed webhook. Callers pass the
+// transaction that makes the change behind the events, so that the rows commit with it.
+// Deliveries queued by the Raft log entry at index get IDs derived from it, so that every node
+// queues them under the same IDs; index is 0 outside raft.
+func enqueueWebhookEvents(q queryer, batch []Event, index uint64) error {
+	if len(config.Webhooks) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	n := 0
+	for _, e := range batch {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encode event %d: %w", e.ID, err)
+		}
+		for _, hook := range config.Webhooks {
+			if !hook.wantsEvent(e.Type) {
+				continue
+			}
+
+			var id interface{}
+			if index > 0 {
+				if n >= 1<<raftDeliveryBits {
+					return fmt.Errorf("raft entry %d queues too many webhook deliveries", index)
+				}
+				id = int64(index<<raftDeliveryBits) + int64(n)
+				n++
+			}
+			_, err := q.Exec(`
+				INSERT INTO webhook_outbox (id, webhook, event_id, event_type, payload, status, next_attempt_at, created_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				id, hook.Name, e.ID, e.Type, string(payload), DeliveryPending, now, now,
+			)
+			if err != nil {
+				return fmt.Errorf("queue event %d for webhook %s: %w", e.ID, hook.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// wakeWebhookDispatcher makes the dispatcher look for due deliveries without waiting for its ticker
+func wakeWebhookDispatcher() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// deliveryMark records the outcome of delivery attempts. It only applies while the delivery
+// is in status From, so that a mark that arrives late changes nothing.
+type deliveryMark struct {
+	ID     int64  `json:"id"`
+	From   string `json:"from"`
+	Status string `json:"status"`
+	// Attempts is the number of attempts made so far; zero keeps the stored count
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// deliverPendingWebhooks attempts every delivery that is due. Under raft the outcomes are
+// replicated, so that a new leader does not deliver again what the previous one delivered.
+func deliverPendingWebhooks(now time.Time) error {
+	if cluster != nil {
+		return deliverWebhooks(cluster.db, now, cluster.markDeliveries)
+	}
+	return deliverWebhooks(db, now, func(marks []deliveryMark, now time.Time) (int, error) {
+		return markDeliveries(db, marks, now)
+	})
+}
+
+// deliverWebhooks attempts the due deliveries in conn's outbox, and hands their outcomes to record
+func deliverWebhooks(conn *sql.DB, now time.Time, record func([]deliveryMark, time.Time) (int, error)) error {
+	rows, err := conn.Query(`
+		SELECT id, webhook, event_type, payload, attempts
+		FROM webhook_outbox
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY id
+		LIMIT ?`,
+		DeliveryPending, now, webhookBatchSize,
+	)
+	if err != nil {
+		return err
+	}
+
+	type due struct {
+		id        int64
+		webhook   string
+		eventType string
+		payload   string
+		attempts  int
+	}
+	var pending []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.webhook, &d.eventType, &d.payload, &d.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var marks []deliveryMark
+	for _, d := range pending {
+		mark := deliveryMark{ID: d.id, From: DeliveryPending}
+		hook, ok := webhookByName(d.webhook)
+		if !ok {
+			// The webhook was removed from the config; nothing will ever deliver this
+			mark.Status, mark.Attempts, mark.LastError = DeliveryFailed, d.attempts, "webhook no longer configured"
+			marks = append(marks, mark)
+			continue
+		}
+
+		mark.Attempts = d.attempts + 1
+		err := postWebhook(hook, d.id, d.eventType, []byte(d.payload), time.Now())
+		switch {
+		case err == nil:
+			mark.Status = DeliveryDelivered
+		case mark.Attempts >= hook.MaxAttempts:
+			log.Printf("Webhook %s gave up on delivery %d after %d attempts: %v", hook.Name, d.id, mark.Attempts, err)
+			mark.Status, mark.LastError = DeliveryFailed, err.Error()
+		default:
+			next := time.Now().Add(webhookBackoff(mark.Attempts))
+			mark.Status, mark.NextAttemptAt, mark.LastError = DeliveryPending, &next, err.Error()
+		}
+		marks = append(marks, mark)
+	}
+
+	if len(marks) == 0 {
+		return nil
+	}
+	_, err = record(marks, time.Now())
+	return err
+}
+
+// postWebhook sends one signed payload. The signature is an HMAC-SHA256 over
+// "<timestamp>.<body>" using the webhook's secret.
+func postWebhook(hook WebhookConfig, deliveryID int64, eventType string, payload []byte, now time.Time) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Registry-Event", eventType)
+	req.Header.Set("X-Registry-Delivery", strconv.FormatInt(deliveryID, 10))
+	req.Header.Set("X-Registry-Timestamp", timestamp)
+	if hook.Secret != "" {
+		req.Header.Set("X-Registry-Signature", "sha256="+signWebhook(hook.Secret, timestamp, payload))
+	}
+
+	client := *webhookClient
+	client.Timeout = hook.Timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<payload>"
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff doubles the delay with every failed attempt, with up to 20% jitter
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookBaseBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// markDeliveries applies delivery outcomes recorded at now, and returns how many applied
+func markDeliveries(q queryer, marks []deliveryMark, now time.Time) (int, error) {
+	marked := 0
+	for _, m := range marks {
+		var deliveredAt interface{}
+		if m.Status == DeliveryDelivered {
+			deliveredAt = now
+		}
+		var next interface{}
+		if m.NextAttemptAt != nil {
+			next = m.NextAttemptAt.Local()
+		}
+
+		result, err := q.Exec(`
+			UPDATE webhook_outbox
+			SET status = ?, attempts = COALESCE(NULLIF(?, 0), attempts), next_attempt_at = ?, last_error = ?, delivered_at = ?
+			WHERE id = ? AND status = ?`,
+			m.Status, m.Attempts, next, sql.NullString{String: m.LastError, Valid: m.LastError != ""}, deliveredAt,
+			m.ID, m.From,
+		)
+		if err != nil {
+			return marked, fmt.Errorf("update webhook delivery %d: %w", m.ID, err)
+		}
+		n, _ := result.RowsAffected()
+		marked += int(n)
+	}
+	return marked, nil
+}
+
+// pruneWebhookOutbox deletes the deliveries that finished longer than server.webhook_retention
+// ago: delivered ones by their delivery time, and failed ones by the time they were queued.
+// Pending deliveries are kept however old they are.
+func pruneWebhookOutbox(now time.Time) (int64, error) {
+	cutoff := now.Add(-config.Server.WebhookRetention)
+	result, err := db.Exec(`
+		DELETE FROM webhook_outbox
+		WHERE (status = ? AND delivered_at < ?) OR (status = ? AND created_at < ?)`,
+		DeliveryDelivered, cutoff, DeliveryFailed, cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// loadOutbox reads every row of the outbox
+func loadOutbox(q queryer) ([]outboxRecord, error) {
+	rows, err := q.Query(`
+		SELECT id, webhook, event_id, event_type, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at
+		FROM webhook_outbox
+		ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []outboxRecord
+	for rows.Next() {
+		var r outboxRecord
+		var next, delivered sql.NullTime
+		var lastError sql.NullString
+		err := rows.Scan(&r.ID, &r.Webhook, &r.EventID, &r.EventType, &r.Payload, &r.Status, &r.Attempts,
+			&next, &lastError, &r.CreatedAt, &delivered)
+		if err != nil {
+			return nil, err
+		}
+		if next.Valid {
+			r.NextAttemptAt = &next.Time
+		}
+		if delivered.Valid {
+			r.DeliveredAt = &delivered.Time
+		}
+		r.LastError = lastError.String
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// replaceOutbox replaces every row of the outbox with records
+func replaceOutbox(q queryer, records []outboxRecord) error {
+	if _, err := q.Exec(`DELETE FROM webhook_outbox`); err != nil {
+		return err
+	}
+	for _, r := range records {
+		var next, delivered interface{}
+		if r.NextAttemptAt != nil {
+			next = r.NextAttemptAt.Local()
+		}
+		if r.DeliveredAt != nil {
+			delivered = r.DeliveredAt.Local()
+		}
+		_, err := q.Exec(`
+			INSERT INTO webhook_outbox (id, webhook, event_id, event_type, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			r.ID, r.Webhook, r.EventID, r.EventType, r.Payload, r.Status, r.Attempts,
+			next, sql.NullString{String: r.LastError, Valid: r.LastError != ""}, r.CreatedAt.Local(), delivered,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func webhookByName(name string) (WebhookConfig, bool) {
+	for _, hook := range config.Webhooks {
+		if hook.Name == name {
+			return hook, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+// webhooksHandler lists the configured webhooks with delivery counts per status
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type webhookStatus struct {
+		Name   string         `json:"name"`
+		URL    string         `json:"url"`
+		Events []string       `json:"events,omitempty"`
+		Counts map[string]int `json:"deliveries"`
+	}
+
+	statuses := make([]webhookStatus, 0, len(config.Webhooks))
+	for _, hook := range config.Webhooks {
+		status := webhookStatus{Name: hook.Name, URL: hook.URL, Events: hook.Events, Counts: map[string]int{
+			DeliveryPending:   0,
+			DeliveryDelivered: 0,
+			DeliveryFailed:    0,
+		}}
+
+		rows, err := db.Query(`SELECT status, COUNT(*) FROM webhook_outbox WHERE webhook = ? GROUP BY status`, hook.Name)
+		if err != nil {
+			log.Printf("Error counting webhook deliveries: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var s string
+			var n int
+			if err := rows.Scan(&s, &n); err == nil {
+				status.Counts[s] = n
+			}
+		}
+		rows.Close()
+
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// webhookDeliveriesHandler lists recent deliveries, optionally filtered by webhook and status
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := `
+		SELECT id, webhook, event_id, event_type, status, attempts, next_attempt_at, last_error, created_at, delivered_at
+		FROM webhook_outbox
+		WHERE 1 = 1`
+	var args []interface{}
+	if webhook := r.URL.Query().Get("webhook"); webhook != "" {
+		query += ` AND webhook = ?`
+		args = append(args, webhook)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+
+	limit := 100
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error fetching webhook deliveries: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var next, delivered sql.NullTime
+		var lastError sql.NullString
+		err := rows.Scan(&d.ID, &d.Webhook, &d.EventID, &d.EventType, &d.Status, &d.Attempts,
+			&next, &lastError, &d.CreatedAt, &delivered)
+		if err != nil {
+			log.Printf("Error scanning row: %v", err)
+			continue
+		}
+		if next.Valid && d.Status == DeliveryPending {
+			d.NextAttemptAt = &next.Time
+		}
+		if delivered.Valid {
+			d.DeliveredAt = &delivered.Time
+		}
+		d.LastError = lastError.String
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Rows iteration error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// webhookRetryHandler requeues a failed delivery for immediate redelivery. The delivery keeps
+// its attempt count, so it gets one more attempt rather than another max_attempts.
+func webhookRetryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery id", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	requeue := []deliveryMark{{ID: id, From: DeliveryFailed, Status: DeliveryPending, NextAttemptAt: &now}}
+	var requeued int
+	if cluster != nil {
+		requeued, err = cluster.markDeliveries(requeue, now)
+	} else {
+		requeued, err = markDeliveries(db, requeue, now)
+	}
+	if err != nil {
+		log.Printf("Error requeueing webhook delivery %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if requeued == 0 {
+		http.Error(w, "No failed delivery with that id", http.StatusNotFound)
+		return
+	}
+
+	wakeWebhookDispatcher()
+
+	log.Printf("Webhook delivery %d requeued", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Delivery requeued",
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	status   int
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests = append(rec.requests, r)
+	rec.bodies = append(rec.bodies, body)
+	w.WriteHeader(rec.status)
+}
+
+func deliveryStatus(t *testing.T, webhook string) (status string, attempts int) {
+	t.Helper()
+
+	err := db.QueryRow(`SELECT status, attempts FROM webhook_outbox WHERE webhook = ?`, webhook).Scan(&status, &attempts)
+	if err != nil {
+		t.Fatalf("read outbox for %s: %v", webhook, err)
+	}
+	return status, attempts
+}
+
+func TestWebhookDeliversSignedPayload(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+
+	rec := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	config.Webhooks = []WebhookConfig{
+		{Name: "ops", URL: server.URL, Secret: "s3cret", Events: []string{"reap"}, Timeout: time.Second, MaxAttempts: 3},
+	}
+
+	enqueueWebhookEvents(db, []Event{
+		{ID: 7, Type: EventAllocate, ClientID: "a", Identifier: "vm-1"},
+		{ID: 8, Type: EventReap, ClientID: "a", Identifier: "vm-1"},
+	}, 0)
+
+	if err := deliverPendingWebhooks(time.Now()); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+
+	// Only the subscribed event type is delivered
+	if len(rec.requests) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(rec.requests))
+	}
+	req, body := rec.requests[0], rec.bodies[0]
+
+	var got Event
+	if err := json.Unmarshal(body, &got); err != nil || got.ID != 8 || got.Type != EventReap {
+		t.Fatalf("payload = %s (%v)", body, err)
+	}
+
+	want := "sha256=" + signWebhook("s3cret", req.Header.Get("X-Registry-Timestamp"), body)
+	if sig := req.Header.Get("X-Registry-Signature"); sig != want {
+		t.Fatalf("signature = %q, want %q", sig, want)
+	}
+
+	if status, attempts := deliveryStatus(t, "ops"); status != DeliveryDelivered || attempts != 1 {
+		t.Fatalf("outbox = %s after %d attempts, want delivered after 1", status, attempts)
+	}
+}
+
+func TestWebhookRetriesThenFails(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+
+	rec := &webhookReceiver{status: http.StatusInternalServerError}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	config.Webhooks = []WebhookConfig{
+		{Name: "flaky", URL: server.URL, Timeout: time.Second, MaxAttempts: 2},
+	}
+
+	enqueueWebhookEvents(db, []Event{{ID: 1, Type: EventRelease, ClientID: "a", Identifier: "vm-1"}}, 0)
+
+	now := time.Now()
+	deliverPendingWebhooks(now)
+	if status, attempts := deliveryStatus(t, "flaky"); status != DeliveryPending || attempts != 1 {
+		t.Fatalf("outbox = %s after %d attempts, want pending after 1", status, attempts)
+	}
+
+	// The retry is backed off, so nothing is due yet
+	deliverPendingWebhooks(now)
+	if len(rec.requests) != 1 {
+		t.Fatalf("retried before backoff elapsed: %d requests", len(rec.requests))
+	}
+
+	deliverPendingWebhooks(now.Add(webhookMaxBackoff * 2))
+	if status, attempts := deliveryStatus(t, "flaky"); status != DeliveryFailed || attempts != 2 {
+		t.Fatalf("outbox = %s after %d attempts, want failed after 2", status, attempts)
+	}
+
+	// A requeued delivery keeps its attempts and gets one more
+	var id int64
+	db.QueryRow(`SELECT id FROM webhook_outbox WHERE webhook = 'flaky'`).Scan(&id)
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/webhooks/deliveries/%d/retry", id), nil)
+	req.SetPathValue("id", fmt.Sprint(id))
+	w := httptest.NewRecorder()
+	webhookRetryHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("retry = %d %s", w.Code, w.Body.String())
+	}
+	if status, attempts := deliveryStatus(t, "flaky"); status != DeliveryPending || attempts != 2 {
+		t.Fatalf("outbox = %s after %d attempts, want pending after 2", status, attempts)
+	}
+
+	deliverPendingWebhooks(time.Now().Add(time.Second))
+	if status, attempts := deliveryStatus(t, "flaky"); status != DeliveryFailed || attempts != 3 {
+		t.Fatalf("outbox = %s after %d attempts, want failed after 3", status, attempts)
+	}
+}
+
+func TestWebhookDeliveriesCommitWithTheChange(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+
+	config.Webhooks = []WebhookConfig{{Name: "ops", URL: "http://127.0.0.1:0", Timeout: time.Second, MaxAttempts: 3}}
+
+	if _, err := allocateIdentifiers(DefaultPool, "a", 1, 0, nil, time.Now()); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	var eventType string
+	if err := db.QueryRow(`SELECT event_type FROM webhook_outbox`).Scan(&eventType); err != nil || eventType != string(EventAllocate) {
+		t.Fatalf("outbox after allocation = %q (%v)", eventType, err)
+	}
+
+	// A release that fails leaves neither the change nor its delivery behind
+	_, err := db.Exec(`
+		CREATE TRIGGER fail_release BEFORE UPDATE ON identifiers WHEN NEW.locked_by IS NULL
+		BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+	if err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+	if _, err := releaseIdentifiers("a", "", time.Now()); err == nil {
+		t.Fatal("release succeeded despite the trigger")
+	}
+
+	var queued int
+	db.QueryRow(`SELECT COUNT(*) FROM webhook_outbox`).Scan(&queued)
+	if queued != 1 {
+		t.Fatalf("outbox holds %d deliveries after a failed release, want 1", queued)
+	}
+}
+
+func TestWebhookOutboxPrunesFinishedDeliveries(t *testing.T) {
+	setupTestDB(t, StrategyLowestFirst, "vm-[1-2]")
+	config.Server.WebhookRetention = time.Hour
+	config.Webhooks = []WebhookConfig{{Name: "ops", URL: "http://127.0.0.1:0", Timeout: time.Second, MaxAttempts: 3}}
+
+	enqueueWebhookEvents(db, []Event{
+		{ID: 1, Type: EventAllocate},
+		{ID: 2, Type: EventRelease},
+		{ID: 3, Type: EventReap},
+		{ID: 4, Type: EventConflict},
+	}, 0)
+	old := time.Now().Add(-2 * time.Hour)
+	db.Exec(`UPDATE webhook_outbox SET created_at = ?`, old)
+	db.Exec(`UPDATE webhook_outbox SET status = ?, delivered_at = ? WHERE event_id = 1`, DeliveryDelivered, old)
+	db.Exec(`UPDATE webhook_outbox SET status = ?, delivered_at = ? WHERE event_id = 2`, DeliveryDelivered, time.Now())
+	db.Exec(`UPDATE webhook_outbox SET status = ? WHERE event_id = 3`, DeliveryFailed)
+
+	pruned, err := pruneWebhookOutbox(time.Now())
+	if err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if pruned != 2 {
+		t.Fatalf("pruned %d deliveries, want the old delivered and failed ones", pruned)
+	}
+
+	// The recent delivery and the pending one, however old, are kept
+	var kept []uint64
+	rows, _ := db.Query(`SELECT event_id FROM webhook_outbox ORDER BY event_id`)
+	for rows.Next() {
+		var id uint64
+		rows.Scan(&id)
+		kept = append(kept, id)
+	}
+	rows.Close()
+	if len(kept) != 2 || kept[0] != 2 || kept[1] != 4 {
+		t.Fatalf("kept events %v, want [2 4]", kept)
+	}
+}
+
+func TestLoadConfigRejectsUnknownWebhookEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(events string) {
+		t.Helper()
+		data := "server:\n  stale_timeout: 90s\nwebhooks:\n  - name: ops\n    url: http://hooks.example.com\n    events: " + events + "\n"
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`["reap", "heartbeat_lost"]`)
+	if _, err := LoadConfig(path); err != nil {
+		t.Fatalf("known events rejected: %v", err)
+	}
+
+	write(`["reap", "reaped"]`)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), `"reaped"`) {
+		t.Fatalf("unknown event accepted: %v", err)
+	}
+}